@@ -0,0 +1,740 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Adaptive Lighting characteristics. These aren't in the public HAP
+// specification (or the hap module), so the types and their TLV8 formats
+// follow HAP-NodeJS.
+const (
+	typeSupportedValueTransitionConfiguration = "144"
+	typeValueTransitionControl                = "143"
+	typeValueActiveTransitionCount            = "24B"
+)
+
+// TLV8 item types
+const (
+	// SupportedCharacteristicValueTransitionConfiguration
+	tlvSupportedConfiguration   = 0x01
+	tlvSupportedIID             = 0x01
+	tlvSupportedTransitionType  = 0x02
+	transitionTypeBrightness    = 0x01
+	transitionTypeColorTemp     = 0x02
+	tlvControlRead              = 0x01
+	tlvControlUpdate            = 0x02
+	tlvReadIID                  = 0x01
+	tlvUpdateConfiguration      = 0x01
+	tlvConfigIID                = 0x01
+	tlvConfigParameters         = 0x02
+	tlvConfigCurve              = 0x05
+	tlvConfigUpdateInterval     = 0x06
+	tlvConfigNotifyThreshold    = 0x08
+	tlvParametersStartTime      = 0x02
+	tlvCurveEntries             = 0x01
+	tlvCurveAdjustmentRange     = 0x03
+	tlvRangeMin                 = 0x01
+	tlvRangeMax                 = 0x02
+	tlvEntryAdjustmentFactor    = 0x01
+	tlvEntryValue               = 0x02
+	tlvEntryTransitionOffset    = 0x03
+	tlvEntryDuration            = 0x04
+	tlvResponseStatus           = 0x01
+	tlvStatusIID                = 0x01
+	tlvStatusParameters         = 0x02
+	tlvStatusTimeSinceStart     = 0x03
+	adaptiveLightingStoreKey    = "adaptive-lighting"
+	defaultTransitionUpdateRate = time.Minute
+)
+
+// hapStatusInvalidValue is the HAP status code for "Invalid value in
+// request"
+const hapStatusInvalidValue = -70410
+
+// hapEpoch is the reference date for transition start times
+var hapEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// transition is a color temperature schedule written by a HomeKit controller.
+// It's a curve of color temperatures over time, adjusted up or down
+// depending on the current brightness.
+type transition struct {
+	start time.Time
+	// config is the raw configuration, kept so it can be persisted and
+	// restored
+	config []byte
+	// params are echoed back to the controller in status responses
+	params  []byte
+	entries []transitionEntry
+	// brightness is clamped to this range before being multiplied by each
+	// entry's adjustment factor
+	minAdjustment, maxAdjustment float64
+	// updateInterval is how often the color temperature should be updated
+	updateInterval time.Duration
+	// notifyThreshold is the minimum time between event notifications for
+	// color temperature changes
+	notifyThreshold time.Duration
+	iid             uint64
+}
+
+type transitionEntry struct {
+	adjustmentFactor float64
+	// value is the color temperature in mireds
+	value float64
+	// offset is the time since the previous entry, during which the color
+	// temperature changes from the previous entry's value to this one's
+	offset time.Duration
+	// duration is how long to hold this entry's value before moving towards
+	// the next entry
+	duration time.Duration
+}
+
+// parseTransition parses a value transition configuration. A configuration
+// with no parameters or curve turns the transition off, and is returned with
+// no entries.
+func parseTransition(config []byte) (*transition, error) {
+	items, err := decodeTLV(config)
+	if err != nil {
+		return nil, err
+	}
+
+	b, ok := items.get(tlvConfigIID)
+	if !ok {
+		return nil, errors.New("transition configuration has no characteristic IID")
+	}
+	iid, err := parseTLVUint(b)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &transition{
+		iid:            iid,
+		config:         config,
+		maxAdjustment:  100,
+		updateInterval: defaultTransitionUpdateRate,
+	}
+
+	params, hasParams := items.get(tlvConfigParameters)
+	curve, hasCurve := items.get(tlvConfigCurve)
+	if !hasParams || !hasCurve {
+		return t, nil
+	}
+
+	if err := t.parseParams(params); err != nil {
+		return nil, err
+	}
+	if err := t.parseIntervals(items); err != nil {
+		return nil, err
+	}
+	if err := t.parseCurve(curve); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// parseParams parses the transition's parameters, which are kept to echo
+// back to the controller
+func (t *transition) parseParams(params []byte) error {
+	t.params = params
+	p, err := decodeTLV(params)
+	if err != nil {
+		return err
+	}
+	b, ok := p.get(tlvParametersStartTime)
+	if !ok {
+		return errors.New("transition parameters have no start time")
+	}
+	start, err := parseTLVUint(b)
+	if err != nil {
+		return err
+	}
+	t.start = hapEpoch.Add(time.Duration(start) * time.Millisecond)
+	return nil
+}
+
+// parseIntervals parses the optional update interval and notification
+// threshold from the transition's configuration
+func (t *transition) parseIntervals(items tlvItems) error {
+	if b, ok := items.get(tlvConfigUpdateInterval); ok {
+		ms, err := parseTLVUint(b)
+		if err != nil {
+			return err
+		}
+		t.updateInterval = max(time.Duration(ms)*time.Millisecond, time.Second)
+	}
+	if b, ok := items.get(tlvConfigNotifyThreshold); ok {
+		ms, err := parseTLVUint(b)
+		if err != nil {
+			return err
+		}
+		t.notifyThreshold = time.Duration(ms) * time.Millisecond
+	}
+	return nil
+}
+
+func (t *transition) parseCurve(curve []byte) error {
+	c, err := decodeTLV(curve)
+	if err != nil {
+		return err
+	}
+
+	if b, ok := c.get(tlvCurveAdjustmentRange); ok {
+		if err := t.parseAdjustmentRange(b); err != nil {
+			return err
+		}
+	}
+
+	b, ok := c.get(tlvCurveEntries)
+	if !ok {
+		return errors.New("transition curve has no entries")
+	}
+	items, err := decodeTLV(b)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items.split(tlvEntryAdjustmentFactor) {
+		e, err := parseTransitionEntry(item)
+		if err != nil {
+			return err
+		}
+		t.entries = append(t.entries, e)
+	}
+	if len(t.entries) == 0 {
+		return errors.New("transition curve has no entries")
+	}
+
+	return nil
+}
+
+// parseAdjustmentRange parses the range brightness is clamped to before
+// adjusting the curve's values
+func (t *transition) parseAdjustmentRange(b []byte) error {
+	r, err := decodeTLV(b)
+	if err != nil {
+		return err
+	}
+	if b, ok := r.get(tlvRangeMin); ok {
+		v, err := parseTLVUint(b)
+		if err != nil {
+			return err
+		}
+		t.minAdjustment = float64(v)
+	}
+	if b, ok := r.get(tlvRangeMax); ok {
+		v, err := parseTLVUint(b)
+		if err != nil {
+			return err
+		}
+		t.maxAdjustment = float64(v)
+	}
+	return nil
+}
+
+func parseTransitionEntry(items tlvItems) (e transitionEntry, err error) {
+	b, ok := items.get(tlvEntryAdjustmentFactor)
+	if !ok {
+		return e, errors.New("transition entry has no adjustment factor")
+	}
+	if e.adjustmentFactor, err = parseTLVFloat(b); err != nil {
+		return e, err
+	}
+
+	b, ok = items.get(tlvEntryValue)
+	if !ok {
+		return e, errors.New("transition entry has no value")
+	}
+	if e.value, err = parseTLVFloat(b); err != nil {
+		return e, err
+	}
+
+	if b, ok := items.get(tlvEntryTransitionOffset); ok {
+		ms, err := parseTLVUint(b)
+		if err != nil {
+			return e, err
+		}
+		e.offset = time.Duration(ms) * time.Millisecond
+	}
+
+	if b, ok := items.get(tlvEntryDuration); ok {
+		ms, err := parseTLVUint(b)
+		if err != nil {
+			return e, err
+		}
+		e.duration = time.Duration(ms) * time.Millisecond
+	}
+
+	return e, nil
+}
+
+// valueAt returns the color temperature (in mireds) at the given time since
+// the start of the transition, for the given brightness (percent). It
+// returns false once the curve has ended.
+func (t *transition) valueAt(elapsed time.Duration, brightness int) (float64, bool) {
+	multiplier := math.Max(t.minAdjustment, math.Min(t.maxAdjustment, float64(brightness)))
+	value := func(e transitionEntry) float64 {
+		return e.value + e.adjustmentFactor*multiplier
+	}
+
+	if elapsed < t.entries[0].offset {
+		return value(t.entries[0]), true
+	}
+
+	lowerStart := time.Duration(0)
+	for i := 0; i+1 < len(t.entries); i++ {
+		lower, upper := t.entries[i], t.entries[i+1]
+		lowerStart += lower.offset
+		holdEnd := lowerStart + lower.duration
+
+		if elapsed <= holdEnd+upper.offset {
+			if elapsed <= holdEnd {
+				return value(lower), true
+			}
+			p := float64(elapsed-holdEnd) / float64(upper.offset)
+			return value(lower) + (value(upper)-value(lower))*p, true
+		}
+
+		lowerStart = holdEnd
+	}
+
+	return 0, false
+}
+
+// adaptiveLighting implements HomeKit's Adaptive Lighting. The controller
+// writes a transition (a color temperature curve covering the next day or
+// so), and the bridge follows it on its own, updating the strip and the
+// lightbulb's characteristics as time passes.
+type adaptiveLighting struct {
+	lb    *service.ColoredLightbulb
+	strip *wifineopixel
+	store hap.Store
+
+	temp      *characteristic.ColorTemperature
+	supported *characteristic.Bytes
+	control   *characteristic.Bytes
+	count     *characteristic.Int
+
+	active *transition
+	// onActivate is called when a transition becomes active, so other
+	// modes that set the color temperature can be turned off
+	onActivate func(ctx context.Context)
+	// stop cancels the active transition's update loop
+	stop       context.CancelFunc
+	lastNotify time.Time
+	now        func() time.Time
+	mu         sync.Mutex
+}
+
+// initAdaptiveLighting adds the color temperature and transition
+// characteristics to the lightbulb, and wires them up to the strip. The
+// active transition is persisted in store - call restore once the
+// accessory's characteristic IDs have been assigned to resume it.
+func initAdaptiveLighting(ctx context.Context, acc *accessory.ColoredLightbulb, strip *wifineopixel, store hap.Store) *adaptiveLighting {
+	lb := acc.Lightbulb
+	a := &adaptiveLighting{
+		lb:    lb,
+		strip: strip,
+		store: store,
+		now:   time.Now,
+	}
+
+	a.temp = characteristic.NewColorTemperature()
+
+	a.supported = characteristic.NewBytes(typeSupportedValueTransitionConfiguration)
+	a.supported.Permissions = []string{characteristic.PermissionRead}
+	a.supported.SetValue(nil)
+
+	a.control = characteristic.NewBytes(typeValueTransitionControl)
+	a.control.Permissions = []string{
+		characteristic.PermissionRead, characteristic.PermissionWrite, characteristic.PermissionWriteResponse,
+	}
+	a.control.SetValue(nil)
+
+	a.count = characteristic.NewInt(typeValueActiveTransitionCount)
+	a.count.Format = characteristic.FormatUInt8
+	a.count.Permissions = []string{characteristic.PermissionRead, characteristic.PermissionEvents}
+	_ = a.count.SetValue(0)
+
+	for _, c := range []*characteristic.C{a.temp.C, a.supported.C, a.control.C, a.count.C} {
+		lb.AddC(c)
+	}
+
+	a.initResponders(ctx)
+
+	return a
+}
+
+func (a *adaptiveLighting) initResponders(ctx context.Context) {
+	tracer := otel.Tracer("")
+	log := zerolog.Ctx(ctx)
+
+	a.temp.ValueRequestFunc = cachedValueRequest(a.temp.C, a.strip)
+	a.temp.OnSetRemoteValue(func(value int) error {
+		ctx, span := tracer.Start(ctx, "lb.ColorTemperature.OnSetRemoteValue")
+		defer span.End()
+		span.SetAttributes(attribute.Int("value", value))
+
+		start := time.Now()
+		log.Debug().Int("mired", value).Msg("Changed ColorTemperature")
+		a.deactivate(ctx, "color temperature changed")
+		err := a.setColorTemperature(ctx, value, a.lb.Brightness.Value())
+		observeUpdateDuration("temp", "remoteUpdate", start)
+		return err
+	})
+
+	a.supported.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+		return base64.StdEncoding.EncodeToString(a.supportedConfiguration()), 0
+	}
+
+	a.control.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return base64.StdEncoding.EncodeToString(a.status()), 0
+	}
+	a.control.SetValueRequestFunc = func(v interface{}, _ *http.Request) (interface{}, int) {
+		ctx, span := tracer.Start(ctx, "lb.ValueTransitionControl.OnSetRemoteValue")
+		defer span.End()
+
+		s, _ := v.(string)
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err == nil {
+			b, err = a.handleControl(ctx, b)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("invalid transition control request")
+			span.RecordError(err)
+			return nil, hapStatusInvalidValue
+		}
+		return base64.StdEncoding.EncodeToString(b), 0
+	}
+	// the write is stored as the characteristic's value, and identical
+	// writes are ignored, so clear it to make sure every request is handled
+	a.control.OnCValueUpdate(func(c *characteristic.C, _, _ interface{}, _ *http.Request) {
+		c.Val = ""
+	})
+
+	// manual color changes turn Adaptive Lighting off, as in the Home app
+	a.lb.Hue.OnValueRemoteUpdate(func(float64) {
+		a.deactivate(ctx, "hue changed")
+	})
+	a.lb.Saturation.OnValueRemoteUpdate(func(float64) {
+		a.deactivate(ctx, "saturation changed")
+	})
+
+	// the curve depends on the brightness, so while a transition is active
+	// the strip is set to its color temperature for the new brightness,
+	// instead of the current color
+	setBrightness := a.lb.Brightness.SetValueRequestFunc
+	a.lb.Brightness.SetValueRequestFunc = func(v interface{}, r *http.Request) (interface{}, int) {
+		bri, _ := v.(int)
+		handled, err := a.setBrightness(ctx, bri)
+		switch {
+		case !handled && setBrightness != nil:
+			return setBrightness(v, r)
+		case err != nil:
+			log.Error().Err(err).Int("brightness", bri).Msg("error setting adaptive lighting brightness")
+			return nil, hapStatusCommunicationFailure
+		default:
+			return nil, 0
+		}
+	}
+
+	// the strip shouldn't show a stale color temperature when it's turned
+	// back on
+	a.lb.On.OnValueRemoteUpdate(func(on bool) {
+		if on {
+			a.update(ctx)
+		}
+	})
+}
+
+// supportedConfiguration lists the characteristics that transitions can
+// be written for
+func (a *adaptiveLighting) supportedConfiguration() []byte {
+	brightness := appendTLV(nil, tlvSupportedIID, tlvUint(a.lb.Brightness.Id))
+	brightness = appendTLV(brightness, tlvSupportedTransitionType, []byte{transitionTypeBrightness})
+
+	temp := appendTLV(nil, tlvSupportedIID, tlvUint(a.temp.Id))
+	temp = appendTLV(temp, tlvSupportedTransitionType, []byte{transitionTypeColorTemp})
+
+	return appendTLVList(nil, tlvSupportedConfiguration, brightness, temp)
+}
+
+// handleControl handles a write to the transition control point, returning
+// the response to send to the controller
+func (a *adaptiveLighting) handleControl(ctx context.Context, b []byte) ([]byte, error) {
+	items, err := decodeTLV(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := items.get(tlvControlRead); ok {
+		return a.handleRead(v)
+	}
+	if v, ok := items.get(tlvControlUpdate); ok {
+		return a.handleUpdate(ctx, v)
+	}
+	return nil, errors.New("unsupported transition control request")
+}
+
+// handleRead responds to a request for the active transition's status
+func (a *adaptiveLighting) handleRead(v []byte) ([]byte, error) {
+	r, err := decodeTLV(v)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := r.get(tlvReadIID)
+	iid, err := parseTLVUint(b)
+	if err != nil {
+		return nil, err
+	}
+	if iid != a.temp.Id {
+		return nil, fmt.Errorf("unsupported characteristic IID %d", iid)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.status(), nil
+}
+
+// handleUpdate starts a new transition, or stops the active one
+func (a *adaptiveLighting) handleUpdate(ctx context.Context, v []byte) ([]byte, error) {
+	u, err := decodeTLV(v)
+	if err != nil {
+		return nil, err
+	}
+	config, ok := u.get(tlvUpdateConfiguration)
+	if !ok {
+		return nil, errors.New("transition update has no configuration")
+	}
+
+	t, err := parseTransition(config)
+	if err != nil {
+		return nil, err
+	}
+	if t.iid != a.temp.Id {
+		return nil, fmt.Errorf("unsupported characteristic IID %d", t.iid)
+	}
+
+	if len(t.entries) == 0 {
+		a.deactivate(ctx, "turned off by controller")
+		return []byte{}, nil
+	}
+
+	if err := a.store.Set(adaptiveLightingStoreKey, t.config); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to persist adaptive lighting transition")
+	}
+	a.activate(ctx, t)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.status(), nil
+}
+
+// status describes the active transition, or is empty when there isn't one.
+// a.mu must be held.
+func (a *adaptiveLighting) status() []byte {
+	t := a.active
+	if t == nil {
+		return []byte{}
+	}
+
+	elapsed := max(a.now().Sub(t.start), 0)
+
+	s := appendTLV(nil, tlvStatusIID, tlvUint(t.iid))
+	s = appendTLV(s, tlvStatusParameters, t.params)
+	s = appendTLV(s, tlvStatusTimeSinceStart, tlvUint(uint64(elapsed.Milliseconds())))
+	return appendTLV(nil, tlvResponseStatus, s)
+}
+
+// restore resumes the transition saved in the store, if there is one and
+// it hasn't ended yet
+func (a *adaptiveLighting) restore(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+
+	b, err := a.store.Get(adaptiveLightingStoreKey)
+	if err != nil || len(b) == 0 {
+		return
+	}
+
+	t, err := parseTransition(b)
+	switch {
+	case err != nil:
+		log.Warn().Err(err).Msg("discarding invalid saved adaptive lighting transition")
+	case t.iid != a.temp.Id || len(t.entries) == 0:
+		log.Warn().Msg("discarding saved adaptive lighting transition for a different characteristic")
+	default:
+		if _, ok := t.valueAt(a.now().Sub(t.start), a.lb.Brightness.Value()); ok {
+			log.Info().Time("start", t.start).Msg("resuming adaptive lighting")
+			a.activate(ctx, t)
+			return
+		}
+	}
+
+	_ = a.store.Delete(adaptiveLightingStoreKey)
+}
+
+// activate makes t the active transition, applies it, and starts updating
+// the color temperature periodically
+func (a *adaptiveLighting) activate(ctx context.Context, t *transition) {
+	a.mu.Lock()
+	if a.stop != nil {
+		a.stop()
+	}
+	a.active = t
+	a.lastNotify = time.Time{}
+	runCtx, stop := context.WithCancel(ctx)
+	a.stop = stop
+	a.mu.Unlock()
+
+	if a.onActivate != nil {
+		a.onActivate(ctx)
+	}
+
+	_ = a.count.SetValue(1)
+	a.update(ctx)
+
+	go func() {
+		tick := time.NewTicker(t.updateInterval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-tick.C:
+				a.update(runCtx)
+			}
+		}
+	}()
+}
+
+// deactivate turns Adaptive Lighting off, if it's on
+func (a *adaptiveLighting) deactivate(ctx context.Context, reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.deactivateLocked(ctx, reason)
+}
+
+func (a *adaptiveLighting) deactivateLocked(ctx context.Context, reason string) {
+	if a.active == nil {
+		return
+	}
+
+	zerolog.Ctx(ctx).Info().Str("reason", reason).Msg("adaptive lighting turned off")
+
+	a.stop()
+	a.stop = nil
+	a.active = nil
+	_ = a.count.SetValue(0)
+	_ = a.store.Delete(adaptiveLightingStoreKey)
+}
+
+// update sets the color temperature from the active transition's curve
+func (a *adaptiveLighting) update(ctx context.Context) {
+	bri := a.lb.Brightness.Value()
+
+	a.mu.Lock()
+	mired, ok := a.step(ctx, bri)
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ctx, span := otel.Tracer("").Start(ctx, "adaptiveLighting.update")
+	defer span.End()
+	span.SetAttributes(attribute.Int("mired", mired))
+
+	if !a.lb.On.Value() {
+		// don't turn the strip on, but keep the color in step for when it
+		// is
+		hue, sat := miredToHueSat(mired)
+		a.lb.Hue.SetValue(hue)
+		a.lb.Saturation.SetValue(sat)
+		return
+	}
+
+	if err := a.setColorTemperature(ctx, mired, bri); err != nil {
+		span.RecordError(err)
+	}
+}
+
+// setBrightness handles a brightness change while a transition is active,
+// setting the strip to the curve's color temperature for the new brightness
+// in a single write. It reports false when there's no active transition, and
+// the change should be handled as usual.
+func (a *adaptiveLighting) setBrightness(ctx context.Context, bri int) (bool, error) {
+	a.mu.Lock()
+	mired, ok := a.step(ctx, bri)
+	a.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	ctx, span := otel.Tracer("").Start(ctx, "adaptiveLighting.setBrightness")
+	defer span.End()
+	span.SetAttributes(attribute.Int("mired", mired), attribute.Int("brightness", bri))
+
+	err := a.setColorTemperature(ctx, mired, bri)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return true, err
+}
+
+// step works out the active transition's color temperature (in mireds) at
+// the given brightness, and updates the color temperature characteristic.
+// It returns false when there's no active transition. a.mu must be held.
+func (a *adaptiveLighting) step(ctx context.Context, bri int) (int, bool) {
+	t := a.active
+	if t == nil {
+		return 0, false
+	}
+
+	now := a.now()
+	v, ok := t.valueAt(now.Sub(t.start), bri)
+	if !ok {
+		a.deactivateLocked(ctx, "transition ended")
+		return 0, false
+	}
+
+	mired := max(a.temp.MinValue(), min(a.temp.MaxValue(), int(math.Round(v))))
+
+	// controllers ask not to be notified of every step
+	if now.Sub(a.lastNotify) >= t.notifyThreshold {
+		_ = a.temp.SetValue(mired)
+		a.lastNotify = now
+	} else {
+		a.temp.Val = mired
+	}
+
+	return mired, true
+}
+
+// setColorTemperature sets the strip to white at the given color temperature
+// (in mireds) and brightness (percent), and updates the hue and saturation
+// to match
+func (a *adaptiveLighting) setColorTemperature(ctx context.Context, mired, bri int) error {
+	hue, sat := miredToHueSat(mired)
+	if err := updateColor(ctx, a.strip, hue, sat, bri); err != nil {
+		return err
+	}
+	a.lb.Hue.SetValue(hue)
+	a.lb.Saturation.SetValue(sat)
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCurve holds 200 mireds for an hour, moves to 300 (less the
+// brightness) over the next hour, then to 400 over the hour after that
+var testCurve = []transitionEntry{
+	{value: 200, duration: time.Hour},
+	{value: 300, adjustmentFactor: -1, offset: time.Hour},
+	{value: 400, offset: time.Hour},
+}
+
+// transitionConfig encodes a transition configuration for the
+// characteristic iid, the way a controller would write it
+func transitionConfig(iid uint64, start time.Time, entries ...transitionEntry) []byte {
+	f32 := func(v float64) []byte {
+		return binary.LittleEndian.AppendUint32(nil, math.Float32bits(float32(v)))
+	}
+	ms := func(d time.Duration) []byte {
+		return tlvUint(uint64(d.Milliseconds()))
+	}
+
+	list := []byte{}
+	for i, e := range entries {
+		if i > 0 {
+			list = append(list, 0, 0)
+		}
+		list = appendTLV(list, tlvEntryAdjustmentFactor, f32(e.adjustmentFactor))
+		list = appendTLV(list, tlvEntryValue, f32(e.value))
+		list = appendTLV(list, tlvEntryTransitionOffset, ms(e.offset))
+		if e.duration > 0 {
+			list = appendTLV(list, tlvEntryDuration, ms(e.duration))
+		}
+	}
+
+	rng := appendTLV(nil, tlvRangeMin, tlvUint(10))
+	rng = appendTLV(rng, tlvRangeMax, tlvUint(100))
+
+	curve := appendTLV(nil, tlvCurveEntries, list)
+	curve = appendTLV(curve, tlvCurveAdjustmentRange, rng)
+
+	params := appendTLV(nil, 0x01, make([]byte, 16))
+	params = appendTLV(params, tlvParametersStartTime,
+		binary.LittleEndian.AppendUint64(nil, uint64(start.Sub(hapEpoch).Milliseconds())))
+
+	cfg := appendTLV(nil, tlvConfigIID, tlvUint(iid))
+	cfg = appendTLV(cfg, tlvConfigParameters, params)
+	cfg = appendTLV(cfg, tlvConfigCurve, curve)
+	cfg = appendTLV(cfg, tlvConfigUpdateInterval, ms(time.Minute))
+	cfg = appendTLV(cfg, tlvConfigNotifyThreshold, ms(10*time.Minute))
+	return cfg
+}
+
+func TestParseTransition(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tr, err := parseTransition(transitionConfig(42, start, testCurve...))
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(42), tr.iid)
+	assert.Equal(t, start, tr.start)
+	assert.Equal(t, time.Minute, tr.updateInterval)
+	assert.Equal(t, 10*time.Minute, tr.notifyThreshold)
+	assert.Equal(t, 10.0, tr.minAdjustment)
+	assert.Equal(t, 100.0, tr.maxAdjustment)
+	assert.Equal(t, testCurve, tr.entries)
+
+	// just the IID turns the transition off
+	tr, err = parseTransition(appendTLV(nil, tlvConfigIID, tlvUint(42)))
+	require.NoError(t, err)
+	assert.Empty(t, tr.entries)
+
+	_, err = parseTransition([]byte{tlvConfigIID, 4, 1})
+	assert.Error(t, err)
+}
+
+func TestTransitionValueAt(t *testing.T) {
+	tr, err := parseTransition(transitionConfig(42, time.Now(), testCurve...))
+	require.NoError(t, err)
+
+	testdata := []struct {
+		elapsed    time.Duration
+		brightness int
+		expected   float64
+	}{
+		{0, 100, 200},
+		{30 * time.Minute, 100, 200},
+		{time.Hour, 100, 200},
+		{90 * time.Minute, 50, 225},
+		// brightness is clamped to the adjustment range
+		{90 * time.Minute, 5, 245},
+		{2 * time.Hour, 50, 250},
+		{150 * time.Minute, 50, 325},
+		{3 * time.Hour, 50, 400},
+	}
+
+	for _, d := range testdata {
+		v, ok := tr.valueAt(d.elapsed, d.brightness)
+		assert.True(t, ok, d.elapsed)
+		assert.InDelta(t, d.expected, v, 0.001, d.elapsed)
+	}
+
+	_, ok := tr.valueAt(3*time.Hour+time.Second, 100)
+	assert.False(t, ok)
+}
+
+// setupAdaptiveLighting adds Adaptive Lighting to a test bridge, with IIDs
+// assigned and the clock stopped at now
+func setupAdaptiveLighting(t *testing.T, b *testBridge, store hap.Store, now time.Time) *adaptiveLighting {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	a := initAdaptiveLighting(ctx, b.acc, b.strip, store)
+	a.now = func() time.Time { return now }
+
+	_, err := hap.NewServer(store, b.acc.A)
+	require.NoError(t, err)
+
+	return a
+}
+
+// writeControl writes a transition control request, returning the decoded
+// response
+func writeControl(t *testing.T, a *adaptiveLighting, req []byte) (tlvItems, int) {
+	t.Helper()
+
+	resp, status := a.control.SetValueRequest(base64.StdEncoding.EncodeToString(req),
+		httptest.NewRequest(http.MethodPut, "/characteristics", nil))
+	if status != 0 {
+		return nil, status
+	}
+
+	b, err := base64.StdEncoding.DecodeString(resp.(string))
+	require.NoError(t, err)
+	items, err := decodeTLV(b)
+	require.NoError(t, err)
+	return items, status
+}
+
+func updateRequest(config []byte) []byte {
+	return appendTLV(nil, tlvControlUpdate, appendTLV(nil, tlvUpdateConfiguration, config))
+}
+
+func TestAdaptiveLighting(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+	store := hap.NewMemStore()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	a := setupAdaptiveLighting(t, b, store, now)
+
+	// the supported configuration lists brightness and color temperature
+	v, status := a.supported.ValueRequest(nil)
+	require.Equal(t, 0, status)
+	raw, err := base64.StdEncoding.DecodeString(v.(string))
+	require.NoError(t, err)
+	items, err := decodeTLV(raw)
+	require.NoError(t, err)
+	require.Len(t, items.split(tlvSupportedConfiguration), 2)
+	supported := items.split(tlvSupportedConfiguration)
+	tempCfg, err := decodeTLV(supported[1][0].val)
+	require.NoError(t, err)
+	iid, _ := tempCfg.get(tlvSupportedIID)
+	assert.Equal(t, tlvUint(a.temp.Id), iid)
+
+	// a transition for another characteristic is rejected
+	_, status = writeControl(t, a, updateRequest(transitionConfig(lb.Hue.Id, now, testCurve...)))
+	assert.Equal(t, hapStatusInvalidValue, status)
+
+	b.dev.ResetRequests()
+	cfg := transitionConfig(a.temp.Id, now.Add(-30*time.Minute), testCurve...)
+	resp, status := writeControl(t, a, updateRequest(cfg))
+	require.Equal(t, 0, status)
+
+	s, ok := resp.get(tlvResponseStatus)
+	require.True(t, ok)
+	st, err := decodeTLV(s)
+	require.NoError(t, err)
+	elapsed, _ := st.get(tlvStatusTimeSinceStart)
+	ms, err := parseTLVUint(elapsed)
+	require.NoError(t, err)
+	assert.Equal(t, uint64((30 * time.Minute).Milliseconds()), ms)
+
+	assert.Equal(t, 1, a.count.Value())
+	assert.Equal(t, 200, a.temp.Value())
+	hue, sat := miredToHueSat(200)
+	assert.InDelta(t, hue, lb.Hue.Value(), 0.001)
+	assert.InDelta(t, sat, lb.Saturation.Value(), 0.001)
+	assert.Len(t, b.rawPayloads(t), 1)
+	assert.Contains(t, b.spanNames(), "adaptiveLighting.update")
+
+	saved, err := store.Get(adaptiveLightingStoreKey)
+	require.NoError(t, err)
+	assert.Equal(t, cfg, saved)
+
+	// reading the control point returns the same status
+	read := appendTLV(nil, tlvControlRead, appendTLV(nil, tlvReadIID, tlvUint(a.temp.Id)))
+	resp2, status := writeControl(t, a, read)
+	require.Equal(t, 0, status)
+	assert.Equal(t, resp, resp2)
+
+	// the curve is followed as time passes and brightness changes
+	a.now = func() time.Time { return now.Add(time.Hour) }
+	b.dev.ResetRequests()
+	require.Equal(t, 0, remoteSet(lb.Brightness, 50))
+	assert.Equal(t, 225, a.temp.Value())
+
+	// the new brightness and color temperature are written together
+	hue, sat = miredToHueSat(225)
+	assert.Equal(t, [][]uint32{solid(colorToUint32(colorful.Hsv(hue, sat/100, 0.5)), 4)}, b.rawPayloads(t))
+	assert.InDelta(t, hue, lb.Hue.Value(), 0.001)
+
+	// choosing a color turns it off
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	assert.Equal(t, 0, a.count.Value())
+	_, err = store.Get(adaptiveLightingStoreKey)
+	assert.Error(t, err)
+	resp, status = writeControl(t, a, read)
+	require.Equal(t, 0, status)
+	assert.Empty(t, resp)
+}
+
+func TestAdaptiveLightingDisable(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	store := hap.NewMemStore()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	a := setupAdaptiveLighting(t, b, store, now)
+
+	_, status := writeControl(t, a, updateRequest(transitionConfig(a.temp.Id, now, testCurve...)))
+	require.Equal(t, 0, status)
+	require.Equal(t, 1, a.count.Value())
+
+	resp, status := writeControl(t, a, updateRequest(appendTLV(nil, tlvConfigIID, tlvUint(a.temp.Id))))
+	require.Equal(t, 0, status)
+	assert.Empty(t, resp)
+	assert.Equal(t, 0, a.count.Value())
+
+	// setting the color temperature directly also turns it off
+	_, status = writeControl(t, a, updateRequest(transitionConfig(a.temp.Id, now, testCurve...)))
+	require.Equal(t, 0, status)
+	require.Equal(t, 1, a.count.Value())
+	require.Equal(t, 0, remoteSet(a.temp, 370))
+	assert.Equal(t, 0, a.count.Value())
+	assert.Equal(t, 370, a.temp.Value())
+}
+
+func TestAdaptiveLightingRestore(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	store := hap.NewMemStore()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	a := setupAdaptiveLighting(t, b, store, now)
+
+	require.NoError(t, store.Set(adaptiveLightingStoreKey,
+		transitionConfig(a.temp.Id, now.Add(-150*time.Minute), testCurve...)))
+	a.restore(context.Background())
+	assert.Equal(t, 1, a.count.Value())
+	assert.Equal(t, 300, a.temp.Value())
+
+	// a transition that has already ended is discarded
+	b = setupBridge(t, solid(red, 4))
+	a = setupAdaptiveLighting(t, b, store, now)
+	require.NoError(t, store.Set(adaptiveLightingStoreKey,
+		transitionConfig(a.temp.Id, now.Add(-4*time.Hour), testCurve...)))
+	a.restore(context.Background())
+	assert.Equal(t, 0, a.count.Value())
+	_, err := store.Get(adaptiveLightingStoreKey)
+	assert.Error(t, err)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/hairyhenderson/wnp-bridge/wnptest"
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	red   = 0xff0000
+	green = 0x00ff00
+)
+
+var initMetricsOnce sync.Once
+
+// testBridge is a lightbulb accessory wired up to a fake strip
+type testBridge struct {
+	dev   *wnptest.Device
+	strip *wifineopixel
+	acc   *accessory.ColoredLightbulb
+	spans *tracetest.SpanRecorder
+}
+
+func setupBridge(t *testing.T, initial []uint32) *testBridge {
+	t.Helper()
+
+	// metrics are registered globally, so can only be initialized once
+	initMetricsOnce.Do(initMetrics)
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+
+	srv, dev := wnptest.NewServer(len(initial))
+	t.Cleanup(srv.Close)
+	dev.SetStates(initial)
+
+	ctx := context.Background()
+
+	strip := newWifiNeopixel()
+	require.NoError(t, strip.connect(ctx, srv.URL))
+
+	acc := accessory.NewColoredLightbulb(accessory.Info{Name: "test"})
+	require.NoError(t, initLight(ctx, acc.Lightbulb, strip))
+	initResponders(ctx, acc, strip)
+
+	dev.ResetRequests()
+
+	return &testBridge{dev: dev, strip: strip, acc: acc, spans: spans}
+}
+
+// remote simulates a HomeKit controller writing v to a characteristic, and
+// returns the HAP status
+func remoteSet(c interface {
+	SetValueRequest(interface{}, *http.Request) (interface{}, int)
+}, v interface{},
+) int {
+	_, status := c.SetValueRequest(v, httptest.NewRequest(http.MethodPut, "/characteristics", nil))
+	return status
+}
+
+// rawPayloads returns the bodies of all /raw requests the device received
+func (b *testBridge) rawPayloads(t *testing.T) [][]uint32 {
+	t.Helper()
+
+	payloads := [][]uint32{}
+	for _, r := range b.dev.Requests() {
+		if r.Path != "/raw" {
+			continue
+		}
+		p := []uint32{}
+		require.NoError(t, json.Unmarshal(r.Body, &p))
+		payloads = append(payloads, p)
+	}
+	return payloads
+}
+
+func (b *testBridge) paths() []string {
+	paths := []string{}
+	for _, r := range b.dev.Requests() {
+		paths = append(paths, r.Method+" "+r.Path)
+	}
+	return paths
+}
+
+func (b *testBridge) spanNames() []string {
+	names := []string{}
+	for _, s := range b.spans.Ended() {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+func solid(c uint32, n int) []uint32 {
+	s := make([]uint32, n)
+	for i := range s {
+		s[i] = c
+	}
+	return s
+}
+
+// opaque adds the full alpha channel, as sent by colorToUint32
+func opaque(c []uint32) []uint32 {
+	o := make([]uint32, len(c))
+	for i := range c {
+		o[i] = 0xff000000 | c[i]
+	}
+	return o
+}
+
+func updateCount(t *testing.T, sub, event string) uint64 {
+	t.Helper()
+
+	m := &dto.Metric{}
+	o := updateMetrics[sub+"UpdateDurationHist"].With(prometheus.Labels{"event": event})
+	require.NoError(t, o.(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestInitLight(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	assert.Equal(t, 0.0, lb.Hue.Value())
+	assert.Equal(t, 100.0, lb.Saturation.Value())
+	assert.Equal(t, 100, lb.Brightness.Value())
+	assert.True(t, lb.On.Value())
+
+	assert.Equal(t, opaque(solid(red, 4)), colorsToUint32(b.strip.state))
+	assert.Equal(t, opaque(solid(red, 4)), colorsToUint32(b.strip.onState))
+
+	b = setupBridge(t, solid(0, 4))
+	assert.False(t, b.acc.Lightbulb.On.Value())
+	// an unlit strip defaults to red when turned on
+	assert.Equal(t, 4, len(b.strip.onState))
+}
+
+func TestColorUpdates(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	hueCount := updateCount(t, "hue", "remoteUpdate")
+	satCount := updateCount(t, "sat", "remoteUpdate")
+	valCount := updateCount(t, "val", "remoteUpdate")
+
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	assert.Equal(t, 120.0, lb.Hue.Value())
+	assert.Equal(t, [][]uint32{opaque(solid(green, 4))}, b.rawPayloads(t))
+	assert.Equal(t, opaque(solid(green, 4)), colorsToUint32(b.strip.state))
+	assert.Equal(t, opaque(solid(green, 4)), colorsToUint32(b.strip.onState))
+	assert.Equal(t, opaque(solid(green, 4)), b.dev.States())
+
+	b.dev.ResetRequests()
+	require.Equal(t, 0, remoteSet(lb.Saturation, 50.0))
+	assert.Equal(t, 50.0, lb.Saturation.Value())
+	assert.Equal(t, [][]uint32{opaque(solid(0x80ff80, 4))}, b.rawPayloads(t))
+
+	b.dev.ResetRequests()
+	require.Equal(t, 0, remoteSet(lb.Brightness, 50))
+	assert.Equal(t, 50, lb.Brightness.Value())
+	assert.Equal(t, [][]uint32{opaque(solid(0x408040, 4))}, b.rawPayloads(t))
+	assert.Equal(t, opaque(solid(0x408040, 4)), colorsToUint32(b.strip.state))
+	assert.Equal(t, opaque(solid(0x408040, 4)), colorsToUint32(b.strip.onState))
+
+	assert.Equal(t, hueCount+1, updateCount(t, "hue", "remoteUpdate"))
+	assert.Equal(t, satCount+1, updateCount(t, "sat", "remoteUpdate"))
+	assert.Equal(t, valCount+1, updateCount(t, "val", "remoteUpdate"))
+
+	names := b.spanNames()
+	for _, n := range []string{
+		"lb.Hue.OnSetRemoteValue", "lb.Saturation.OnSetRemoteValue", "lb.Brightness.OnSetRemoteValue",
+		"updateColor", "setSolid", "setState",
+	} {
+		assert.Contains(t, names, n)
+	}
+}
+
+func TestOnOff(t *testing.T) {
+	b := setupBridge(t, solid(green, 3))
+	lb := b.acc.Lightbulb
+
+	onCount := updateCount(t, "on", "remoteUpdate")
+
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	assert.False(t, lb.On.Value())
+	assert.Equal(t, []string{"GET /clear", "GET /states"}, b.paths())
+	assert.Equal(t, solid(0, 3), b.dev.States())
+	assert.Equal(t, opaque(solid(0, 3)), colorsToUint32(b.strip.state))
+	// the last lit state is kept for turning back on
+	assert.Equal(t, opaque(solid(green, 3)), colorsToUint32(b.strip.onState))
+
+	b.dev.ResetRequests()
+	require.Equal(t, 0, remoteSet(lb.On, true))
+	assert.True(t, lb.On.Value())
+	assert.Equal(t, [][]uint32{opaque(solid(green, 3))}, b.rawPayloads(t))
+	assert.Equal(t, opaque(solid(green, 3)), b.dev.States())
+	assert.Equal(t, opaque(solid(green, 3)), colorsToUint32(b.strip.state))
+
+	assert.Equal(t, onCount+2, updateCount(t, "on", "remoteUpdate"))
+	assert.Contains(t, b.spanNames(), "lb.On.OnSetRemoteValue")
+
+	// reads go to the device, so out-of-band changes are noticed
+	b.dev.SetStates(solid(0, 3))
+	v, status := lb.On.ValueRequest(httptest.NewRequest(http.MethodGet, "/characteristics", nil))
+	assert.Equal(t, 0, status)
+	assert.Equal(t, false, v)
+}
+
+func TestUnreachableDevice(t *testing.T) {
+	b := setupBridge(t, solid(red, 2))
+	lb := b.acc.Lightbulb
+
+	b.dev.SetFaults(wnptest.Faults{ErrorRate: 1})
+
+	// failed writes report a communication failure, and the characteristic
+	// keeps its last known good value
+	assert.Equal(t, hapStatusCommunicationFailure, remoteSet(lb.Hue, 240.0))
+	assert.Equal(t, 0.0, lb.Hue.Value())
+	assert.Equal(t, hapStatusCommunicationFailure, remoteSet(lb.On, false))
+	assert.True(t, lb.On.Value())
+	assert.Equal(t, opaque(solid(red, 2)), colorsToUint32(b.strip.state))
+
+	req := httptest.NewRequest(http.MethodGet, "/characteristics", nil)
+	_, status := lb.On.ValueRequest(req)
+	assert.Equal(t, hapStatusCommunicationFailure, status)
+	_, status = lb.Brightness.ValueRequest(req)
+	assert.Equal(t, hapStatusCommunicationFailure, status)
+
+	// once the device recovers, so does the accessory
+	b.dev.SetFaults(wnptest.Faults{})
+	v, status := lb.On.ValueRequest(req)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, true, v)
+	v, status = lb.Brightness.ValueRequest(req)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, 100, v)
+}
+
+func TestNotConnected(t *testing.T) {
+	ctx := context.Background()
+
+	// writes are refused until the device has been found, rather than
+	// clobbering the state that'll be read from it
+	strip := newWifiNeopixel()
+	assert.ErrorIs(t, strip.setState(ctx, []colorful.Color{{R: 1}, {R: 1}}), errNotConnected)
+	assert.ErrorIs(t, strip.on(ctx), errNotConnected)
+	assert.ErrorIs(t, strip.clear(ctx), errNotConnected)
+	assert.ErrorIs(t, updateColor(ctx, strip, 120, 100, 100), errNotConnected)
+	assert.Equal(t, uint64(0), strip.changes.Load())
+
+	b := setupBridge(t, solid(red, 2))
+	assert.ErrorIs(t, b.strip.setState(ctx, nil), errEmptyFrame)
+	assert.Empty(t, b.dev.Requests())
+	assert.Equal(t, opaque(solid(red, 2)), colorsToUint32(b.strip.state))
+}
+
+func TestConcurrentStateAccess(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	ctx := context.Background()
+
+	// background writers (scheduler, E1.31, identify...) run alongside
+	// HomeKit reads, so this is mostly for the race detector
+	writers := []func() error{
+		func() error { return b.strip.setSolid(ctx, colorful.Color{G: 1}) },
+		func() error { return b.strip.clear(ctx) },
+		func() error { return b.strip.on(ctx) },
+		func() error { return b.strip.refresh(ctx) },
+		func() error { _, _, _, err := b.strip.hsv(ctx); return err },
+		func() error { return updateColor(ctx, b.strip, 240, 100, 50) },
+	}
+
+	wg := sync.WaitGroup{}
+	for _, f := range writers {
+		wg.Add(1)
+		go func(f func() error) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				assert.NoError(t, f())
+				_ = b.strip.isOn()
+				assert.Len(t, b.strip.currentState(), 4)
+				assert.Len(t, b.strip.snapshotOnState(), 4)
+				assert.Equal(t, 4, b.strip.pixelCount())
+			}
+		}(f)
+	}
+	wg.Wait()
+}
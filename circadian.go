@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/yaml.v3"
+)
+
+const circadianStoreKey = "circadian"
+
+// circadianConfig is the auto-white mode's configuration file, e.g.:
+//
+//	interval: 1m
+//	resume: "06:00"
+//	anchors:
+//	  - {time: "07:00", temperature: 2700, brightness: 40}
+//	  - {time: "12:00", temperature: 5500, brightness: 100}
+//	  - {time: "20:00", temperature: 2700, brightness: 60}
+//	  - {time: "23:00", temperature: 2000, brightness: 20}
+type circadianConfig struct {
+	// Resume is the time of day (HH:MM) at which the mode resumes after
+	// being suspended by a manual color change. Without it, the mode stays
+	// suspended until the light is turned off and on again.
+	Resume  string            `yaml:"resume"`
+	Anchors []circadianAnchor `yaml:"anchors"`
+	// Interval is how often the color is updated
+	Interval time.Duration `yaml:"interval"`
+	resume   time.Duration
+}
+
+// circadianAnchor is a point on the curve - the color temperature (in
+// kelvin) and brightness (percent) at a time of day (HH:MM). Between
+// anchors, both change gradually.
+type circadianAnchor struct {
+	Time        string `yaml:"time"`
+	Temperature int    `yaml:"temperature"`
+	Brightness  int    `yaml:"brightness"`
+	at          time.Duration
+}
+
+// defaultCircadianConfig is used when no configuration file is given: warm
+// and dim in the early morning and late evening, cool and bright at midday
+func defaultCircadianConfig() *circadianConfig {
+	cfg, err := parseCircadianConfig([]byte(`
+anchors:
+  - {time: "06:00", temperature: 2200, brightness: 20}
+  - {time: "09:00", temperature: 4000, brightness: 80}
+  - {time: "13:00", temperature: 5500, brightness: 100}
+  - {time: "18:00", temperature: 3500, brightness: 80}
+  - {time: "21:00", temperature: 2500, brightness: 50}
+  - {time: "23:00", temperature: 2000, brightness: 20}
+`))
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+// loadCircadianConfig reads and validates the auto-white mode's
+// configuration file
+func loadCircadianConfig(path string) (*circadianConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read circadian config: %w", err)
+	}
+
+	return parseCircadianConfig(b)
+}
+
+func parseCircadianConfig(b []byte) (*circadianConfig, error) {
+	cfg := &circadianConfig{}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse circadian config: %w", err)
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.Interval < time.Second {
+		return nil, fmt.Errorf("circadian interval must be at least 1s, not %s", cfg.Interval)
+	}
+
+	if cfg.Resume != "" {
+		at, err := parseTimeOfDay(cfg.Resume)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circadian resume time: %w", err)
+		}
+		cfg.resume = at
+	}
+
+	if len(cfg.Anchors) == 0 {
+		return nil, errors.New("circadian config needs at least one anchor")
+	}
+
+	for i := range cfg.Anchors {
+		if err := cfg.Anchors[i].init(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(cfg.Anchors, func(i, j int) bool {
+		return cfg.Anchors[i].at < cfg.Anchors[j].at
+	})
+
+	return cfg, nil
+}
+
+// init validates the anchor, and parses its time
+func (a *circadianAnchor) init() error {
+	at, err := parseTimeOfDay(a.Time)
+	if err != nil {
+		return fmt.Errorf("invalid circadian anchor time: %w", err)
+	}
+	a.at = at
+
+	// ColorTemperature's range is 140-500 mireds
+	if a.Temperature < 2000 || a.Temperature > 7142 {
+		return fmt.Errorf("circadian anchor at %s: temperature must be between 2000K and 7142K, not %dK", a.Time, a.Temperature)
+	}
+	if a.Brightness < 0 || a.Brightness > 100 {
+		return fmt.Errorf("circadian anchor at %s: brightness must be between 0 and 100, not %d", a.Time, a.Brightness)
+	}
+	return nil
+}
+
+// parseTimeOfDay parses an HH:MM time, returning the time since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// sinceMidnight returns the time since the start of t's day
+func sinceMidnight(t time.Time) time.Duration {
+	y, m, d := t.Date()
+	return t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+}
+
+// at returns the color temperature (in mireds) and brightness on the curve
+// at the given time, interpolating between the anchors on either side of it
+// (wrapping around midnight)
+func (c *circadianConfig) at(t time.Time) (mired, brightness int) {
+	now := sinceMidnight(t)
+	anchors := c.Anchors
+
+	// the anchors either side of now, with times relative to today
+	prev, next := anchors[len(anchors)-1], anchors[0]
+	prevAt, nextAt := prev.at-24*time.Hour, next.at+24*time.Hour
+	for _, a := range anchors {
+		if a.at <= now {
+			prev, prevAt = a, a.at
+		}
+	}
+	for i := len(anchors) - 1; i >= 0; i-- {
+		if anchors[i].at > now {
+			next, nextAt = anchors[i], anchors[i].at
+		}
+	}
+
+	p := 0.0
+	if nextAt > prevAt {
+		p = float64(now-prevAt) / float64(nextAt-prevAt)
+	}
+
+	// interpolate in mireds, which is closer to how the change is perceived
+	prevMired, nextMired := 1e6/float64(prev.Temperature), 1e6/float64(next.Temperature)
+	mired = int(math.Round(prevMired + (nextMired-prevMired)*p))
+	brightness = int(math.Round(float64(prev.Brightness) + float64(next.Brightness-prev.Brightness)*p))
+
+	return mired, brightness
+}
+
+// circadian is the auto-white mode. While its switch is on, the strip
+// follows a color temperature and brightness curve through the day. Choosing
+// a hue or saturation suspends the mode, until the light is turned off and
+// on again, or until the configured resume time. It can't be on at the same
+// time as Adaptive Lighting - turning either on turns the other off.
+type circadian struct {
+	lb    *service.ColoredLightbulb
+	sw    *service.Switch
+	strip *wifineopixel
+	store hap.Store
+	cfg   *circadianConfig
+	// al is the accessory's Adaptive Lighting, if it has it
+	al  *adaptiveLighting
+	now func() time.Time
+	// suspendedUntil is when the suspended mode resumes - it's zero when
+	// it's only resumed by turning the light off and on
+	suspendedUntil time.Time
+	suspended      bool
+	mu             sync.Mutex
+}
+
+// initCircadian adds the auto-white mode's switch to the accessory, restoring
+// its last state from store
+func initCircadian(ctx context.Context, acc *accessory.ColoredLightbulb, strip *wifineopixel, store hap.Store,
+	cfg *circadianConfig, al *adaptiveLighting,
+) *circadian {
+	c := &circadian{
+		lb:    acc.Lightbulb,
+		sw:    service.NewSwitch(),
+		strip: strip,
+		store: store,
+		cfg:   cfg,
+		al:    al,
+		now:   time.Now,
+	}
+
+	name := characteristic.NewName()
+	name.SetValue("Auto White")
+	c.sw.AddC(name.C)
+	acc.AddS(c.sw.S)
+
+	if b, err := store.Get(circadianStoreKey); err == nil && string(b) == "on" {
+		c.sw.On.SetValue(true)
+	}
+
+	c.initResponders(ctx)
+
+	return c
+}
+
+func (c *circadian) initResponders(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+
+	c.sw.On.OnValueRemoteUpdate(func(on bool) {
+		log.Info().Bool("on", on).Msg("auto-white mode switched")
+
+		var err error
+		if on {
+			err = c.store.Set(circadianStoreKey, []byte("on"))
+		} else {
+			err = c.store.Delete(circadianStoreKey)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("failed to persist auto-white mode")
+		}
+
+		c.mu.Lock()
+		c.suspended = false
+		c.mu.Unlock()
+
+		if on && c.al != nil {
+			c.al.deactivate(ctx, "auto-white mode turned on")
+		}
+
+		c.update(ctx)
+	})
+
+	if c.al != nil {
+		c.al.onActivate = c.turnOff
+	}
+
+	// a manual color choice takes over until the light's power is cycled,
+	// or the resume time comes around
+	c.lb.Hue.OnValueRemoteUpdate(func(float64) {
+		c.suspend(ctx)
+	})
+	c.lb.Saturation.OnValueRemoteUpdate(func(float64) {
+		c.suspend(ctx)
+	})
+
+	c.lb.On.OnValueRemoteUpdate(func(on bool) {
+		if !on {
+			return
+		}
+
+		c.mu.Lock()
+		if c.suspended {
+			log.Info().Msg("auto-white mode resumed")
+		}
+		c.suspended = false
+		c.mu.Unlock()
+
+		c.update(ctx)
+	})
+}
+
+// turnOff switches the mode off, when Adaptive Lighting takes over
+func (c *circadian) turnOff(ctx context.Context) {
+	if !c.sw.On.Value() {
+		return
+	}
+
+	zerolog.Ctx(ctx).Info().Msg("auto-white mode turned off by adaptive lighting")
+
+	c.sw.On.SetValue(false)
+	if err := c.store.Delete(circadianStoreKey); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Msg("failed to persist auto-white mode")
+	}
+}
+
+// suspend pauses the mode after a manual change
+func (c *circadian) suspend(ctx context.Context) {
+	if !c.sw.On.Value() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.suspended = true
+	c.suspendedUntil = time.Time{}
+	if c.cfg.Resume != "" {
+		now := c.now()
+		y, m, d := now.Date()
+		c.suspendedUntil = time.Date(y, m, d, 0, 0, 0, 0, now.Location()).Add(c.cfg.resume)
+		if !c.suspendedUntil.After(now) {
+			c.suspendedUntil = c.suspendedUntil.AddDate(0, 0, 1)
+		}
+	}
+
+	ev := zerolog.Ctx(ctx).Info()
+	if !c.suspendedUntil.IsZero() {
+		ev = ev.Time("until", c.suspendedUntil)
+	}
+	ev.Msg("auto-white mode suspended by manual color change")
+}
+
+// active returns whether the strip should be following the curve
+func (c *circadian) active(ctx context.Context) bool {
+	if !c.sw.On.Value() {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.suspended && !c.suspendedUntil.IsZero() && !c.now().Before(c.suspendedUntil) {
+		zerolog.Ctx(ctx).Info().Msg("auto-white mode resumed")
+		c.suspended = false
+	}
+
+	return !c.suspended
+}
+
+// run updates the strip periodically until ctx is cancelled
+func (c *circadian) run(ctx context.Context) {
+	tick := time.NewTicker(c.cfg.Interval)
+	defer tick.Stop()
+
+	c.update(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			c.update(ctx)
+		}
+	}
+}
+
+// update sets the strip to the curve's current color temperature and
+// brightness, if the mode is active and the light is on
+func (c *circadian) update(ctx context.Context) {
+	if !c.active(ctx) || !c.lb.On.Value() || !c.strip.available() {
+		return
+	}
+
+	ctx, span := otel.Tracer("").Start(ctx, "circadian.update")
+	defer span.End()
+
+	mired, bri := c.cfg.at(c.now())
+	span.SetAttributes(attribute.Int("mired", mired), attribute.Int("brightness", bri))
+
+	hue, sat := miredToHueSat(mired)
+	if err := updateColor(ctx, c.strip, hue, sat, bri); err != nil {
+		span.RecordError(err)
+		return
+	}
+
+	c.lb.Hue.SetValue(hue)
+	c.lb.Saturation.SetValue(sat)
+	_ = c.lb.Brightness.SetValue(bri)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCircadian = `
+resume: "06:00"
+anchors:
+  - {time: "20:00", temperature: 2500, brightness: 40}
+  - {time: "08:00", temperature: 2500, brightness: 40}
+  - {time: "12:00", temperature: 5000, brightness: 100}
+`
+
+func TestParseCircadianConfig(t *testing.T) {
+	cfg, err := parseCircadianConfig([]byte(testCircadian))
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, cfg.Interval)
+	assert.Equal(t, 6*time.Hour, cfg.resume)
+	require.Len(t, cfg.Anchors, 3)
+	// sorted by time
+	assert.Equal(t, "08:00", cfg.Anchors[0].Time)
+	assert.Equal(t, 20*time.Hour, cfg.Anchors[2].at)
+
+	assert.NotNil(t, defaultCircadianConfig())
+
+	testdata := []string{
+		`anchors: []`,
+		`anchors: [{time: "25:00", temperature: 2700, brightness: 50}]`,
+		`anchors: [{time: "noon", temperature: 2700, brightness: 50}]`,
+		`anchors: [{time: "12:00", temperature: 1000, brightness: 50}]`,
+		`anchors: [{time: "12:00", temperature: 2700, brightness: 150}]`,
+		`{resume: "6am", anchors: [{time: "12:00", temperature: 2700, brightness: 50}]}`,
+		`{interval: 1ms, anchors: [{time: "12:00", temperature: 2700, brightness: 50}]}`,
+	}
+	for _, d := range testdata {
+		_, err := parseCircadianConfig([]byte(d))
+		assert.Error(t, err, d)
+	}
+}
+
+func TestCircadianAt(t *testing.T) {
+	cfg, err := parseCircadianConfig([]byte(testCircadian))
+	require.NoError(t, err)
+
+	testdata := []struct {
+		clock      string
+		mired, bri int
+	}{
+		{"08:00", 400, 40},
+		{"10:00", 300, 70},
+		{"12:00", 200, 100},
+		{"16:00", 300, 70},
+		// the curve wraps around midnight
+		{"23:00", 400, 40},
+		{"03:00", 400, 40},
+	}
+
+	for _, d := range testdata {
+		c, err := time.Parse("15:04", d.clock)
+		require.NoError(t, err)
+		mired, bri := cfg.at(time.Date(2024, 6, 1, c.Hour(), c.Minute(), 0, 0, time.Local))
+		assert.Equal(t, d.mired, mired, d.clock)
+		assert.Equal(t, d.bri, bri, d.clock)
+	}
+
+	// a single anchor is a constant
+	cfg, err = parseCircadianConfig([]byte(`anchors: [{time: "12:00", temperature: 4000, brightness: 50}]`))
+	require.NoError(t, err)
+	mired, bri := cfg.at(time.Date(2024, 6, 1, 3, 0, 0, 0, time.Local))
+	assert.Equal(t, 250, mired)
+	assert.Equal(t, 50, bri)
+}
+
+func TestCircadian(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+	store := hap.NewMemStore()
+	cfg, err := parseCircadianConfig([]byte(testCircadian))
+	require.NoError(t, err)
+
+	c := initCircadian(context.Background(), b.acc, b.strip, store, cfg, nil)
+	now := time.Date(2024, 6, 1, 10, 0, 0, 0, time.Local)
+	c.now = func() time.Time { return now }
+
+	// nothing happens while the switch is off
+	c.update(context.Background())
+	assert.Empty(t, b.rawPayloads(t))
+
+	require.Equal(t, 0, remoteSet(c.sw.On, true))
+	v, err := store.Get(circadianStoreKey)
+	require.NoError(t, err)
+	assert.Equal(t, "on", string(v))
+
+	hue, sat := miredToHueSat(300)
+	assert.InDelta(t, hue, lb.Hue.Value(), 0.001)
+	assert.InDelta(t, sat, lb.Saturation.Value(), 0.001)
+	assert.Equal(t, 70, lb.Brightness.Value())
+	assert.Len(t, b.rawPayloads(t), 1)
+	assert.Contains(t, b.spanNames(), "circadian.update")
+
+	// a manual color change suspends it
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	b.dev.ResetRequests()
+	now = now.Add(time.Hour)
+	c.update(context.Background())
+	assert.Empty(t, b.rawPayloads(t))
+	assert.Equal(t, 120.0, lb.Hue.Value())
+
+	// until the light is turned off and on again
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	require.Equal(t, 0, remoteSet(lb.On, true))
+	hue, _ = miredToHueSat(250)
+	assert.InDelta(t, hue, lb.Hue.Value(), 0.001)
+	assert.Equal(t, 85, lb.Brightness.Value())
+
+	// or until the resume time
+	require.Equal(t, 0, remoteSet(lb.Saturation, 50.0))
+	now = time.Date(2024, 6, 2, 5, 59, 0, 0, time.Local)
+	c.update(context.Background())
+	assert.Equal(t, 50.0, lb.Saturation.Value())
+	now = now.Add(time.Minute)
+	c.update(context.Background())
+	assert.Equal(t, 40, lb.Brightness.Value())
+
+	// the switch's state is restored
+	b = setupBridge(t, solid(red, 4))
+	c = initCircadian(context.Background(), b.acc, b.strip, store, cfg, nil)
+	assert.True(t, c.sw.On.Value())
+
+	require.Equal(t, 0, remoteSet(c.sw.On, false))
+	_, err = store.Get(circadianStoreKey)
+	assert.Error(t, err)
+}
+
+func TestCircadianAdaptiveLighting(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	store := hap.NewMemStore()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	a := setupAdaptiveLighting(t, b, store, now)
+	cfg, err := parseCircadianConfig([]byte(testCircadian))
+	require.NoError(t, err)
+
+	c := initCircadian(context.Background(), b.acc, b.strip, store, cfg, a)
+	c.now = func() time.Time { return now }
+
+	require.Equal(t, 0, remoteSet(c.sw.On, true))
+
+	// starting Adaptive Lighting turns auto-white off...
+	_, status := writeControl(t, a, updateRequest(transitionConfig(a.temp.Id, now, testCurve...)))
+	require.Equal(t, 0, status)
+	assert.Equal(t, 1, a.count.Value())
+	assert.False(t, c.sw.On.Value())
+	_, err = store.Get(circadianStoreKey)
+	assert.Error(t, err)
+
+	// ...and turning auto-white on stops Adaptive Lighting
+	require.Equal(t, 0, remoteSet(c.sw.On, true))
+	assert.Equal(t, 0, a.count.Value())
+	_, err = store.Get(adaptiveLightingStoreKey)
+	assert.Error(t, err)
+
+	// so only auto-white changes the color from here on
+	hue, _ := miredToHueSat(200)
+	assert.InDelta(t, hue, b.acc.Lightbulb.Hue.Value(), 0.001)
+	assert.Equal(t, 100, b.acc.Lightbulb.Brightness.Value())
+}
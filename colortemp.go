@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// kelvinToColor approximates the color of white light at the given color
+// temperature, using Tanner Helland's fit of the black-body curve. It's good
+// enough for LEDs between about 1000K and 40000K.
+func kelvinToColor(k float64) colorful.Color {
+	t := k / 100
+
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+
+	switch {
+	case t >= 66:
+		b = 255
+	case t <= 19:
+		b = 0
+	default:
+		b = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+
+	clamp := func(v float64) float64 {
+		return math.Max(0, math.Min(255, v)) / 255
+	}
+
+	return colorful.Color{R: clamp(r), G: clamp(g), B: clamp(b)}
+}
+
+// miredToHueSat returns the HomeKit hue (degrees) and saturation (percent)
+// that best match the given color temperature in mireds, as used by the
+// ColorTemperature characteristic
+func miredToHueSat(mired int) (hue, sat float64) {
+	h, s, _ := kelvinToColor(1e6 / float64(mired)).Hsv()
+	return h, s * 100
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDDPPackets(t *testing.T) {
+	_, err := newDDPOutput("", -1, ddpMaxPixels)
+	assert.Error(t, err)
+	_, err = newDDPOutput("", 0, 0)
+	assert.Error(t, err)
+	_, err = newDDPOutput("", 0, ddpMaxPixels+1)
+	assert.Error(t, err)
+
+	// a full-size chunk holds the whole frame
+	d, err := newDDPOutput("", 0, ddpMaxPixels)
+	require.NoError(t, err)
+	require.Len(t, d.packets(make([]colorful.Color, ddpMaxPixels)), 1)
+	require.Len(t, d.packets(make([]colorful.Color, ddpMaxPixels+1)), 2)
+
+	d, err = newDDPOutput("", 10, 2)
+	require.NoError(t, err)
+
+	frame := []colorful.Color{{R: 1}, {G: 1}, {B: 1}, {R: 1, G: 1, B: 1}, {R: 0.5}}
+	pkts := d.packets(frame)
+	require.Len(t, pkts, 3)
+
+	for i, p := range pkts {
+		assert.Equal(t, byte(ddpVersion1), p[0]&0xc0)
+		// only the last packet pushes the frame to the strip
+		assert.Equal(t, i == 2, p[0]&ddpFlagPush != 0, i)
+		assert.Equal(t, byte(i+1), p[1])
+		assert.Equal(t, byte(ddpTypeRGB8), p[2])
+		assert.Equal(t, byte(ddpDefaultDestination), p[3])
+		// offsets are in bytes, and include the pixel offset
+		assert.Equal(t, uint32(3*(10+2*i)), binary.BigEndian.Uint32(p[4:]))
+	}
+
+	assert.Equal(t, uint16(6), binary.BigEndian.Uint16(pkts[0][8:]))
+	assert.Equal(t, []byte{0xff, 0, 0, 0, 0xff, 0}, pkts[0][10:])
+	assert.Equal(t, []byte{0, 0, 0xff, 0xff, 0xff, 0xff}, pkts[1][10:])
+	assert.Equal(t, uint16(3), binary.BigEndian.Uint16(pkts[2][8:]))
+	assert.Equal(t, []byte{0x80, 0, 0}, pkts[2][10:])
+
+	// sequence numbers cycle from 1 to 15
+	for i := 0; i < 4; i++ {
+		d.packets(frame)
+	}
+	assert.Equal(t, byte(15), d.seq)
+	assert.Equal(t, byte(1), d.packets(frame)[0][1])
+
+	// an empty frame is still pushed
+	pkts = d.packets(nil)
+	require.Len(t, pkts, 1)
+	assert.Equal(t, byte(ddpVersion1|ddpFlagPush), pkts[0][0])
+	assert.Len(t, pkts[0], ddpHeaderLength)
+}
+
+func TestDDPOutput(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	b.strip.ddp, err = newDDPOutput(conn.LocalAddr().String(), 0, ddpMaxPixels)
+	require.NoError(t, err)
+
+	// the limiter applies to DDP frames too
+	b.strip.power.maxCurrent = 40
+
+	recv := func() []byte {
+		t.Helper()
+
+		buf := make([]byte, 1500)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		return buf[:n]
+	}
+
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	p := recv()
+	assert.Equal(t, byte(ddpVersion1|ddpFlagPush), p[0])
+	assert.Equal(t, []byte{0, 0x80, 0, 0, 0x80, 0, 0, 0x80, 0, 0, 0x80, 0}, p[10:])
+	assert.Contains(t, b.spanNames(), "ddp.write")
+
+	// the HTTP API isn't used to write
+	assert.Empty(t, b.rawPayloads(t))
+	assert.Equal(t, opaque(solid(green, 4)), colorsToUint32(b.strip.state))
+
+	// turning off sends a black frame, and on restores the last color
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	assert.Equal(t, make([]byte, 12), recv()[10:])
+	require.Equal(t, 0, remoteSet(lb.On, true))
+	assert.Equal(t, []byte{0, 0x80, 0, 0, 0x80, 0, 0, 0x80, 0, 0, 0x80, 0}, recv()[10:])
+	assert.Empty(t, b.rawPayloads(t))
+	assert.True(t, b.strip.available())
+
+	// reads are served from the frames sent, as the HTTP API doesn't know
+	// about them
+	b.dev.ResetRequests()
+	b.dev.SetStates(solid(0, 4))
+	v, status := lb.On.ValueRequest(httptest.NewRequest(http.MethodGet, "/characteristics", nil))
+	assert.Equal(t, 0, status)
+	assert.Equal(t, true, v)
+	h, _, _, err := b.strip.hsv(context.Background())
+	require.NoError(t, err)
+	assert.InDelta(t, 120.0, h, 0.001)
+	assert.Empty(t, b.paths())
+}
+
+func TestDDPOutputDefaultAddr(t *testing.T) {
+	d, err := newDDPOutput("", 0, ddpMaxPixels)
+	require.NoError(t, err)
+
+	err = d.write(context.Background(), nil, []colorful.Color{{R: 1}})
+	assert.ErrorIs(t, err, errNotConnected)
+
+	// without an address, the device's host is used on the DDP port
+	u, err := url.Parse("http://127.0.0.1:8080")
+	require.NoError(t, err)
+	require.NoError(t, d.write(context.Background(), u, []colorful.Color{{R: 1}}))
+	assert.Equal(t, "127.0.0.1:4048", d.dialed)
+}
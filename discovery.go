@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	neopixelService = "_neopixel._tcp"
+	neopixelDomain  = "local"
+)
+
+// mdnsDiscovery finds wifi neopixel devices with mDNS
+type mdnsDiscovery struct {
+	service string
+	domain  string
+	// enableIPv6 allows querying over IPv6, and connecting to devices by
+	// their IPv6 addresses when they have no IPv4 address
+	enableIPv6 bool
+	// preferIPv6 connects to devices by their IPv6 address even when they
+	// also have an IPv4 address (implies enableIPv6)
+	preferIPv6 bool
+	// browse finds the devices answering for the service - it's query,
+	// except in tests
+	browse func(ctx context.Context) ([]mdns.ServiceEntry, error)
+}
+
+func newMDNSDiscovery(enableIPv6, preferIPv6 bool) *mdnsDiscovery {
+	d := &mdnsDiscovery{
+		service:    neopixelService,
+		domain:     neopixelDomain,
+		enableIPv6: enableIPv6 || preferIPv6,
+		preferIPv6: preferIPv6,
+	}
+	d.browse = d.query
+	return d
+}
+
+// query performs a single mDNS query and returns every entry that answered
+// for the service, sorted by instance name. Duplicate answers from the same
+// instance are collapsed into the most recent one.
+func (d *mdnsDiscovery) query(ctx context.Context) ([]mdns.ServiceEntry, error) {
+	log := zerolog.Ctx(ctx)
+	span := trace.SpanFromContext(ctx)
+
+	entries := []mdns.ServiceEntry{}
+
+	suffix := fmt.Sprintf("%s.%s.", d.service, d.domain)
+	// Make a channel for results and start listening
+	entriesCh := make(chan *mdns.ServiceEntry, 4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for entry := range entriesCh {
+			if !strings.HasSuffix(entry.Name, suffix) {
+				continue
+			}
+
+			log.Debug().Str("host", entry.Host).Str("name", entry.Name).
+				IPAddr("addr_v4", entry.AddrV4).IPAddr("addr_v6", entry.AddrV6).Int("port", entry.Port).
+				Msg("mDNS: got entry")
+			span.AddEvent("mDNS: got entry",
+				trace.WithAttributes(
+					attribute.String("entry.host", entry.Host),
+					attribute.String("entry.name", entry.Name),
+					attribute.Stringer("entry.addr_v4", entry.AddrV4),
+					attribute.Stringer("entry.addr_v6", entry.AddrV6),
+					attribute.Int("entry.port", entry.Port),
+				))
+
+			// the mdns client may keep mutating in-progress entries, so
+			// keep a copy
+			entries = append(entries, *entry)
+		}
+	}()
+
+	// Start the lookup
+	opts := &mdns.QueryParam{
+		Timeout:             5 * time.Second,
+		Domain:              d.domain,
+		Service:             d.service,
+		Entries:             entriesCh,
+		WantUnicastResponse: true,
+		DisableIPv6:         !d.enableIPv6,
+	}
+	err := mdns.Query(opts)
+	close(entriesCh)
+	<-done
+
+	return dedupeEntries(entries), err
+}
+
+func dedupeEntries(entries []mdns.ServiceEntry) []mdns.ServiceEntry {
+	byName := map[string]mdns.ServiceEntry{}
+	for _, e := range entries {
+		byName[e.Name] = e
+	}
+
+	out := make([]mdns.ServiceEntry, 0, len(byName))
+	for _, e := range byName {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	return out
+}
+
+// foundDevice is a device found by mDNS
+type foundDevice struct {
+	// url is the device's address
+	url string
+	// instance is the device's mDNS instance name, which can be used to
+	// track the device later on
+	instance string
+	// txt holds the device's TXT records, such as "mac=5c:cf:7f:00:00:01"
+	txt []string
+}
+
+// lookup finds a wifi neopixel device. When more than one device answers,
+// selector picks one (see selectEntry).
+func (d *mdnsDiscovery) lookup(ctx context.Context, selector string) (*foundDevice, error) {
+	log := zerolog.Ctx(ctx)
+	ctx, span := otel.Tracer("").Start(ctx, "mDNS host lookup",
+		trace.WithAttributes(attribute.String("selector", selector)))
+	defer span.End()
+
+	entries, err := d.browse(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("neopixel not found: %w", err)
+	}
+
+	dev, err := d.resolve(entries, selector)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	log.Info().Str("name", dev.instance).Str("url", dev.url).Msg("found neopixel")
+	span.SetAttributes(attribute.String("url", dev.url))
+
+	return dev, nil
+}
+
+// resolve selects a device from entries and builds its URL
+func (d *mdnsDiscovery) resolve(entries []mdns.ServiceEntry, selector string) (*foundDevice, error) {
+	entry, err := d.selectEntry(entries, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	hostURL, err := d.entryURL(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &foundDevice{url: hostURL, instance: entry.Name, txt: entry.InfoFields}, nil
+}
+
+// selectEntry picks a single device from entries. An empty selector is only
+// acceptable when exactly one device was found. Otherwise the selector must
+// match exactly one device's instance name, hostname, or one of its TXT
+// records (either the whole "key=value" string or just the value, such as a
+// MAC address).
+func (d *mdnsDiscovery) selectEntry(entries []mdns.ServiceEntry, selector string) (*mdns.ServiceEntry, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("neopixel not found")
+	}
+
+	matches := []mdns.ServiceEntry{}
+	for _, e := range entries {
+		if selector == "" || d.entryMatches(&e, selector) {
+			matches = append(matches, e)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no neopixel matching %q, found: %s", selector, d.describeEntries(entries))
+	case 1:
+		return &matches[0], nil
+	default:
+		if selector == "" {
+			return nil, fmt.Errorf("found multiple neopixels, select one with -device: %s", d.describeEntries(matches))
+		}
+		return nil, fmt.Errorf("%q matches multiple neopixels: %s", selector, d.describeEntries(matches))
+	}
+}
+
+func (d *mdnsDiscovery) entryMatches(e *mdns.ServiceEntry, selector string) bool {
+	selector = strings.TrimSuffix(selector, ".")
+	host := strings.TrimSuffix(e.Host, ".")
+
+	candidates := []string{
+		d.instanceName(e.Name),
+		strings.TrimSuffix(e.Name, "."),
+		host,
+		strings.TrimSuffix(host, "."+d.domain),
+	}
+	for _, f := range e.InfoFields {
+		candidates = append(candidates, f)
+		if _, v, ok := strings.Cut(f, "="); ok && v != "" {
+			candidates = append(candidates, v)
+		}
+	}
+
+	for _, c := range candidates {
+		if strings.EqualFold(c, selector) {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceName strips the service and domain from a full mDNS service
+// instance name
+func (d *mdnsDiscovery) instanceName(name string) string {
+	return strings.TrimSuffix(name, fmt.Sprintf(".%s.%s.", d.service, d.domain))
+}
+
+func (d *mdnsDiscovery) describeEntries(entries []mdns.ServiceEntry) string {
+	s := make([]string, len(entries))
+	for i, e := range entries {
+		s[i] = fmt.Sprintf("%q (host %s)", d.instanceName(e.Name), strings.TrimSuffix(e.Host, "."))
+	}
+	return strings.Join(s, ", ")
+}
+
+// entryURL builds the device's URL from its advertised address and port,
+// choosing between IPv4 and IPv6 according to configuration
+func (d *mdnsDiscovery) entryURL(entry *mdns.ServiceEntry) (string, error) {
+	ip := d.entryAddr(entry)
+	if ip == nil {
+		return "", fmt.Errorf("no usable address for %q (IPv6 enabled: %t)", entry.Name, d.enableIPv6)
+	}
+
+	port := entry.Port
+	if port == 0 {
+		port = 80
+	}
+
+	u := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(ip.String(), strconv.Itoa(port)),
+	}
+
+	return u.String(), nil
+}
+
+// entryAddr returns the entry's preferred address, or nil if it has no
+// usable address
+func (d *mdnsDiscovery) entryAddr(entry *mdns.ServiceEntry) net.IP {
+	v4, v6 := entry.AddrV4, entry.AddrV6
+	// older responders may only have populated the deprecated Addr field
+	if v4 == nil && v6 == nil && entry.Addr != nil {
+		if entry.Addr.To4() != nil {
+			v4 = entry.Addr
+		} else {
+			v6 = entry.Addr
+		}
+	}
+
+	switch {
+	case d.preferIPv6 && v6 != nil:
+		return v6
+	case v4 != nil:
+		return v4
+	case d.enableIPv6 && v6 != nil:
+		return v6
+	default:
+		return nil
+	}
+}
+
+// printDevices writes a table of all discovered devices to w
+func (d *mdnsDiscovery) printDevices(w io.Writer, entries []mdns.ServiceEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tHOST\tURL\tTXT")
+	for i := range entries {
+		e := &entries[i]
+		u, err := d.entryURL(e)
+		if err != nil {
+			u = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			d.instanceName(e.Name),
+			strings.TrimSuffix(e.Host, "."),
+			u,
+			strings.Join(e.InfoFields, " "))
+	}
+	return tw.Flush()
+}
+
+// discover prints all devices that answer an mDNS query
+func (d *mdnsDiscovery) discover(ctx context.Context, w io.Writer) error {
+	ctx, span := otel.Tracer("").Start(ctx, "mDNS discover")
+	defer span.End()
+
+	entries, err := d.browse(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("mDNS query failed: %w", err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no neopixels found")
+	}
+
+	return d.printDevices(w, entries)
+}
+
+// watch periodically browses for the device with the given mDNS instance
+// name, and points the strip at its new address whenever it changes (e.g.
+// after a new DHCP lease). It blocks until ctx is cancelled.
+func (d *mdnsDiscovery) watch(ctx context.Context, strip *wifineopixel, instance string, interval time.Duration) {
+	log := zerolog.Ctx(ctx).With().Str("instance", instance).Logger()
+	ctx = log.WithContext(ctx)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			d.rediscover(ctx, strip, instance)
+		}
+	}
+}
+
+func (d *mdnsDiscovery) rediscover(ctx context.Context, strip *wifineopixel, instance string) {
+	log := zerolog.Ctx(ctx)
+	ctx, span := otel.Tracer("").Start(ctx, "mDNS rediscovery",
+		trace.WithAttributes(attribute.String("instance", instance)))
+	defer span.End()
+
+	entries, err := d.browse(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("mDNS rediscovery failed")
+		span.RecordError(err)
+		observeDiscoveryEvent("error")
+		return
+	}
+
+	var found *mdns.ServiceEntry
+	for i := range entries {
+		if entries[i].Name == instance {
+			found = &entries[i]
+			break
+		}
+	}
+
+	if found == nil {
+		log.Debug().Msg("device not seen during mDNS rediscovery")
+		span.AddEvent("device not seen")
+		observeDiscoveryEvent("not_seen")
+		return
+	}
+
+	newURL, err := d.entryURL(found)
+	if err != nil {
+		log.Warn().Err(err).Msg("rediscovered device has no usable address")
+		span.RecordError(err)
+		observeDiscoveryEvent("error")
+		return
+	}
+
+	oldURL := strip.addr().String()
+	if newURL == oldURL {
+		observeDiscoveryEvent("unchanged")
+		return
+	}
+
+	if err := strip.setAddress(newURL); err != nil {
+		log.Error().Err(err).Str("url", newURL).Msg("rediscovered device has invalid URL")
+		span.RecordError(err)
+		observeDiscoveryEvent("error")
+		return
+	}
+
+	log.Info().Str("old_url", oldURL).Str("new_url", newURL).Msg("device address changed")
+	span.AddEvent("device address changed",
+		trace.WithAttributes(
+			attribute.String("old_url", oldURL),
+			attribute.String("new_url", newURL),
+		))
+	observeDiscoveryEvent("address_changed")
+}
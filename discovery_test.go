@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryURL(t *testing.T) {
+	v4 := net.ParseIP("192.168.1.42").To4()
+	v6 := net.ParseIP("fd00::1234")
+
+	testdata := []struct {
+		entry    mdns.ServiceEntry
+		expected string
+		enable6  bool
+		prefer6  bool
+	}{
+		{entry: mdns.ServiceEntry{AddrV4: v4, Port: 80}, expected: "http://192.168.1.42:80"},
+		{entry: mdns.ServiceEntry{AddrV4: v4, Port: 8888}, expected: "http://192.168.1.42:8888"},
+		{entry: mdns.ServiceEntry{AddrV4: v4}, expected: "http://192.168.1.42:80"},
+		{entry: mdns.ServiceEntry{Addr: v4, Port: 81}, expected: "http://192.168.1.42:81"},
+		{entry: mdns.ServiceEntry{AddrV4: v4, AddrV6: v6, Port: 80}, expected: "http://192.168.1.42:80"},
+		{entry: mdns.ServiceEntry{AddrV4: v4, AddrV6: v6, Port: 80}, enable6: true, expected: "http://192.168.1.42:80"},
+		{entry: mdns.ServiceEntry{AddrV4: v4, AddrV6: v6, Port: 80}, prefer6: true, expected: "http://[fd00::1234]:80"},
+		{entry: mdns.ServiceEntry{AddrV6: v6, Port: 8080}, enable6: true, expected: "http://[fd00::1234]:8080"},
+		{entry: mdns.ServiceEntry{Addr: v6, Port: 8080}, enable6: true, expected: "http://[fd00::1234]:8080"},
+		{entry: mdns.ServiceEntry{AddrV4: v4, Port: 80}, prefer6: true, expected: "http://192.168.1.42:80"},
+	}
+
+	for _, d := range testdata {
+		disco := newMDNSDiscovery(d.enable6, d.prefer6)
+		actual, err := disco.entryURL(&d.entry)
+		require.NoError(t, err)
+		assert.Equal(t, d.expected, actual)
+	}
+
+	// IPv6-only devices are unusable unless IPv6 is enabled
+	disco := newMDNSDiscovery(false, false)
+	_, err := disco.entryURL(&mdns.ServiceEntry{Name: "foo", AddrV6: v6, Port: 80})
+	assert.Error(t, err)
+
+	_, err = disco.entryURL(&mdns.ServiceEntry{Name: "foo", Port: 80})
+	assert.Error(t, err)
+}
+
+func TestResolve(t *testing.T) {
+	disco := newMDNSDiscovery(true, false)
+
+	kitchen := mdns.ServiceEntry{
+		Name:       "kitchen._neopixel._tcp.local.",
+		Host:       "esp-kitchen.local.",
+		AddrV4:     net.ParseIP("10.0.0.5").To4(),
+		Port:       80,
+		InfoFields: []string{"id=abc123", "mac=5c:cf:7f:00:00:01"},
+	}
+	porch := mdns.ServiceEntry{
+		Name:       "porch._neopixel._tcp.local.",
+		Host:       "esp-porch.local.",
+		AddrV6:     net.ParseIP("fd00::5"),
+		Port:       8888,
+		InfoFields: []string{"id=def456", "mac=5c:cf:7f:00:00:02"},
+	}
+	entries := []mdns.ServiceEntry{kitchen, porch}
+
+	testdata := []struct {
+		selector string
+		url      string
+		instance string
+	}{
+		{"kitchen", "http://10.0.0.5:80", kitchen.Name},
+		{"KITCHEN", "http://10.0.0.5:80", kitchen.Name},
+		{"porch._neopixel._tcp.local.", "http://[fd00::5]:8888", porch.Name},
+		{"esp-porch", "http://[fd00::5]:8888", porch.Name},
+		{"esp-kitchen.local.", "http://10.0.0.5:80", kitchen.Name},
+		{"def456", "http://[fd00::5]:8888", porch.Name},
+		{"mac=5c:cf:7f:00:00:01", "http://10.0.0.5:80", kitchen.Name},
+		{"5C:CF:7F:00:00:02", "http://[fd00::5]:8888", porch.Name},
+	}
+
+	for _, d := range testdata {
+		dev, err := disco.resolve(entries, d.selector)
+		require.NoError(t, err, d.selector)
+		assert.Equal(t, d.url, dev.url, d.selector)
+		assert.Equal(t, d.instance, dev.instance, d.selector)
+	}
+
+	// a single device is selected without a selector
+	dev, err := disco.resolve([]mdns.ServiceEntry{kitchen}, "")
+	require.NoError(t, err)
+	assert.Equal(t, "http://10.0.0.5:80", dev.url)
+	assert.Equal(t, kitchen.Name, dev.instance)
+	assert.Equal(t, kitchen.InfoFields, dev.txt)
+
+	// ambiguous selections list the candidates
+	_, err = disco.resolve(entries, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"kitchen"`)
+	assert.Contains(t, err.Error(), `"porch"`)
+
+	_, err = disco.resolve(entries, "5c:cf:7f")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"kitchen"`)
+
+	_, err = disco.resolve(nil, "")
+	assert.Error(t, err)
+}
+
+func TestEntryMatches(t *testing.T) {
+	disco := newMDNSDiscovery(false, false)
+	e := &mdns.ServiceEntry{
+		Name:       "kitchen._neopixel._tcp.local.",
+		Host:       "esp-kitchen.local.",
+		InfoFields: []string{"id=abc123", "mac=5c:cf:7f:00:00:01", "flag", "empty="},
+	}
+
+	testdata := []struct {
+		selector string
+		expected bool
+	}{
+		// instance name
+		{"kitchen", true},
+		{"Kitchen", true},
+		{"kitchen._neopixel._tcp.local.", true},
+		{"kitchen._neopixel._tcp.local", true},
+		// host
+		{"esp-kitchen", true},
+		{"esp-kitchen.local", true},
+		{"esp-kitchen.local.", true},
+		// TXT records, whole or by value
+		{"mac=5c:cf:7f:00:00:01", true},
+		{"5C:CF:7F:00:00:01", true},
+		{"abc123", true},
+		{"flag", true},
+		{"empty=", true},
+		// no match
+		{"porch", false},
+		{"5c:cf:7f", false},
+		{"id", false},
+		{"mac", false},
+		{"", false},
+	}
+
+	for _, d := range testdata {
+		assert.Equal(t, d.expected, disco.entryMatches(e, d.selector), d.selector)
+	}
+}
+
+func TestSelectEntry(t *testing.T) {
+	disco := newMDNSDiscovery(false, false)
+
+	kitchen := mdns.ServiceEntry{
+		Name:       "kitchen._neopixel._tcp.local.",
+		Host:       "esp-kitchen.local.",
+		InfoFields: []string{"mac=5c:cf:7f:00:00:01", "group=downstairs"},
+	}
+	porch := mdns.ServiceEntry{
+		Name:       "porch._neopixel._tcp.local.",
+		Host:       "esp-porch.local.",
+		InfoFields: []string{"mac=5c:cf:7f:00:00:02", "group=downstairs"},
+	}
+	entries := []mdns.ServiceEntry{kitchen, porch}
+
+	testdata := []struct {
+		selector string
+		expected string
+		err      string
+		entries  []mdns.ServiceEntry
+	}{
+		{selector: "kitchen", entries: entries, expected: kitchen.Name},
+		{selector: "esp-porch.local", entries: entries, expected: porch.Name},
+		{selector: "5c:cf:7f:00:00:02", entries: entries, expected: porch.Name},
+		{selector: "", entries: []mdns.ServiceEntry{porch}, expected: porch.Name},
+		// a selector still has to match when there's only one device
+		{selector: "kitchen", entries: []mdns.ServiceEntry{porch}, err: `no neopixel matching "kitchen", found: "porch" (host esp-porch.local)`},
+		{selector: "attic", entries: entries, err: `no neopixel matching "attic"`},
+		{selector: "", entries: entries, err: "found multiple neopixels, select one with -device"},
+		{selector: "downstairs", entries: entries, err: `"downstairs" matches multiple neopixels: "kitchen" (host esp-kitchen.local), "porch"`},
+		{selector: "kitchen", entries: nil, err: "neopixel not found"},
+	}
+
+	for _, d := range testdata {
+		e, err := disco.selectEntry(d.entries, d.selector)
+		if d.err != "" {
+			require.Error(t, err, d.selector)
+			assert.Contains(t, err.Error(), d.err, d.selector)
+			continue
+		}
+		require.NoError(t, err, d.selector)
+		assert.Equal(t, d.expected, e.Name, d.selector)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	var entries []mdns.ServiceEntry
+	var browseErr error
+	disco := newMDNSDiscovery(false, false)
+	disco.browse = func(context.Context) ([]mdns.ServiceEntry, error) {
+		return entries, browseErr
+	}
+
+	entries = []mdns.ServiceEntry{
+		{
+			Name: "kitchen._neopixel._tcp.local.", Host: "esp-kitchen.local.",
+			AddrV4: net.ParseIP("10.0.0.5").To4(), Port: 80, InfoFields: []string{"mac=5c:cf:7f:00:00:01", "v=1"},
+		},
+		// IPv6-only devices are listed, without a URL
+		{Name: "porch._neopixel._tcp.local.", Host: "esp-porch.local.", AddrV6: net.ParseIP("fd00::5"), Port: 80},
+	}
+
+	out := &bytes.Buffer{}
+	require.NoError(t, disco.discover(context.Background(), out))
+	assert.Equal(t, ""+
+		"INSTANCE  HOST               URL                 TXT\n"+
+		"kitchen   esp-kitchen.local  http://10.0.0.5:80  mac=5c:cf:7f:00:00:01 v=1\n"+
+		"porch     esp-porch.local    -                   \n",
+		out.String())
+
+	entries = nil
+	assert.EqualError(t, disco.discover(context.Background(), out), "no neopixels found")
+
+	browseErr = errors.New("network is down")
+	assert.EqualError(t, disco.discover(context.Background(), out), "mDNS query failed: network is down")
+}
+
+func TestDedupeEntries(t *testing.T) {
+	entries := []mdns.ServiceEntry{
+		{Name: "b._neopixel._tcp.local.", Port: 1},
+		{Name: "a._neopixel._tcp.local.", Port: 1},
+		{Name: "b._neopixel._tcp.local.", Port: 2},
+	}
+
+	actual := dedupeEntries(entries)
+	assert.Equal(t, []mdns.ServiceEntry{
+		{Name: "a._neopixel._tcp.local.", Port: 1},
+		{Name: "b._neopixel._tcp.local.", Port: 2},
+	}, actual)
+}
+
+func discoveryEventCount(t *testing.T, event string) float64 {
+	t.Helper()
+
+	m := &dto.Metric{}
+	require.NoError(t, discoveryEvents.With(prometheus.Labels{"event": event}).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestRediscover(t *testing.T) {
+	initMetricsOnce.Do(initMetrics)
+
+	kitchen := mdns.ServiceEntry{
+		Name:   "kitchen._neopixel._tcp.local.",
+		Host:   "esp-kitchen.local.",
+		AddrV4: net.ParseIP("10.0.0.5").To4(),
+		Port:   80,
+	}
+	moved := kitchen
+	moved.AddrV4 = net.ParseIP("10.0.0.6").To4()
+	moved.Port = 8080
+	noAddr := kitchen
+	noAddr.AddrV4 = nil
+	porch := mdns.ServiceEntry{Name: "porch._neopixel._tcp.local.", AddrV4: net.ParseIP("10.0.0.7").To4()}
+
+	var entries []mdns.ServiceEntry
+	var browseErr error
+	disco := newMDNSDiscovery(false, false)
+	disco.browse = func(context.Context) ([]mdns.ServiceEntry, error) {
+		return entries, browseErr
+	}
+
+	strip := newWifiNeopixel()
+	require.NoError(t, strip.setAddress("http://10.0.0.5:80"))
+
+	testdata := []struct {
+		err     error
+		event   string
+		url     string
+		entries []mdns.ServiceEntry
+	}{
+		{entries: []mdns.ServiceEntry{kitchen, porch}, event: "unchanged", url: "http://10.0.0.5:80"},
+		{entries: []mdns.ServiceEntry{moved}, event: "address_changed", url: "http://10.0.0.6:8080"},
+		// a device that isn't seen keeps its last address
+		{entries: []mdns.ServiceEntry{porch}, event: "not_seen", url: "http://10.0.0.6:8080"},
+		{entries: nil, event: "not_seen", url: "http://10.0.0.6:8080"},
+		{err: errors.New("network is down"), event: "error", url: "http://10.0.0.6:8080"},
+		{entries: []mdns.ServiceEntry{noAddr}, event: "error", url: "http://10.0.0.6:8080"},
+		{entries: []mdns.ServiceEntry{kitchen}, event: "address_changed", url: "http://10.0.0.5:80"},
+	}
+
+	for _, d := range testdata {
+		entries, browseErr = d.entries, d.err
+		count := discoveryEventCount(t, d.event)
+
+		disco.rediscover(context.Background(), strip, kitchen.Name)
+
+		assert.Equal(t, count+1, discoveryEventCount(t, d.event), d.event)
+		assert.Equal(t, d.url, strip.addr().String(), d.event)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	initMetricsOnce.Do(initMetrics)
+
+	moved := mdns.ServiceEntry{
+		Name:   "kitchen._neopixel._tcp.local.",
+		AddrV4: net.ParseIP("10.0.0.6").To4(),
+		Port:   80,
+	}
+
+	disco := newMDNSDiscovery(false, false)
+	disco.browse = func(context.Context) ([]mdns.ServiceEntry, error) {
+		return []mdns.ServiceEntry{moved}, nil
+	}
+
+	strip := newWifiNeopixel()
+	require.NoError(t, strip.setAddress("http://10.0.0.5:80"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		disco.watch(ctx, strip, moved.Name, time.Millisecond)
+	}()
+
+	require.Eventually(t, func() bool {
+		return strip.addr().String() == "http://10.0.0.6:80"
+	}, 5*time.Second, time.Millisecond)
+
+	// watching stops with the context
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch didn't return after its context was cancelled")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/brutella/hap/service"
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/rs/zerolog"
+	"golang.org/x/net/ipv4"
+)
+
+// E1.31 (Streaming ACN) packet layout - see ANSI E1.31-2018
+const (
+	e131Port                = 5568
+	e131MinPacketLength     = 126
+	e131ChannelsPerUniverse = 510 // 170 RGB pixels, as xLights and QLC+ use by default
+
+	e131VectorRootData    = 0x00000004
+	e131VectorFramingData = 0x00000002
+	e131VectorDMPSetProp  = 0x02
+
+	e131OptionPreview    = 0x80
+	e131OptionTerminated = 0x40
+)
+
+var e131PacketID = []byte("ASC-E1.17\x00\x00\x00")
+
+// e131Packet is an E1.31 data packet
+type e131Packet struct {
+	// data is the DMX channel data, without the start code
+	data     []byte
+	universe uint16
+	sequence byte
+	options  byte
+}
+
+// parseE131 parses an E1.31 data packet. Only DMX data (start code 0) is
+// supported.
+func parseE131(b []byte) (*e131Packet, error) {
+	if len(b) < e131MinPacketLength {
+		return nil, fmt.Errorf("E1.31 packet too short (%d bytes)", len(b))
+	}
+
+	if !bytes.Equal(b[4:16], e131PacketID) {
+		return nil, errors.New("not an E1.31 packet")
+	}
+	if v := binary.BigEndian.Uint32(b[18:22]); v != e131VectorRootData {
+		return nil, fmt.Errorf("unsupported E1.31 root vector %#x", v)
+	}
+	if v := binary.BigEndian.Uint32(b[40:44]); v != e131VectorFramingData {
+		return nil, fmt.Errorf("unsupported E1.31 framing vector %#x", v)
+	}
+	if b[117] != e131VectorDMPSetProp {
+		return nil, fmt.Errorf("unsupported E1.31 DMP vector %#x", b[117])
+	}
+
+	// the property count includes the start code
+	count := int(binary.BigEndian.Uint16(b[123:125]))
+	if count < 1 || count > 513 || len(b) < 125+count {
+		return nil, fmt.Errorf("invalid E1.31 property count %d", count)
+	}
+	if b[125] != 0 {
+		return nil, fmt.Errorf("unsupported DMX start code %#x", b[125])
+	}
+
+	return &e131Packet{
+		sequence: b[111],
+		options:  b[112],
+		universe: binary.BigEndian.Uint16(b[113:115]),
+		data:     b[126 : 125+count],
+	}, nil
+}
+
+// e131MulticastGroup returns the multicast address for a universe
+func e131MulticastGroup(universe uint16) net.IP {
+	return net.IPv4(239, 255, byte(universe>>8), byte(universe))
+}
+
+// e131Receiver drives the strip from E1.31 data sent by lighting software.
+// Pixels are mapped as consecutive RGB channels, starting at startChannel in
+// the first universe and continuing into the following universes. While
+// packets are arriving the receiver has control of the strip - once they
+// stop for longer than timeout, the strip is set back to the lightbulb's
+// HomeKit state.
+type e131Receiver struct {
+	takeover
+
+	// data holds the latest channels received for each universe, waiting
+	// to be written
+	data      map[uint16][]byte
+	sequences map[uint16]byte
+	// startChannel is 1-based, as in DMX
+	startChannel int
+	universe     uint16
+	dirty        bool
+}
+
+func newE131Receiver(lb *service.ColoredLightbulb, strip *wifineopixel, universe uint16, startChannel int,
+	maxFPS float64, timeout time.Duration,
+) (*e131Receiver, error) {
+	if universe < 1 || universe > 63999 {
+		return nil, fmt.Errorf("E1.31 universe must be between 1 and 63999, not %d", universe)
+	}
+	if startChannel < 1 || startChannel > e131ChannelsPerUniverse {
+		return nil, fmt.Errorf("E1.31 start channel must be between 1 and %d, not %d", e131ChannelsPerUniverse, startChannel)
+	}
+	if maxFPS <= 0 {
+		return nil, fmt.Errorf("E1.31 frame rate must be positive, not %g", maxFPS)
+	}
+
+	r := &e131Receiver{
+		takeover: takeover{
+			lb:       lb,
+			strip:    strip,
+			id:       "e131",
+			name:     "E1.31 source",
+			interval: time.Duration(float64(time.Second) / maxFPS),
+			timeout:  timeout,
+			now:      time.Now,
+		},
+		universe:     universe,
+		startChannel: startChannel,
+		sequences:    map[uint16]byte{},
+		data:         map[uint16][]byte{},
+	}
+	r.src = r
+	return r, nil
+}
+
+// universes returns the universes covering a strip of n pixels
+func (r *e131Receiver) universes(n int) []uint16 {
+	last := (r.startChannel - 1 + 3*n - 1) / e131ChannelsPerUniverse
+	u := make([]uint16, 0, last+1)
+	for i := 0; i <= last; i++ {
+		u = append(u, r.universe+uint16(i))
+	}
+	return u
+}
+
+// listen receives E1.31 packets on addr (e.g. ":5568") until ctx is
+// cancelled. With multicast, the receiver joins the universes' multicast
+// groups once the strip's length is known.
+func (r *e131Receiver) listen(ctx context.Context, addr string, multicast bool) error {
+	log := zerolog.Ctx(ctx)
+
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for E1.31: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	log.Info().Stringer("addr", conn.LocalAddr()).Uint16("universe", r.universe).Msg("listening for E1.31")
+
+	go r.run(ctx)
+
+	if multicast {
+		go r.joinGroups(ctx, ipv4.NewPacketConn(conn))
+	}
+
+	go r.serve(ctx, conn)
+
+	return nil
+}
+
+// joinGroups joins the multicast groups for the strip's universes, waiting
+// for the strip's length to be known
+func (r *e131Receiver) joinGroups(ctx context.Context, p *ipv4.PacketConn) {
+	log := zerolog.Ctx(ctx)
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for r.pixels.Load() == 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+
+	for _, u := range r.universes(int(r.pixels.Load())) {
+		group := &net.UDPAddr{IP: e131MulticastGroup(u)}
+		if err := p.JoinGroup(nil, group); err != nil {
+			log.Error().Err(err).Uint16("universe", u).Msg("failed to join E1.31 multicast group")
+			continue
+		}
+		log.Debug().Uint16("universe", u).Stringer("group", group).Msg("joined E1.31 multicast group")
+	}
+}
+
+func (r *e131Receiver) serve(ctx context.Context, conn net.PacketConn) {
+	log := zerolog.Ctx(ctx)
+
+	buf := make([]byte, 1144)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Err(err).Msg("E1.31 receive failed")
+			}
+			return
+		}
+
+		p, err := parseE131(buf[:n])
+		if err != nil {
+			log.Debug().Err(err).Msg("ignoring invalid E1.31 packet")
+			observeE131Packet("invalid")
+			continue
+		}
+
+		observeE131Packet(r.handle(ctx, p))
+	}
+}
+
+// handle stores a packet's channels, to be mapped onto the strip by the next
+// flush, returning how the packet was handled (for metrics)
+func (r *e131Receiver) handle(ctx context.Context, p *e131Packet) string {
+	if p.options&e131OptionPreview != 0 {
+		return "preview"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.inSequence(p) {
+		return "out_of_order"
+	}
+
+	if p.options&e131OptionTerminated != 0 {
+		r.stopped()
+		return "terminated"
+	}
+
+	if !r.covers(p.universe) {
+		return "ignored"
+	}
+
+	r.received(ctx)
+	r.data[p.universe] = append(r.data[p.universe][:0], p.data...)
+	r.dirty = true
+
+	return "accepted"
+}
+
+// inSequence records the packet's sequence number, reporting whether it
+// arrived in order, allowing for the sequence number wrapping around (E1.31
+// section 6.7.2). r.mu must be held.
+func (r *e131Receiver) inSequence(p *e131Packet) bool {
+	if last, ok := r.sequences[p.universe]; ok {
+		if d := int8(p.sequence - last); d <= 0 && d > -20 {
+			return false
+		}
+	}
+	r.sequences[p.universe] = p.sequence
+	return true
+}
+
+// covers reports whether any of the universe's channels map onto the strip
+func (r *e131Receiver) covers(universe uint16) bool {
+	n := int(r.pixels.Load())
+	if n == 0 || universe < r.universe {
+		return false
+	}
+	return int(universe-r.universe)*e131ChannelsPerUniverse-(r.startChannel-1) < 3*n
+}
+
+// mapFrame maps the received channels onto a strip of n pixels. Pixels that
+// haven't been received are black.
+func (r *e131Receiver) mapFrame(n int) []colorful.Color {
+	frame := make([]colorful.Color, n)
+	for u, data := range r.data {
+		// the channel offset of this universe's first channel, relative to
+		// the strip's first channel
+		base := int(u-r.universe)*e131ChannelsPerUniverse - (r.startChannel - 1)
+		for i, v := range data {
+			// only the first 510 channels of each universe are mapped,
+			// the last 2 aren't enough for a whole pixel
+			if i >= e131ChannelsPerUniverse {
+				break
+			}
+			ch := base + i
+			if ch < 0 || ch >= 3*n {
+				continue
+			}
+			c := &frame[ch/3]
+			switch ch % 3 {
+			case 0:
+				c.R = float64(v) / 255
+			case 1:
+				c.G = float64(v) / 255
+			case 2:
+				c.B = float64(v) / 255
+			}
+		}
+	}
+	return frame
+}
+
+// pending maps the received channels onto the strip, if any have arrived
+// since the last write
+func (r *e131Receiver) pending(n int) []colorful.Color {
+	if !r.dirty {
+		return nil
+	}
+	r.dirty = false
+	return r.mapFrame(n)
+}
+
+func (r *e131Receiver) reset() {
+	r.dirty = false
+	r.data = map[uint16][]byte{}
+}
+
+func (r *e131Receiver) written(error) {}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// e131Data builds an E1.31 data packet
+func e131Data(universe uint16, seq, options byte, data []byte) []byte {
+	b := make([]byte, 126+len(data))
+	binary.BigEndian.PutUint16(b[0:], 0x0010)
+	copy(b[4:], e131PacketID)
+	binary.BigEndian.PutUint16(b[16:], 0x7000|uint16(len(b)-16))
+	binary.BigEndian.PutUint32(b[18:], e131VectorRootData)
+	binary.BigEndian.PutUint16(b[38:], 0x7000|uint16(len(b)-38))
+	binary.BigEndian.PutUint32(b[40:], e131VectorFramingData)
+	copy(b[44:], "test")
+	b[108] = 100
+	b[111] = seq
+	b[112] = options
+	binary.BigEndian.PutUint16(b[113:], universe)
+	binary.BigEndian.PutUint16(b[115:], 0x7000|uint16(len(b)-115))
+	b[117] = e131VectorDMPSetProp
+	b[118] = 0xa1
+	binary.BigEndian.PutUint16(b[121:], 1)
+	binary.BigEndian.PutUint16(b[123:], uint16(len(data)+1))
+	copy(b[126:], data)
+	return b
+}
+
+func TestParseE131(t *testing.T) {
+	p, err := parseE131(e131Data(7, 42, 0, []byte{1, 2, 3}))
+	require.NoError(t, err)
+	assert.Equal(t, uint16(7), p.universe)
+	assert.Equal(t, byte(42), p.sequence)
+	assert.Equal(t, []byte{1, 2, 3}, p.data)
+
+	_, err = parseE131([]byte("hello"))
+	assert.Error(t, err)
+
+	b := e131Data(1, 0, 0, []byte{1})
+	b[4] = 'X'
+	_, err = parseE131(b)
+	assert.Error(t, err)
+
+	// non-DMX start codes aren't supported
+	b = e131Data(1, 0, 0, []byte{1})
+	b[125] = 0xdd
+	_, err = parseE131(b)
+	assert.Error(t, err)
+
+	// the property count must fit the packet
+	b = e131Data(1, 0, 0, []byte{1})
+	binary.BigEndian.PutUint16(b[123:], 10)
+	_, err = parseE131(b)
+	assert.Error(t, err)
+
+	assert.Equal(t, net.IPv4(239, 255, 1, 2), e131MulticastGroup(258))
+}
+
+func TestE131Mapping(t *testing.T) {
+	b := setupBridge(t, solid(red, 200))
+	ctx := context.Background()
+
+	_, err := newE131Receiver(b.acc.Lightbulb, b.strip, 0, 1, 20, time.Second)
+	assert.Error(t, err)
+	_, err = newE131Receiver(b.acc.Lightbulb, b.strip, 1, 511, 20, time.Second)
+	assert.Error(t, err)
+
+	// starting at channel 4 of universe 2, 200 pixels spill into universe 3
+	r, err := newE131Receiver(b.acc.Lightbulb, b.strip, 2, 4, 20, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{2, 3}, r.universes(200))
+	assert.Equal(t, []uint16{2}, r.universes(169))
+
+	data := make([]byte, 512)
+
+	// nothing's accepted until the strip's length is known
+	assert.Equal(t, "ignored", r.handle(ctx, &e131Packet{universe: 2, sequence: 1, data: data}))
+	r.flush(ctx)
+	assert.Equal(t, int64(200), r.pixels.Load())
+
+	data[3], data[4], data[5] = 0xff, 0x80, 0x00
+	assert.Equal(t, "accepted", r.handle(ctx, &e131Packet{universe: 2, sequence: 2, data: data}))
+
+	data = make([]byte, 512)
+	// universe 2 only has room for 169 pixels after the first 3 channels,
+	// so universe 3 starts with the 170th
+	data[0], data[1], data[2] = 0xff, 0x00, 0xff
+	assert.Equal(t, "accepted", r.handle(ctx, &e131Packet{universe: 3, sequence: 1, data: data}))
+
+	frame := r.mapFrame(200)
+	assert.Equal(t, uint32(0xff8000), colorToUint32(frame[0])&0xffffff)
+	assert.Equal(t, uint32(0), colorToUint32(frame[168])&0xffffff)
+	assert.Equal(t, uint32(0xff00ff), colorToUint32(frame[169])&0xffffff)
+	assert.Equal(t, uint32(0), colorToUint32(frame[170])&0xffffff)
+
+	// universes outside the strip, and stale or preview packets, are ignored
+	assert.Equal(t, "ignored", r.handle(ctx, &e131Packet{universe: 1, sequence: 1, data: data}))
+	assert.Equal(t, "ignored", r.handle(ctx, &e131Packet{universe: 4, sequence: 1, data: data}))
+	assert.Equal(t, "out_of_order", r.handle(ctx, &e131Packet{universe: 2, sequence: 1, data: data}))
+	assert.Equal(t, "preview", r.handle(ctx, &e131Packet{universe: 2, sequence: 3, options: e131OptionPreview, data: data}))
+	// the sequence number wraps around
+	r.sequences[2] = 255
+	assert.Equal(t, "accepted", r.handle(ctx, &e131Packet{universe: 2, sequence: 0, data: data}))
+}
+
+func TestE131Receiver(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	r, err := newE131Receiver(lb, b.strip, 1, 1, 100, time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	r.flush(ctx)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	// frames are flushed from the test, rather than by run, so the strip
+	// is only used from here
+	go r.serve(ctx, conn)
+
+	src, err := net.Dial("udp4", conn.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { src.Close() })
+
+	send := func(seq, options byte, data []byte) {
+		t.Helper()
+
+		_, err := src.Write(e131Data(1, seq, options, data))
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return r.sequences[1] == seq
+		}, time.Second, time.Millisecond)
+	}
+
+	active := func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.active
+	}
+
+	frame := []byte{0, 0, 0xff, 0, 0xff, 0, 0xff, 0, 0, 0xff, 0xff, 0xff}
+	send(1, 0, frame)
+	send(2, 0, frame)
+
+	// both packets are written as one frame
+	r.flush(ctx)
+	r.flush(ctx)
+	assert.Equal(t, [][]uint32{opaque([]uint32{0x0000ff, 0x00ff00, 0xff0000, 0xffffff})}, b.rawPayloads(t))
+	assert.Contains(t, b.spanNames(), "e131.write")
+
+	// once packets stop, HomeKit gets the strip back
+	now = now.Add(time.Hour)
+	r.flush(ctx)
+	assert.False(t, active())
+	assert.Equal(t, opaque(solid(red, 4)), b.dev.States())
+	assert.Contains(t, b.spanNames(), "e131.release")
+
+	// a terminated stream hands back control straight away, and turning the
+	// light on afterwards restores its HomeKit color rather than the last
+	// E1.31 frame
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	send(3, 0, frame)
+	r.flush(ctx)
+	assert.Equal(t, opaque([]uint32{0x0000ff, 0x00ff00, 0xff0000, 0xffffff}), b.dev.States())
+
+	send(4, e131OptionTerminated, nil)
+	r.flush(ctx)
+	assert.False(t, active())
+	assert.Equal(t, solid(0, 4), b.dev.States())
+	require.Equal(t, 0, remoteSet(lb.On, true))
+	assert.Equal(t, opaque(solid(red, 4)), b.dev.States())
+}
+
+func TestE131ReceiverConcurrentHomeKit(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a short timeout, so control goes back and forth while HomeKit writes
+	// to the strip at the same time - this is mostly for the race detector
+	r, err := newE131Receiver(lb, b.strip, 1, 1, 1000, 5*time.Millisecond)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.run(ctx)
+	}()
+
+	require.Eventually(t, func() bool { return r.pixels.Load() == 4 }, time.Second, time.Millisecond)
+
+	frame := []byte{0, 0, 0xff, 0, 0xff, 0, 0xff, 0, 0, 0xff, 0xff, 0xff}
+	for i := 0; i < 20; i++ {
+		r.handle(ctx, &e131Packet{universe: 1, sequence: byte(i), data: frame})
+		remoteSet(lb.On, i%2 == 0)
+		remoteSet(lb.Hue, float64(i*10))
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/brutella/hap/service"
+	"github.com/lucasb-eyer/go-colorful"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/yaml.v3"
+)
+
+// fillSpec describes a multi-color fill across the strip, e.g.:
+//
+//	type: gradient
+//	colors: ["#ff4000", "#ff00a0", "#4000ff"]
+//	stops: [0, 0.3, 1]
+//	space: hcl
+//	repeat: 2
+type fillSpec struct {
+	// Type is either "gradient" (the default), which blends between the
+	// colors, or "palette", which shows each color in turn without blending
+	Type string `yaml:"type" json:"type,omitempty"`
+	// Space is the color space gradients are blended in - one of rgb, lab,
+	// luv, hcl (the default), luvlch or hsv
+	Space string `yaml:"space" json:"space,omitempty"`
+	// Colors are hex RGB colors, e.g. "#ff8800"
+	Colors []string `yaml:"colors" json:"colors"`
+	// Stops are the gradient's colors' positions along the strip, from 0 to
+	// 1 - the colors are evenly spaced when omitted
+	Stops []float64 `yaml:"stops" json:"stops,omitempty"`
+	// Repeat is the number of times the fill is repeated along the strip
+	Repeat int `yaml:"repeat" json:"repeat,omitempty"`
+	// Reverse runs the fill from the end of the strip
+	Reverse bool `yaml:"reverse" json:"reverse,omitempty"`
+}
+
+// blendFuncs are the color spaces gradients can be blended in
+var blendFuncs = map[string]func(c1, c2 colorful.Color, t float64) colorful.Color{
+	"rgb":    colorful.Color.BlendRgb,
+	"lab":    colorful.Color.BlendLab,
+	"luv":    colorful.Color.BlendLuv,
+	"hcl":    colorful.Color.BlendHcl,
+	"luvlch": colorful.Color.BlendLuvLCh,
+	"hsv":    colorful.Color.BlendHsv,
+}
+
+// fill is a parsed fillSpec, which can be rendered onto the strip
+type fill struct {
+	spec   *fillSpec
+	blend  func(c1, c2 colorful.Color, t float64) colorful.Color
+	colors []colorful.Color
+	stops  []float64
+}
+
+// parse validates the spec
+func (s *fillSpec) parse() (*fill, error) {
+	f := &fill{spec: s}
+
+	switch s.Type {
+	case "", "gradient", "palette":
+	default:
+		return nil, fmt.Errorf("fill type must be gradient or palette, not %q", s.Type)
+	}
+
+	if len(s.Colors) == 0 {
+		return nil, errors.New("a fill needs at least one color")
+	}
+	for _, h := range s.Colors {
+		c, err := colorful.Hex(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid color: %w", err)
+		}
+		f.colors = append(f.colors, c)
+	}
+
+	space := s.Space
+	if space == "" {
+		space = "hcl"
+	}
+	f.blend = blendFuncs[space]
+	if f.blend == nil {
+		return nil, fmt.Errorf("unknown color space %q", s.Space)
+	}
+
+	if s.Repeat < 0 {
+		return nil, fmt.Errorf("repeat must not be negative, not %d", s.Repeat)
+	}
+
+	stops, err := s.parseStops()
+	if err != nil {
+		return nil, err
+	}
+	f.stops = stops
+
+	return f, nil
+}
+
+// parseStops validates the spec's stops, or spaces the colors evenly when
+// there aren't any
+func (s *fillSpec) parseStops() ([]float64, error) {
+	switch {
+	case len(s.Stops) == 0:
+		return evenStops(len(s.Colors)), nil
+	case s.Type == "palette":
+		return nil, errors.New("stops can only be used with gradients")
+	case len(s.Stops) != len(s.Colors):
+		return nil, fmt.Errorf("a fill with %d colors needs %d stops, not %d", len(s.Colors), len(s.Colors), len(s.Stops))
+	}
+
+	for i, p := range s.Stops {
+		if p < 0 || p > 1 {
+			return nil, fmt.Errorf("stops must be between 0 and 1, not %g", p)
+		}
+		if i > 0 && p < s.Stops[i-1] {
+			return nil, errors.New("stops must be in ascending order")
+		}
+	}
+	return s.Stops, nil
+}
+
+// evenStops spaces n colors evenly along the strip
+func evenStops(n int) []float64 {
+	stops := make([]float64, n)
+	if n > 1 {
+		for i := range stops {
+			stops[i] = float64(i) / float64(n-1)
+		}
+	}
+	return stops
+}
+
+// render renders the fill onto a strip of n pixels
+func (f *fill) render(n int) []colorful.Color {
+	repeat := max(f.spec.Repeat, 1)
+
+	frame := make([]colorful.Color, n)
+	for i := range frame {
+		p := i
+		if f.spec.Reverse {
+			p = n - 1 - i
+		}
+
+		if f.spec.Type == "palette" {
+			frame[i] = f.colors[p*repeat*len(f.colors)/n%len(f.colors)]
+			continue
+		}
+
+		// the position within this repetition of the gradient, stretched
+		// so that each repetition's last pixel gets the last color
+		width := float64(n) / float64(repeat)
+		x := float64(p) / width
+		t := 0.0
+		if width > 1 {
+			t = math.Min((x-math.Floor(x))*width/(width-1), 1)
+		}
+		frame[i] = f.at(t)
+	}
+	return frame
+}
+
+// at returns the gradient's color at position t
+func (f *fill) at(t float64) colorful.Color {
+	last := len(f.colors) - 1
+	switch {
+	case t <= f.stops[0]:
+		return f.colors[0]
+	case t >= f.stops[last]:
+		return f.colors[last]
+	}
+
+	i := sort.SearchFloat64s(f.stops, t)
+	from, to := f.stops[i-1], f.stops[i]
+	if to == from {
+		return f.colors[i]
+	}
+	return f.blend(f.colors[i-1], f.colors[i], (t-from)/(to-from)).Clamped()
+}
+
+// base returns the hue (degrees) and saturation (0-1) of the fill's first
+// color, which is what HomeKit shows while the fill is displayed
+func (f *fill) base() (hue, sat float64) {
+	hue, sat, _ = f.colors[0].Hsv()
+	return hue, sat
+}
+
+// pattern renders the fill onto n pixels, as a pattern that's shown as it
+// is at full brightness and the hue and saturation of its first color
+func (f *fill) pattern(n int) *pattern {
+	hue, sat := f.base()
+	return &pattern{frame: f.render(n), hue: hue, sat: sat, val: 1}
+}
+
+// fillPresets are named fills, loaded from a YAML file, e.g.:
+//
+//	sunset:
+//	  colors: ["#ff4000", "#ff00a0", "#4000ff"]
+//	candy:
+//	  type: palette
+//	  colors: ["#ff0000", "#ffffff"]
+//	  repeat: 10
+type fillPresets map[string]*fill
+
+// loadFillPresets reads and validates a file of fill presets
+func loadFillPresets(path string) (fillPresets, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fill presets: %w", err)
+	}
+
+	return parseFillPresets(b)
+}
+
+func parseFillPresets(b []byte) (fillPresets, error) {
+	specs := map[string]*fillSpec{}
+	if err := yaml.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse fill presets: %w", err)
+	}
+
+	presets := fillPresets{}
+	for name, s := range specs {
+		if s == nil {
+			return nil, fmt.Errorf("fill preset %q is empty", name)
+		}
+		f, err := s.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid fill preset %q: %w", name, err)
+		}
+		presets[name] = f
+	}
+
+	return presets, nil
+}
+
+// applyFill shows the fill on the strip, at the lightbulb's brightness, and
+// turns the light on. The lightbulb's hue and saturation are set to the
+// fill's first color, so that palette mode rotates the fill from there.
+func applyFill(ctx context.Context, lb *service.ColoredLightbulb, strip *wifineopixel, f *fill) error {
+	ctx, span := otel.Tracer("").Start(ctx, "fill.apply")
+	defer span.End()
+
+	hue, sat := f.base()
+	span.SetAttributes(
+		attribute.String("type", f.spec.Type),
+		attribute.StringSlice("colors", f.spec.Colors),
+	)
+
+	p := f.pattern(strip.pixelCount())
+	frame := p.at(hue, sat*100, lb.Brightness.Value())
+	if err := strip.setState(ctx, frame); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to apply fill: %w", err)
+	}
+	strip.pattern.set(p, f.spec, frame)
+	strip.pattern.setColor(hue, sat*100, lb.Brightness.Value())
+
+	lb.Hue.SetValue(hue)
+	lb.Saturation.SetValue(sat * 100)
+	lb.On.SetValue(true)
+
+	return nil
+}
+
+// fillHandler is the API for showing fills on the strip. GET returns the
+// current fill and the presets' names, PUT shows a fill (given as JSON, or
+// by preset name with ?preset=), and DELETE returns the strip to the
+// lightbulb's solid color.
+type fillHandler struct {
+	lb      *service.ColoredLightbulb
+	strip   *wifineopixel
+	presets fillPresets
+}
+
+// fillStatus describes the strip's fill, for the API
+type fillStatus struct {
+	Fill        *fillSpec `json:"fill"`
+	Presets     []string  `json:"presets"`
+	PaletteMode bool      `json:"paletteMode"`
+}
+
+func (h *fillHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("").Start(r.Context(), "fill."+r.Method)
+	defer span.End()
+
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		h.get(w)
+	case http.MethodPut:
+		err = h.put(ctx, w, r)
+	case http.MethodDelete:
+		err = h.delete(ctx, w)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+}
+
+// get responds with the strip's fill and the presets' names
+func (h *fillHandler) get(w http.ResponseWriter) {
+	st := fillStatus{
+		Fill:        h.strip.pattern.fillSpec(),
+		Presets:     make([]string, 0, len(h.presets)),
+		PaletteMode: h.strip.pattern.paletteMode,
+	}
+	for name := range h.presets {
+		st.Presets = append(st.Presets, name)
+	}
+	sort.Strings(st.Presets)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// put shows the requested fill, returning an error only if the strip
+// couldn't be written to
+func (h *fillHandler) put(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var f *fill
+	if name := r.URL.Query().Get("preset"); name != "" {
+		f = h.presets[name]
+		if f == nil {
+			http.Error(w, fmt.Sprintf("unknown preset %q", name), http.StatusNotFound)
+			return nil
+		}
+	} else {
+		spec := &fillSpec{}
+		if err := json.NewDecoder(r.Body).Decode(spec); err != nil {
+			http.Error(w, fmt.Sprintf("invalid fill: %v", err), http.StatusBadRequest)
+			return nil
+		}
+		var err error
+		f, err = spec.parse()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid fill: %v", err), http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	if err := applyFill(ctx, h.lb, h.strip, f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// delete returns the strip to the lightbulb's solid color, returning an
+// error if the strip couldn't be written to
+func (h *fillHandler) delete(ctx context.Context, w http.ResponseWriter) error {
+	h.strip.pattern.set(nil, nil, nil)
+
+	// a light that's off is left off, and shows the solid color when it's
+	// turned back on
+	lb := h.lb
+	c := colorful.Hsv(lb.Hue.Value(), lb.Saturation.Value()/100, float64(lb.Brightness.Value())/100)
+	if lb.On.Value() {
+		if err := h.strip.setSolid(ctx, c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return err
+		}
+		h.strip.pattern.setColor(lb.Hue.Value(), lb.Saturation.Value(), lb.Brightness.Value())
+	} else {
+		onState := make([]colorful.Color, h.strip.pixelCount())
+		for i := range onState {
+			onState[i] = c
+		}
+		h.strip.restoreOnState(onState)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hairyhenderson/wnp-bridge/wnptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseFill(t *testing.T, s string) *fill {
+	t.Helper()
+
+	spec := &fillSpec{}
+	require.NoError(t, json.Unmarshal([]byte(s), spec))
+	f, err := spec.parse()
+	require.NoError(t, err)
+	return f
+}
+
+func TestFillSpecParse(t *testing.T) {
+	f := parseFill(t, `{"colors": ["#ff0000", "#00ff00", "#0000ff"]}`)
+	assert.Equal(t, []float64{0, 0.5, 1}, f.stops)
+
+	testdata := []string{
+		`{"colors": []}`,
+		`{"colors": ["red"]}`,
+		`{"type": "rainbow", "colors": ["#ff0000"]}`,
+		`{"space": "cmyk", "colors": ["#ff0000"]}`,
+		`{"repeat": -1, "colors": ["#ff0000"]}`,
+		`{"colors": ["#ff0000", "#0000ff"], "stops": [0]}`,
+		`{"colors": ["#ff0000", "#0000ff"], "stops": [0, 1.5]}`,
+		`{"colors": ["#ff0000", "#0000ff"], "stops": [1, 0]}`,
+		`{"type": "palette", "colors": ["#ff0000", "#0000ff"], "stops": [0, 1]}`,
+	}
+	for _, d := range testdata {
+		spec := &fillSpec{}
+		require.NoError(t, json.Unmarshal([]byte(d), spec))
+		_, err := spec.parse()
+		assert.Error(t, err, d)
+	}
+}
+
+func TestFillRender(t *testing.T) {
+	testdata := []struct {
+		spec     string
+		expected []uint32
+	}{
+		{
+			`{"space": "rgb", "colors": ["#ff0000", "#0000ff"]}`,
+			[]uint32{0xff0000, 0x800080, 0x0000ff},
+		},
+		{
+			`{"space": "rgb", "colors": ["#ff0000", "#0000ff"], "reverse": true}`,
+			[]uint32{0x0000ff, 0x800080, 0xff0000},
+		},
+		{
+			`{"space": "rgb", "colors": ["#ff0000", "#0000ff"], "repeat": 2}`,
+			[]uint32{0xff0000, 0x0000ff, 0xff0000, 0x0000ff},
+		},
+		{
+			`{"space": "rgb", "colors": ["#ff0000", "#0000ff"], "stops": [0.5, 1]}`,
+			[]uint32{0xff0000, 0xff0000, 0xff0000, 0x800080, 0x0000ff},
+		},
+		{
+			`{"colors": ["#00ff00"]}`,
+			[]uint32{0x00ff00, 0x00ff00},
+		},
+		{
+			`{"type": "palette", "colors": ["#ff0000", "#ffffff"], "repeat": 2}`,
+			[]uint32{0xff0000, 0xff0000, 0xffffff, 0xffffff, 0xff0000, 0xff0000, 0xffffff, 0xffffff},
+		},
+	}
+
+	for _, d := range testdata {
+		f := parseFill(t, d.spec)
+		assert.Equal(t, opaque(d.expected), colorsToUint32(f.render(len(d.expected))), d.spec)
+	}
+
+	// gradients in other color spaces still start and end on their colors
+	for space := range blendFuncs {
+		f := parseFill(t, `{"space": "`+space+`", "colors": ["#ff0000", "#0000ff"]}`)
+		frame := colorsToUint32(f.render(10))
+		assert.Equal(t, opaque([]uint32{0xff0000}), frame[:1], space)
+		assert.Equal(t, opaque([]uint32{0x0000ff}), frame[9:], space)
+	}
+}
+
+func TestFillPattern(t *testing.T) {
+	f := parseFill(t, `{"space": "rgb", "colors": ["#ff0000", "#00ff00"]}`)
+
+	hue, sat := f.base()
+	assert.Equal(t, 0.0, hue)
+	assert.Equal(t, 1.0, sat)
+
+	assert.Equal(t, opaque([]uint32{red, green}), colorsToUint32(f.pattern(2).at(0, 100, 100)))
+	// the whole fill is rotated and dimmed
+	assert.Equal(t, opaque([]uint32{0x008000, 0x000080}), colorsToUint32(f.pattern(2).at(120, 100, 50)))
+	// and desaturated
+	assert.Equal(t, opaque([]uint32{0xffffff, 0xffffff}), colorsToUint32(f.pattern(2).at(0, 0, 100)))
+}
+
+func TestParseFillPresets(t *testing.T) {
+	presets, err := parseFillPresets([]byte(`
+sunset:
+  colors: ["#ff4000", "#ff00a0", "#4000ff"]
+candy:
+  type: palette
+  colors: ["#ff0000", "#ffffff"]
+  repeat: 10
+`))
+	require.NoError(t, err)
+	assert.Len(t, presets, 2)
+	assert.Equal(t, "palette", presets["candy"].spec.Type)
+
+	_, err = parseFillPresets([]byte(`bad: {colors: []}`))
+	assert.Error(t, err)
+	_, err = parseFillPresets([]byte(`empty:`))
+	assert.Error(t, err)
+}
+
+func TestFillHandler(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	presets, err := parseFillPresets([]byte(`rg: {space: rgb, colors: ["#ff0000", "#00ff00"], repeat: 2}`))
+	require.NoError(t, err)
+	h := &fillHandler{lb: lb, strip: b.strip, presets: presets}
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	// turning the light off first shows that a fill turns it on
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	b.dev.ResetRequests()
+
+	w := do(http.MethodPut, "/fill", `{"space": "rgb", "colors": ["#0000ff", "#00ff00"]}`)
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.Equal(t, [][]uint32{opaque([]uint32{0x0000ff, 0x0055aa, 0x00aa55, 0x00ff00})}, b.rawPayloads(t))
+	assert.True(t, lb.On.Value())
+	assert.Equal(t, 240.0, lb.Hue.Value())
+	assert.Contains(t, b.spanNames(), "fill.apply")
+
+	w = do(http.MethodGet, "/fill", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"fill": {"space": "rgb", "colors": ["#0000ff", "#00ff00"]}, "presets": ["rg"], "paletteMode": false}`,
+		w.Body.String())
+
+	// without palette mode, a HomeKit color change replaces the fill
+	require.Equal(t, 0, remoteSet(lb.Hue, 0.0))
+	assert.Equal(t, opaque(solid(red, 4)), b.dev.States())
+	assert.Nil(t, b.strip.pattern.fillSpec())
+
+	// with palette mode, the fill is rotated and dimmed
+	b.strip.pattern.paletteMode = true
+	w = do(http.MethodPut, "/fill?preset=rg", "")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.Equal(t, opaque([]uint32{red, green, red, green}), b.dev.States())
+
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	assert.Equal(t, opaque([]uint32{green, 0x0000ff, green, 0x0000ff}), b.dev.States())
+	require.Equal(t, 0, remoteSet(lb.Brightness, 50))
+	assert.Equal(t, opaque([]uint32{0x008000, 0x000080, 0x008000, 0x000080}), b.dev.States())
+
+	// turning the light off and on again keeps the fill
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	require.Equal(t, 0, remoteSet(lb.On, true))
+	assert.Equal(t, opaque([]uint32{0x008000, 0x000080, 0x008000, 0x000080}), b.dev.States())
+
+	// deleting the fill goes back to the solid color
+	w = do(http.MethodDelete, "/fill", "")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.Equal(t, opaque(solid(0x008000, 4)), b.dev.States())
+	assert.Nil(t, b.strip.pattern.fillSpec())
+
+	// deleting the fill while the light's off leaves it off, and it comes
+	// back on with the solid color of the fill's first color
+	w = do(http.MethodPut, "/fill?preset=rg", "")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	b.dev.ResetRequests()
+	w = do(http.MethodDelete, "/fill", "")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.Empty(t, b.rawPayloads(t))
+	require.Equal(t, 0, remoteSet(lb.On, true))
+	assert.Equal(t, opaque(solid(0x800000, 4)), b.dev.States())
+	assert.Nil(t, b.strip.pattern.fillSpec())
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPut, "/fill?preset=nope", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/fill", `{"colors": []}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/fill", `nope`).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "/fill", "").Code)
+
+	// the device being unreachable is reported
+	b.dev.SetFaults(wnptest.Faults{ErrorRate: 1})
+	assert.Equal(t, http.StatusBadGateway, do(http.MethodPut, "/fill?preset=rg", "").Code)
+}
@@ -0,0 +1,214 @@
+// hap has data races of its own (in conn and its dnssd responder) which
+// these end-to-end tests trigger, so they're skipped with -race. `make test`
+// runs them separately, without it.
+
+//go:build !race
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/characteristic"
+	hclog "github.com/brutella/hap/log"
+	"github.com/hairyhenderson/wnp-bridge/wnptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPin = "12344321"
+
+// startHAPServer serves the bridge's accessory over HAP on a loopback port,
+// returning the address to connect to
+func startHAPServer(t *testing.T, b *testBridge) string {
+	t.Helper()
+
+	// hap logs failed pairings and unauthorized requests, which some tests
+	// provoke on purpose
+	hclog.Info.Disable()
+
+	srv, err := hap.NewServer(hap.NewFsStore(t.TempDir()), b.acc.A)
+	require.NoError(t, err)
+	srv.Pin = testPin
+	srv.Addr = freeAddr(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = srv.ListenAndServe(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// wait for the server to start listening
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", srv.Addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return srv.Addr
+}
+
+// freeAddr finds an unused loopback port - hap.Server doesn't expose the
+// port it listens on, so ":0" can't be used
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func pairController(t *testing.T, addr string) *hapController {
+	t.Helper()
+
+	hc, err := newHAPController("test-controller")
+	require.NoError(t, err)
+	require.NoError(t, hc.pair(addr, testPin))
+	return hc
+}
+
+func connectController(t *testing.T, hc *hapController, addr string) *hapConn {
+	t.Helper()
+
+	c, err := hc.connect(addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func charID(b *testBridge, c *characteristic.C) hapCharacteristic {
+	return hapCharacteristic{Aid: b.acc.A.Id, Iid: c.Id}
+}
+
+func charValue(b *testBridge, c *characteristic.C, v interface{}) hapCharacteristic {
+	hc := charID(b, c)
+	hc.Value = v
+	return hc
+}
+
+func TestHAPPairing(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	addr := startHAPServer(t, b)
+
+	hc, err := newHAPController("wrong-pin")
+	require.NoError(t, err)
+	assert.Error(t, hc.pair(addr, "11122333"))
+
+	// characteristics can't be read without pairing
+	c, err := dialHAP(addr)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.get(charID(b, b.acc.Lightbulb.On.C))
+	assert.Error(t, err)
+
+	hc = pairController(t, addr)
+
+	// only one controller can pair - others must be added by an admin
+	other, err := newHAPController("other")
+	require.NoError(t, err)
+	assert.Error(t, other.pair(addr, testPin))
+	_, err = other.connect(addr)
+	assert.Error(t, err)
+
+	// the paired controller can connect more than once
+	connectController(t, hc, addr)
+	connectController(t, hc, addr)
+}
+
+func TestHAPControl(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+	addr := startHAPServer(t, b)
+
+	c := connectController(t, pairController(t, addr), addr)
+
+	on, hue, bri := charID(b, lb.On.C), charID(b, lb.Hue.C), charID(b, lb.Brightness.C)
+	cs, err := c.get(on, hue, bri)
+	require.NoError(t, err)
+	require.Len(t, cs, 3)
+	assert.Equal(t, true, cs[0].Value)
+	assert.EqualValues(t, 0, cs[1].Value)
+	assert.EqualValues(t, 100, cs[2].Value)
+
+	statuses, err := c.put(charValue(b, lb.On.C, false))
+	require.NoError(t, err)
+	assert.Empty(t, statuses)
+	assert.Equal(t, solid(0, 4), b.dev.States())
+	assert.False(t, lb.On.Value())
+
+	b.dev.ResetRequests()
+	statuses, err = c.put(charValue(b, lb.On.C, true))
+	require.NoError(t, err)
+	assert.Empty(t, statuses)
+	assert.Equal(t, opaque(solid(red, 4)), b.dev.States())
+
+	statuses, err = c.put(charValue(b, lb.Hue.C, 120))
+	require.NoError(t, err)
+	assert.Empty(t, statuses)
+	assert.Equal(t, opaque(solid(green, 4)), b.dev.States())
+
+	cs, err = c.get(hue)
+	require.NoError(t, err)
+	assert.EqualValues(t, 120, cs[0].Value)
+
+	// device failures are reported per-characteristic
+	b.dev.SetFaults(wnptest.Faults{ErrorRate: 1})
+	statuses, err = c.put(charValue(b, lb.On.C, false))
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	require.NotNil(t, statuses[0].Status)
+	assert.Equal(t, hapStatusCommunicationFailure, *statuses[0].Status)
+	assert.True(t, lb.On.Value())
+}
+
+func TestHAPEvents(t *testing.T) {
+	b := setupBridge(t, solid(green, 4))
+	lb := b.acc.Lightbulb
+	addr := startHAPServer(t, b)
+
+	hc := pairController(t, addr)
+	watcher := connectController(t, hc, addr)
+	writer := connectController(t, hc, addr)
+
+	require.NoError(t, watcher.subscribe(charID(b, lb.On.C), charID(b, lb.Brightness.C)))
+
+	// changes made by another controller are pushed to subscribers...
+	_, err := writer.put(charValue(b, lb.On.C, false))
+	require.NoError(t, err)
+
+	ev, err := watcher.nextEvent(2 * time.Second)
+	require.NoError(t, err)
+	require.Len(t, ev.Characteristics, 1)
+	assert.Equal(t, lb.On.Id, ev.Characteristics[0].Iid)
+	assert.Equal(t, false, ev.Characteristics[0].Value)
+
+	// ...but not to the controller that made them
+	_, err = writer.nextEvent(100 * time.Millisecond)
+	assert.Error(t, err)
+
+	// changes made by the bridge itself are pushed too
+	lb.Brightness.SetValue(50)
+	ev, err = watcher.nextEvent(2 * time.Second)
+	require.NoError(t, err)
+	require.Len(t, ev.Characteristics, 1)
+	assert.Equal(t, lb.Brightness.Id, ev.Characteristics[0].Iid)
+	assert.EqualValues(t, 50, ev.Characteristics[0].Value)
+
+	// unsubscribed characteristics don't generate events
+	lb.Hue.SetValue(200)
+	_, err = watcher.nextEvent(100 * time.Millisecond)
+	assert.Error(t, err)
+}
@@ -0,0 +1,677 @@
+// only used by the end-to-end tests in hap_test.go
+
+//go:build !race
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brutella/hap/chacha20poly1305"
+	"github.com/brutella/hap/curve25519"
+	"github.com/brutella/hap/hkdf"
+	"github.com/brutella/hap/tlv8"
+	"github.com/tadglines/go-pkgs/crypto/srp"
+)
+
+// hapController is a minimal headless HomeKit controller, for driving the
+// bridge over the network the same way the Home app would. It isn't safe
+// for concurrent use, and only speaks enough HAP to pair and to read, write
+// and subscribe to characteristics.
+type hapController struct {
+	// id and key identify the controller to the accessory - they're
+	// generated once, and reused by every connection
+	id  string
+	key ed25519.PrivateKey
+
+	// accessoryKey is the accessory's long-term public key, learned
+	// during pair-setup
+	accessoryKey ed25519.PublicKey
+}
+
+func newHAPController(id string) (*hapController, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &hapController{id: id, key: key}, nil
+}
+
+// hapConn is a connection to the accessory. It's plaintext until pair-verify
+// completes, and encrypted from then on.
+type hapConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// set after pair-verify
+	readKey, writeKey     [32]byte
+	readCount, writeCount uint64
+	secure                bool
+
+	// events holds notifications received while waiting for a response
+	events []hapEvent
+}
+
+// hapCharacteristic identifies a characteristic, and optionally carries a
+// value or an event subscription
+type hapCharacteristic struct {
+	Aid    uint64      `json:"aid"`
+	Iid    uint64      `json:"iid"`
+	Value  interface{} `json:"value,omitempty"`
+	Events *bool       `json:"ev,omitempty"`
+	Status *int        `json:"status,omitempty"`
+}
+
+type hapEvent struct {
+	Characteristics []hapCharacteristic `json:"characteristics"`
+}
+
+// hapMessage is a response or event read from the accessory
+type hapMessage struct {
+	proto  string
+	status int
+	body   []byte
+}
+
+// pairingRequest is sent in pair-setup and pair-verify requests. The tlv8
+// encoder doesn't understand "optional", but skips empty byte slices.
+type pairingRequest struct {
+	Method        byte   `tlv8:"0"`
+	PublicKey     []byte `tlv8:"3"`
+	Proof         []byte `tlv8:"4"`
+	EncryptedData []byte `tlv8:"5"`
+	State         byte   `tlv8:"6"`
+}
+
+// pairingSubTLV is the encrypted part of pair-setup and pair-verify
+// requests
+type pairingSubTLV struct {
+	Identifier string `tlv8:"1"`
+	PublicKey  []byte `tlv8:"3"`
+	Signature  []byte `tlv8:"10"`
+}
+
+// accessorySubTLV is the encrypted part of pair-setup and pair-verify
+// responses - PublicKey is only sent in pair-setup
+type accessorySubTLV struct {
+	Identifier string `tlv8:"1"`
+	PublicKey  []byte `tlv8:"3,optional"`
+	Signature  []byte `tlv8:"10"`
+}
+
+// pairingPayload is used to decode pair-setup and pair-verify responses
+type pairingPayload struct {
+	Salt          []byte `tlv8:"2,optional"`
+	PublicKey     []byte `tlv8:"3,optional"`
+	Proof         []byte `tlv8:"4,optional"`
+	EncryptedData []byte `tlv8:"5,optional"`
+	State         byte   `tlv8:"6"`
+	Error         byte   `tlv8:"7,optional"`
+}
+
+func dialHAP(addr string) (*hapConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &hapConn{conn: conn}
+	c.br = bufio.NewReader(readerFunc(c.read))
+	return c, nil
+}
+
+func (c *hapConn) Close() error {
+	return c.conn.Close()
+}
+
+// pair runs pair-setup with the given setup code (e.g. "00102003"), after
+// which the controller can connect with pair-verify
+func (hc *hapController) pair(addr, pin string) error {
+	c, err := dialHAP(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	srpKey, err := c.pairSetupSRP(pin)
+	if err != nil {
+		return err
+	}
+
+	hc.accessoryKey, err = hc.pairSetupExchange(c, srpKey)
+	return err
+}
+
+// pairSetupSRP runs the first four pair-setup steps, proving both sides
+// know the setup code, and returns the shared SRP key
+func (c *hapConn) pairSetupSRP(pin string) ([]byte, error) {
+	// M1 -> M2: get the salt and the accessory's SRP public key
+	m2, err := c.postTLV8("/pair-setup", pairingRequest{State: 1})
+	if err != nil {
+		return nil, fmt.Errorf("pair-setup M1: %w", err)
+	}
+
+	username := []byte("Pair-Setup")
+	s, err := srp.NewSRP("rfc5054.3072", sha512.New, srpKeyDerivative(username))
+	if err != nil {
+		return nil, err
+	}
+	// the accessory formats the code as XXX-XX-XXX
+	client := s.NewClientSession(username, []byte(pin[:3]+"-"+pin[3:5]+"-"+pin[5:]))
+	srpKey, err := client.ComputeKey(m2.Salt, m2.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("pair-setup M2: %w", err)
+	}
+
+	// M3 -> M4: exchange proofs
+	m4, err := c.postTLV8("/pair-setup", pairingRequest{
+		State:     3,
+		PublicKey: client.GetA(),
+		Proof:     client.ComputeAuthenticator(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pair-setup M3: %w", err)
+	}
+	if !client.VerifyServerAuthenticator(m4.Proof) {
+		return nil, errors.New("pair-setup M4: invalid accessory proof")
+	}
+
+	return srpKey, nil
+}
+
+// pairSetupExchange runs the last two pair-setup steps, exchanging the
+// controller's and accessory's long-term keys, and returns the accessory's
+// public key
+func (hc *hapController) pairSetupExchange(c *hapConn, srpKey []byte) (ed25519.PublicKey, error) {
+	// M5 -> M6: exchange long-term keys
+	encKey, err := hkdf.Sha512(srpKey, []byte("Pair-Setup-Encrypt-Salt"), []byte("Pair-Setup-Encrypt-Info"))
+	if err != nil {
+		return nil, err
+	}
+	signKey, err := hkdf.Sha512(srpKey, []byte("Pair-Setup-Controller-Sign-Salt"), []byte("Pair-Setup-Controller-Sign-Info"))
+	if err != nil {
+		return nil, err
+	}
+
+	pub := hc.key.Public().(ed25519.PublicKey)
+	signed := concat(signKey[:], []byte(hc.id), pub)
+	sub, err := tlv8.Marshal(pairingSubTLV{
+		Identifier: hc.id,
+		PublicKey:  pub,
+		Signature:  ed25519.Sign(hc.key, signed),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m6, err := c.postTLV8("/pair-setup", pairingRequest{
+		State:         5,
+		EncryptedData: seal(encKey, "PS-Msg05", sub),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pair-setup M5: %w", err)
+	}
+
+	b, err := open(encKey, "PS-Msg06", m6.EncryptedData)
+	if err != nil {
+		return nil, fmt.Errorf("pair-setup M6: %w", err)
+	}
+	acc := accessorySubTLV{}
+	if err := tlv8.Unmarshal(b, &acc); err != nil {
+		return nil, fmt.Errorf("pair-setup M6: %w", err)
+	}
+
+	accSignKey, err := hkdf.Sha512(srpKey, []byte("Pair-Setup-Accessory-Sign-Salt"), []byte("Pair-Setup-Accessory-Sign-Info"))
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(acc.PublicKey, concat(accSignKey[:], []byte(acc.Identifier), acc.PublicKey), acc.Signature) {
+		return nil, errors.New("pair-setup M6: invalid accessory signature")
+	}
+
+	return acc.PublicKey, nil
+}
+
+// connect opens a connection and runs pair-verify on it, so that it's
+// encrypted and authorized for characteristic requests
+func (hc *hapController) connect(addr string) (*hapConn, error) {
+	if hc.accessoryKey == nil {
+		return nil, errors.New("not paired")
+	}
+
+	c, err := dialHAP(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hc.verify(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (hc *hapController) verify(c *hapConn) error {
+	pub, priv := curve25519.GenerateKeyPair()
+
+	// M1 -> M2: exchange ephemeral keys, and check the accessory's identity
+	m2, err := c.postTLV8("/pair-verify", pairingRequest{State: 1, PublicKey: pub[:]})
+	if err != nil {
+		return fmt.Errorf("pair-verify M1: %w", err)
+	}
+
+	var accPub [32]byte
+	copy(accPub[:], m2.PublicKey)
+	shared := curve25519.SharedSecret(priv, accPub)
+
+	encKey, err := hkdf.Sha512(shared[:], []byte("Pair-Verify-Encrypt-Salt"), []byte("Pair-Verify-Encrypt-Info"))
+	if err != nil {
+		return err
+	}
+
+	b, err := open(encKey, "PV-Msg02", m2.EncryptedData)
+	if err != nil {
+		return fmt.Errorf("pair-verify M2: %w", err)
+	}
+	acc := accessorySubTLV{}
+	if err := tlv8.Unmarshal(b, &acc); err != nil {
+		return fmt.Errorf("pair-verify M2: %w", err)
+	}
+	if !ed25519.Verify(hc.accessoryKey, concat(accPub[:], []byte(acc.Identifier), pub[:]), acc.Signature) {
+		return errors.New("pair-verify M2: invalid accessory signature")
+	}
+
+	// M3 -> M4: prove our identity
+	sub, err := tlv8.Marshal(pairingSubTLV{
+		Identifier: hc.id,
+		Signature:  ed25519.Sign(hc.key, concat(pub[:], []byte(hc.id), accPub[:])),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.postTLV8("/pair-verify", pairingRequest{
+		State:         3,
+		EncryptedData: seal(encKey, "PV-Msg03", sub),
+	})
+	if err != nil {
+		return fmt.Errorf("pair-verify M3: %w", err)
+	}
+
+	// everything from here on is encrypted - note the accessory's read key
+	// is our write key, and vice versa
+	c.readKey, err = hkdf.Sha512(shared[:], []byte("Control-Salt"), []byte("Control-Read-Encryption-Key"))
+	if err != nil {
+		return err
+	}
+	c.writeKey, err = hkdf.Sha512(shared[:], []byte("Control-Salt"), []byte("Control-Write-Encryption-Key"))
+	if err != nil {
+		return err
+	}
+	c.secure = true
+
+	return nil
+}
+
+// postTLV8 POSTs a TLV8 payload, and returns the decoded response
+func (c *hapConn) postTLV8(path string, p pairingRequest) (*pairingPayload, error) {
+	b, err := tlv8.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.do(http.MethodPost, path, "application/pairing+tlv8", b)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pairingPayload{}
+	if err := tlv8.Unmarshal(msg.body, resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != 0 {
+		return nil, fmt.Errorf("accessory returned TLV error %d (HTTP %d)", resp.Error, msg.status)
+	}
+	if resp.State != p.State+1 {
+		return nil, fmt.Errorf("unexpected state %d", resp.State)
+	}
+
+	return resp, nil
+}
+
+// get reads the values of characteristics
+func (c *hapConn) get(cs ...hapCharacteristic) ([]hapCharacteristic, error) {
+	ids := make([]string, len(cs))
+	for i, ch := range cs {
+		ids[i] = fmt.Sprintf("%d.%d", ch.Aid, ch.Iid)
+	}
+
+	msg, err := c.do(http.MethodGet, "/characteristics?id="+strings.Join(ids, ","), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if msg.status != http.StatusOK && msg.status != http.StatusMultiStatus {
+		return nil, fmt.Errorf("unexpected status %d: %s", msg.status, msg.body)
+	}
+
+	resp := hapEvent{}
+	if err := json.Unmarshal(msg.body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Characteristics, nil
+}
+
+// put writes characteristics (values and/or event subscriptions), and
+// returns any per-characteristic statuses reported by the accessory
+func (c *hapConn) put(cs ...hapCharacteristic) ([]hapCharacteristic, error) {
+	b, err := json.Marshal(hapEvent{Characteristics: cs})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.do(http.MethodPut, "/characteristics", "application/hap+json", b)
+	if err != nil {
+		return nil, err
+	}
+
+	switch msg.status {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusMultiStatus:
+		resp := hapEvent{}
+		if err := json.Unmarshal(msg.body, &resp); err != nil {
+			return nil, err
+		}
+		return resp.Characteristics, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %d: %s", msg.status, msg.body)
+	}
+}
+
+// subscribe enables event notifications for the given characteristics
+func (c *hapConn) subscribe(cs ...hapCharacteristic) error {
+	ev := true
+	for i := range cs {
+		cs[i].Events = &ev
+	}
+	statuses, err := c.put(cs...)
+	if err != nil {
+		return err
+	}
+	if len(statuses) > 0 {
+		return fmt.Errorf("failed to subscribe: %+v", statuses)
+	}
+	return nil
+}
+
+// nextEvent returns the next event notification, waiting up to timeout for
+// one to arrive
+func (c *hapConn) nextEvent(timeout time.Duration) (*hapEvent, error) {
+	if len(c.events) == 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		//nolint:errcheck
+		defer c.conn.SetReadDeadline(time.Time{})
+
+		msg, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.proto != "EVENT/1.0" {
+			return nil, fmt.Errorf("expected an event, got %s %d", msg.proto, msg.status)
+		}
+		if err := c.queueEvent(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	ev := c.events[0]
+	c.events = c.events[1:]
+	return &ev, nil
+}
+
+func (c *hapConn) queueEvent(msg *hapMessage) error {
+	ev := hapEvent{}
+	if err := json.Unmarshal(msg.body, &ev); err != nil {
+		return err
+	}
+	c.events = append(c.events, ev)
+	return nil
+}
+
+// do sends a request and reads the response, queueing any events that
+// arrive first
+func (c *hapConn) do(method, path, contentType string, body []byte) (*hapMessage, error) {
+	req, err := http.NewRequest(method, "http://hap"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := req.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := c.write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if err := c.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, err
+	}
+	//nolint:errcheck
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.proto != "EVENT/1.0" {
+			return msg, nil
+		}
+		if err := c.queueEvent(msg); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readMessage reads an HTTP-style message. This can't use
+// http.ReadResponse, since it rejects the EVENT/1.0 protocol used for
+// notifications.
+func (c *hapConn) readMessage() (*hapMessage, error) {
+	tp := textproto.NewReader(c.br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	proto, status, ok := strings.Cut(line, " ")
+	if !ok {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+	msg := &hapMessage{proto: proto}
+	msg.status, err = strconv.Atoi(strings.Fields(status)[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	msg.body, err = c.readBody(tp, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// readBody reads a message body, which is either chunked or has a
+// Content-Length
+func (c *hapConn) readBody(tp *textproto.Reader, hdr textproto.MIMEHeader) ([]byte, error) {
+	switch {
+	case hdr.Get("Transfer-Encoding") == "chunked":
+		body, err := io.ReadAll(httputil.NewChunkedReader(c.br))
+		if err != nil {
+			return nil, err
+		}
+		// the chunked reader stops before the final CRLF
+		if _, err := tp.ReadLine(); err != nil {
+			return nil, err
+		}
+		return body, nil
+	case hdr.Get("Content-Length") != "":
+		n, err := strconv.Atoi(hdr.Get("Content-Length"))
+		if err != nil {
+			return nil, err
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(c.br, body); err != nil {
+			return nil, err
+		}
+		return body, nil
+	default:
+		return nil, nil
+	}
+}
+
+// write sends b, encrypted into frames of up to 1024 bytes once the
+// connection is secure:
+//
+//	[length (2 bytes, little-endian)] [encrypted data] [auth tag (16 bytes)]
+func (c *hapConn) write(b []byte) error {
+	if !c.secure {
+		_, err := c.conn.Write(b)
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	for len(b) > 0 {
+		n := min(len(b), 0x400)
+
+		length := make([]byte, 2)
+		binary.LittleEndian.PutUint16(length, uint16(n))
+
+		enc, mac, err := chacha20poly1305.EncryptAndSeal(c.writeKey[:], nonce(c.writeCount), b[:n], length)
+		if err != nil {
+			return err
+		}
+		c.writeCount++
+
+		buf.Write(length)
+		buf.Write(enc)
+		buf.Write(mac[:])
+		b = b[n:]
+	}
+
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+// read reads plaintext from the connection, decrypting one frame at a time
+// once the connection is secure
+func (c *hapConn) read(b []byte) (int, error) {
+	if !c.secure {
+		return c.conn.Read(b)
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(c.conn, length); err != nil {
+		return 0, err
+	}
+	frame := make([]byte, int(binary.LittleEndian.Uint16(length))+16)
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		return 0, err
+	}
+
+	var mac [16]byte
+	copy(mac[:], frame[len(frame)-16:])
+	dec, err := chacha20poly1305.DecryptAndVerify(c.readKey[:], nonce(c.readCount), frame[:len(frame)-16], mac, length)
+	if err != nil {
+		return 0, err
+	}
+	c.readCount++
+
+	// frames are at most 1024 bytes, and the bufio.Reader's buffer is
+	// bigger, so this always fits
+	if len(dec) > len(b) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(b, dec), nil
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) { return f(b) }
+
+func nonce(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, n)
+	return b
+}
+
+// seal encrypts b with a fixed nonce, appending the auth tag, as used for
+// the encrypted sub-TLVs in pairing messages
+func seal(key [32]byte, nonce string, b []byte) []byte {
+	enc, mac, err := chacha20poly1305.EncryptAndSeal(key[:], []byte(nonce), b, nil)
+	if err != nil {
+		panic(err)
+	}
+	return append(enc, mac[:]...)
+}
+
+func open(key [32]byte, nonce string, b []byte) ([]byte, error) {
+	if len(b) < 16 {
+		return nil, errors.New("encrypted data too short")
+	}
+	var mac [16]byte
+	copy(mac[:], b[len(b)-16:])
+	return chacha20poly1305.DecryptAndVerify(key[:], []byte(nonce), b[:len(b)-16], mac, nil)
+}
+
+// srpKeyDerivative is the SRP-6a x = H(s | H(I | ":" | P)) function used by
+// HAP
+func srpKeyDerivative(username []byte) srp.KeyDerivationFunc {
+	return func(salt, password []byte) []byte {
+		h := sha512.New()
+		h.Write(username)
+		h.Write([]byte(":"))
+		h.Write(password)
+		inner := h.Sum(nil)
+
+		h.Reset()
+		h.Write(salt)
+		h.Write(inner)
+		return h.Sum(nil)
+	}
+}
+
+func concat(bs ...[]byte) []byte {
+	out := []byte{}
+	for _, b := range bs {
+		out = append(out, b...)
+	}
+	return out
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Philips Hue v1 API error types - see
+// https://developers.meethue.com/develop/hue-api/error-messages/
+const (
+	hueErrInvalidJSON   = 2
+	hueErrNotAvailable  = 3
+	hueErrInvalidValue  = 7
+	hueErrInternalError = 901
+)
+
+// hueLightID is the ID of the strip, the bridge's only light
+const hueLightID = "1"
+
+// hueBridge emulates a Philips Hue bridge's v1 local API, so that apps and
+// assistants that can't see HomeKit accessories (e.g. Alexa) can control the
+// strip. The strip is the bridge's only light, an extended color light.
+// State changes are written to the lightbulb's characteristics the way a
+// HomeKit controller's are, so they're handled by the same responders and
+// paired controllers are notified.
+type hueBridge struct {
+	lb *service.ColoredLightbulb
+	// temp is the Adaptive Lighting color temperature characteristic, used
+	// for ct changes when available
+	temp  *characteristic.ColorTemperature
+	strip *wifineopixel
+	// mode is the color mode last set through the API, which is reported
+	// until the color is changed some other way
+	mode *hueColorMode
+	name string
+	mac  net.HardwareAddr
+	mu   sync.Mutex
+}
+
+// hueColorMode is a color set with ct or xy, and the HomeKit hue and
+// saturation it was shown as
+type hueColorMode struct {
+	mode     string
+	xy       []float64
+	ct       int
+	hue, sat float64
+}
+
+func newHueBridge(lb *service.ColoredLightbulb, temp *characteristic.ColorTemperature, strip *wifineopixel, name string) *hueBridge {
+	return &hueBridge{lb: lb, temp: temp, strip: strip, name: name, mac: hueBridgeMAC(name)}
+}
+
+// hueBridgeMAC makes up a stable MAC address for the bridge from its name,
+// as clients use the bridge ID derived from it to recognize the bridge
+func hueBridgeMAC(name string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte("hue:" + name))
+	mac := net.HardwareAddr(sum[:6])
+	// locally administered, unicast
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac
+}
+
+// bridgeID is the bridge's ID, in the form Hue bridges derive from their MAC
+func (b *hueBridge) bridgeID() string {
+	h := strings.ToUpper(hex.EncodeToString(b.mac))
+	return h[:6] + "FFFE" + h[6:]
+}
+
+// uuid is the bridge's UPnP UUID, in the form Hue bridges use
+func (b *hueBridge) uuid() string {
+	return "2f402f80-da50-11e1-9b23-" + hex.EncodeToString(b.mac)
+}
+
+// hueError is an error in a Hue API response
+type hueError struct {
+	Address     string `json:"address"`
+	Description string `json:"description"`
+	Type        int    `json:"type"`
+}
+
+type hueResult struct {
+	Success map[string]interface{} `json:"success,omitempty"`
+	Error   *hueError              `json:"error,omitempty"`
+}
+
+// hueLightState is a light's state in the Hue API
+type hueLightState struct {
+	XY        []float64 `json:"xy"`
+	Effect    string    `json:"effect"`
+	Alert     string    `json:"alert"`
+	ColorMode string    `json:"colormode"`
+	Mode      string    `json:"mode"`
+	Bri       int       `json:"bri"`
+	Hue       int       `json:"hue"`
+	Sat       int       `json:"sat"`
+	CT        int       `json:"ct"`
+	On        bool      `json:"on"`
+	Reachable bool      `json:"reachable"`
+}
+
+// hueLight is a light in the Hue API
+type hueLight struct {
+	Type             string        `json:"type"`
+	Name             string        `json:"name"`
+	ModelID          string        `json:"modelid"`
+	ManufacturerName string        `json:"manufacturername"`
+	ProductName      string        `json:"productname"`
+	UniqueID         string        `json:"uniqueid"`
+	SWVersion        string        `json:"swversion"`
+	State            hueLightState `json:"state"`
+}
+
+// hueStateRequest is a change to a light's state - fields that aren't set
+// are left alone
+type hueStateRequest struct {
+	On  *bool     `json:"on"`
+	Bri *int      `json:"bri"`
+	Hue *int      `json:"hue"`
+	Sat *int      `json:"sat"`
+	CT  *int      `json:"ct"`
+	XY  []float64 `json:"xy"`
+}
+
+func (b *hueBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := otel.Tracer("").Start(r.Context(), "hue."+r.Method)
+	defer span.End()
+	span.SetAttributes(attribute.String("path", r.URL.Path))
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(path) == 1 && path[0] == "description.xml" && r.Method == http.MethodGet:
+		b.description(w, r)
+	case len(path) == 1 && path[0] == "api" && r.Method == http.MethodPost:
+		b.createUser(w)
+	case len(path) < 2 || path[0] != "api":
+		hueRespond(w, hueFailure(hueErrNotAvailable, r.URL.Path, "resource, %s, not available", r.URL.Path))
+	default:
+		b.serveAPI(ctx, w, r, path[2:])
+	}
+}
+
+// serveAPI serves a user's requests. Any username is accepted, as though the
+// bridge's link button had been pressed.
+func (b *hueBridge) serveAPI(ctx context.Context, w http.ResponseWriter, r *http.Request, path []string) {
+	resource := "/" + strings.Join(path, "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		if v := b.get(r, resource); v != nil {
+			hueRespond(w, v)
+			return
+		}
+	case http.MethodPut:
+		if resource == "/lights/"+hueLightID+"/state" {
+			b.putState(ctx, w, r)
+			return
+		}
+	}
+	hueRespond(w, hueFailure(hueErrNotAvailable, resource, "resource, %s, not available", resource))
+}
+
+// get returns the resource to respond to a GET with, or nil if it isn't
+// available
+func (b *hueBridge) get(r *http.Request, resource string) interface{} {
+	switch resource {
+	case "/":
+		return map[string]interface{}{
+			"lights":    map[string]hueLight{hueLightID: b.light()},
+			"groups":    map[string]interface{}{},
+			"config":    b.config(r),
+			"schedules": map[string]interface{}{},
+			"scenes":    map[string]interface{}{},
+			"rules":     map[string]interface{}{},
+			"sensors":   map[string]interface{}{},
+		}
+	case "/config":
+		return b.config(r)
+	case "/lights":
+		return map[string]hueLight{hueLightID: b.light()}
+	case "/lights/" + hueLightID:
+		return b.light()
+	case "/groups":
+		return map[string]interface{}{}
+	}
+	return nil
+}
+
+// putState changes the light's state
+func (b *hueBridge) putState(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	req := &hueStateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		hueRespond(w, hueFailure(hueErrInvalidJSON, "", "body contains invalid json"))
+		return
+	}
+	hueRespond(w, b.setState(ctx, req))
+}
+
+func hueRespond(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func hueFailure(typ int, address, format string, args ...interface{}) []hueResult {
+	return []hueResult{{Error: &hueError{Type: typ, Address: address, Description: fmt.Sprintf(format, args...)}}}
+}
+
+// createUser registers an app. Usernames aren't checked, so a random one is
+// returned without waiting for the link button.
+func (b *hueBridge) createUser(w http.ResponseWriter) {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	hueRespond(w, []hueResult{{Success: map[string]interface{}{"username": hex.EncodeToString(buf)}}})
+}
+
+func (b *hueBridge) config(r *http.Request) map[string]interface{} {
+	return map[string]interface{}{
+		"name":             b.name,
+		"bridgeid":         b.bridgeID(),
+		"mac":              b.mac.String(),
+		"ipaddress":        hostIP(r),
+		"modelid":          "BSB002",
+		"apiversion":       "1.41.0",
+		"swversion":        "1941132080",
+		"datastoreversion": "98",
+		"factorynew":       false,
+		"replacesbridgeid": nil,
+		"linkbutton":       true,
+		"whitelist":        map[string]interface{}{},
+	}
+}
+
+// hostIP returns the address the request was sent to, which apps use to
+// reach the bridge. The Host header has no port when the API's on port 80,
+// so the connection's local address is used then.
+func hostIP(r *http.Request) string {
+	if ip, _, err := net.SplitHostPort(r.Host); err == nil {
+		return ip
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if ip, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return ip
+		}
+	}
+	return r.Host
+}
+
+// light describes the strip, from the lightbulb's characteristics
+func (b *hueBridge) light() hueLight {
+	lb := b.lb
+	hue, sat := lb.Hue.Value(), lb.Saturation.Value()
+
+	st := hueLightState{
+		On:        lb.On.Value(),
+		Bri:       max(1, min(254, int(math.Round(float64(lb.Brightness.Value())*254/100)))),
+		Hue:       int(math.Round(hue * 65535 / 360)),
+		Sat:       int(math.Round(sat * 254 / 100)),
+		ColorMode: "hs",
+		CT:        366,
+		Effect:    "none",
+		Alert:     "none",
+		Mode:      "homeautomation",
+		Reachable: b.strip.available(),
+	}
+
+	x, y, _ := colorful.Hsv(hue, sat/100, 1).Xyy()
+	st.XY = []float64{roundXY(x), roundXY(y)}
+	if b.temp != nil {
+		st.CT = b.temp.Value()
+	}
+
+	// the color was last set with ct or xy, and hasn't been changed since
+	b.mu.Lock()
+	if m := b.mode; m != nil && m.hue == hue && m.sat == sat {
+		st.ColorMode = m.mode
+		if m.mode == "xy" {
+			st.XY = m.xy
+		} else {
+			st.CT = m.ct
+		}
+	}
+	b.mu.Unlock()
+
+	return hueLight{
+		Type:             "Extended color light",
+		Name:             b.name,
+		ModelID:          "LCT015",
+		ManufacturerName: "Signify Netherlands B.V.",
+		ProductName:      "Hue color lamp",
+		UniqueID:         b.mac.String() + ":00:01-0b",
+		SWVersion:        firmwareRevision(),
+		State:            st,
+	}
+}
+
+func roundXY(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
+
+// hueResults collects the results of a state change, one for each field
+type hueResults struct {
+	prefix  string
+	results []hueResult
+}
+
+func (r *hueResults) ok(field string, v interface{}) {
+	r.results = append(r.results, hueResult{Success: map[string]interface{}{r.prefix + field: v}})
+}
+
+// fail returns the results so far, followed by the field's error
+func (r *hueResults) fail(field string, err error) []hueResult {
+	return append(r.results, hueFailure(hueErrInternalError, r.prefix+field, "%v", err)...)
+}
+
+// hueStateStep changes part of the light's state, returning the field that
+// failed when there's an error
+type hueStateStep func(ctx context.Context, req *hueStateRequest, res *hueResults) (string, error)
+
+// setState changes the light's state, returning a result for each field.
+// As with the scheduler, a light being turned on is turned on before its
+// color changes, and one being turned off is turned off after.
+func (b *hueBridge) setState(ctx context.Context, req *hueStateRequest) []hueResult {
+	prefix := "/lights/" + hueLightID + "/state/"
+
+	if res := req.validate(prefix); res != nil {
+		return res
+	}
+
+	zerolog.Ctx(ctx).Debug().Interface("state", req).Msg("Hue state change")
+
+	res := &hueResults{prefix: prefix, results: []hueResult{}}
+	for _, step := range []hueStateStep{b.turnOn, b.setColor, b.setBri, b.turnOff} {
+		if field, err := step(ctx, req, res); err != nil {
+			return res.fail(field, err)
+		}
+	}
+
+	return res.results
+}
+
+// turnOn turns the light on, when that's requested
+func (b *hueBridge) turnOn(ctx context.Context, req *hueStateRequest, res *hueResults) (string, error) {
+	return b.setOn(ctx, req, res, true)
+}
+
+// turnOff turns the light off, when that's requested
+func (b *hueBridge) turnOff(ctx context.Context, req *hueStateRequest, res *hueResults) (string, error) {
+	return b.setOn(ctx, req, res, false)
+}
+
+func (b *hueBridge) setOn(ctx context.Context, req *hueStateRequest, res *hueResults, on bool) (string, error) {
+	if req.On == nil || *req.On != on {
+		return "", nil
+	}
+	if err := remoteWrite(ctx, b.lb.On.C, on); err != nil {
+		return "on", err
+	}
+	res.ok("on", on)
+	return "", nil
+}
+
+// setColor changes the light's color to the requested ct, xy, or hue and
+// sat, in that order of precedence
+func (b *hueBridge) setColor(ctx context.Context, req *hueStateRequest, res *hueResults) (string, error) {
+	lb := b.lb
+	mode, hue, sat := req.color(lb.Hue.Value(), lb.Saturation.Value())
+
+	// color temperature changes go through Adaptive Lighting's
+	// characteristic when there is one, so that it's turned off as it
+	// would be in the Home app
+	if req.CT != nil && b.temp != nil {
+		if err := remoteWrite(ctx, b.temp.C, *req.CT); err != nil {
+			return "ct", err
+		}
+		hue, sat = lb.Hue.Value(), lb.Saturation.Value()
+	} else if field, err := b.setHueSat(ctx, hue, sat); err != nil {
+		return field, err
+	}
+
+	if mode != nil {
+		mode.hue, mode.sat = hue, sat
+	}
+	b.mu.Lock()
+	if mode != nil || req.Hue != nil || req.Sat != nil {
+		b.mode = mode
+	}
+	b.mu.Unlock()
+
+	req.colorResults(res)
+	return "", nil
+}
+
+// setHueSat writes the hue and saturation, where they've changed
+func (b *hueBridge) setHueSat(ctx context.Context, hue, sat float64) (string, error) {
+	lb := b.lb
+	if hue != lb.Hue.Value() {
+		if err := remoteWrite(ctx, lb.Hue.C, hue); err != nil {
+			return "hue", err
+		}
+	}
+	if sat != lb.Saturation.Value() {
+		if err := remoteWrite(ctx, lb.Saturation.C, sat); err != nil {
+			return "sat", err
+		}
+	}
+	return "", nil
+}
+
+// setBri changes the light's brightness, when that's requested
+func (b *hueBridge) setBri(ctx context.Context, req *hueStateRequest, res *hueResults) (string, error) {
+	if req.Bri == nil {
+		return "", nil
+	}
+
+	bri := max(1, int(math.Round(float64(*req.Bri)*100/254)))
+	if bri != b.lb.Brightness.Value() {
+		if err := remoteWrite(ctx, b.lb.Brightness.C, bri); err != nil {
+			return "bri", err
+		}
+	}
+	res.ok("bri", *req.Bri)
+	return "", nil
+}
+
+// color returns the HomeKit hue (degrees) and saturation (percent) the
+// request sets, starting from the current hue and sat, and the color mode
+// to report when it's set with ct or xy
+func (req *hueStateRequest) color(hue, sat float64) (*hueColorMode, float64, float64) {
+	switch {
+	case req.CT != nil:
+		hue, sat = miredToHueSat(*req.CT)
+		return &hueColorMode{mode: "ct", ct: *req.CT}, hue, sat
+	case req.XY != nil:
+		hue, sat = xyToHueSat(req.XY[0], req.XY[1])
+		return &hueColorMode{mode: "xy", xy: req.XY}, hue, sat
+	}
+
+	if req.Hue != nil {
+		hue = float64(*req.Hue) * 360 / 65535
+	}
+	if req.Sat != nil {
+		sat = float64(*req.Sat) * 100 / 254
+	}
+	return nil, hue, sat
+}
+
+// colorResults records the results for the request's color fields - only
+// the one with precedence is reported
+func (req *hueStateRequest) colorResults(res *hueResults) {
+	switch {
+	case req.CT != nil:
+		res.ok("ct", *req.CT)
+	case req.XY != nil:
+		res.ok("xy", req.XY)
+	default:
+		if req.Hue != nil {
+			res.ok("hue", *req.Hue)
+		}
+		if req.Sat != nil {
+			res.ok("sat", *req.Sat)
+		}
+	}
+}
+
+// validate checks the request's values are in the ranges the Hue API allows
+func (req *hueStateRequest) validate(prefix string) []hueResult {
+	invalid := func(field string, v interface{}) []hueResult {
+		return hueFailure(hueErrInvalidValue, prefix+field, "invalid value, %v, for parameter, %s", v, field)
+	}
+
+	ranges := []struct {
+		v        *int
+		field    string
+		min, max int
+	}{
+		{req.Bri, "bri", 0, 254},
+		{req.Hue, "hue", 0, 65535},
+		{req.Sat, "sat", 0, 254},
+		{req.CT, "ct", 153, 500},
+	}
+	for _, r := range ranges {
+		if r.v != nil && (*r.v < r.min || *r.v > r.max) {
+			return invalid(r.field, *r.v)
+		}
+	}
+
+	if req.XY != nil && !validXY(req.XY) {
+		return invalid("xy", req.XY)
+	}
+	return nil
+}
+
+// validXY reports whether xy is a pair of CIE chromaticity coordinates
+func validXY(xy []float64) bool {
+	return len(xy) == 2 && xy[0] >= 0 && xy[0] <= 1 && xy[1] > 0 && xy[1] <= 1
+}
+
+// xyToHueSat converts CIE xy chromaticity coordinates to the HomeKit hue
+// (degrees) and saturation (percent) of the brightest color with that
+// chromaticity
+func xyToHueSat(x, y float64) (hue, sat float64) {
+	c := colorful.Xyy(x, y, 1)
+	c = colorful.Color{R: math.Max(c.R, 0), G: math.Max(c.G, 0), B: math.Max(c.B, 0)}
+	if m := math.Max(c.R, math.Max(c.G, c.B)); m > 0 {
+		c = colorful.Color{R: c.R / m, G: c.G / m, B: c.B / m}
+	}
+	h, s, _ := c.Hsv()
+	return h, s * 100
+}
+
+// hueDescription is the bridge's UPnP device description
+type hueDescription struct {
+	XMLName     xml.Name `xml:"urn:schemas-upnp-org:device-1-0 root"`
+	SpecVersion struct {
+		Major int `xml:"major"`
+		Minor int `xml:"minor"`
+	} `xml:"specVersion"`
+	URLBase string `xml:"URLBase"`
+	Device  struct {
+		DeviceType       string `xml:"deviceType"`
+		FriendlyName     string `xml:"friendlyName"`
+		Manufacturer     string `xml:"manufacturer"`
+		ManufacturerURL  string `xml:"manufacturerURL"`
+		ModelDescription string `xml:"modelDescription"`
+		ModelName        string `xml:"modelName"`
+		ModelNumber      string `xml:"modelNumber"`
+		ModelURL         string `xml:"modelURL"`
+		SerialNumber     string `xml:"serialNumber"`
+		UDN              string `xml:"UDN"`
+		PresentationURL  string `xml:"presentationURL"`
+	} `xml:"device"`
+}
+
+// description serves the UPnP device description that SSDP responses point
+// to. Apps check that it describes a Philips hue bridge.
+func (b *hueBridge) description(w http.ResponseWriter, r *http.Request) {
+	d := hueDescription{URLBase: "http://" + r.Host + "/"}
+	d.SpecVersion.Major = 1
+	d.Device.DeviceType = "urn:schemas-upnp-org:device:Basic:1"
+	d.Device.FriendlyName = fmt.Sprintf("%s (%s)", b.name, r.Host)
+	d.Device.Manufacturer = "Royal Philips Electronics"
+	d.Device.ManufacturerURL = "http://www.philips.com"
+	d.Device.ModelDescription = "Philips hue Personal Wireless Lighting"
+	d.Device.ModelName = "Philips hue bridge 2015"
+	d.Device.ModelNumber = "BSB002"
+	d.Device.ModelURL = "http://www.meethue.com"
+	d.Device.SerialNumber = hex.EncodeToString(b.mac)
+	d.Device.UDN = "uuid:" + b.uuid()
+	d.Device.PresentationURL = "index.html"
+
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	_ = enc.Encode(d)
+}
+
+// listen serves the Hue API on addr (e.g. ":80") until ctx is cancelled,
+// returning the port it's listening on
+func (b *hueBridge) listen(ctx context.Context, addr string) (int, error) {
+	log := zerolog.Ctx(ctx)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to listen for the Hue API: %w", err)
+	}
+
+	srv := &http.Server{Handler: b, ReadHeaderTimeout: 2 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	go func() {
+		if err := srv.Serve(l); err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("Hue API server failed")
+		}
+	}()
+
+	log.Info().Stringer("addr", l.Addr()).Str("bridgeid", b.bridgeID()).Msg("serving the Hue API")
+
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
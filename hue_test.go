@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/hairyhenderson/wnp-bridge/wnptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hueDo(t *testing.T, h http.Handler, method, target, body string) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+func hueGetLight(t *testing.T, h http.Handler) hueLight {
+	t.Helper()
+
+	l := hueLight{}
+	require.NoError(t, json.Unmarshal([]byte(hueDo(t, h, http.MethodGet, "/api/u/lights/1", "")), &l))
+	return l
+}
+
+func TestHueBridgeIdentity(t *testing.T) {
+	b := newHueBridge(nil, nil, nil, "test")
+	assert.Equal(t, hueBridgeMAC("test"), b.mac)
+	assert.Len(t, b.bridgeID(), 16)
+	assert.Equal(t, "FFFE", b.bridgeID()[6:10])
+	assert.Equal(t, "2f402f80-da50-11e1-9b23-"+strings.ReplaceAll(b.mac.String(), ":", ""), b.uuid())
+	assert.NotEqual(t, hueBridgeMAC("other"), b.mac)
+}
+
+func TestHueBridge(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+	h := newHueBridge(lb, nil, b.strip, "test")
+
+	out := hueDo(t, h, http.MethodPost, "/api", `{"devicetype": "app#test"}`)
+	res := []hueResult{}
+	require.NoError(t, json.Unmarshal([]byte(out), &res))
+	require.Len(t, res, 1)
+	assert.Len(t, res[0].Success["username"], 32)
+
+	l := hueGetLight(t, h)
+	assert.Equal(t, "Extended color light", l.Type)
+	assert.Equal(t, hueLightState{
+		On: true, Bri: 254, Hue: 0, Sat: 254, CT: 366, XY: []float64{0.64, 0.33},
+		ColorMode: "hs", Effect: "none", Alert: "none", Mode: "homeautomation", Reachable: true,
+	}, l.State)
+
+	out = hueDo(t, h, http.MethodPut, "/api/u/lights/1/state", `{"hue": 43690, "sat": 254, "bri": 127}`)
+	assert.JSONEq(t, `[
+		{"success": {"/lights/1/state/hue": 43690}},
+		{"success": {"/lights/1/state/sat": 254}},
+		{"success": {"/lights/1/state/bri": 127}}
+	]`, out)
+	assert.Equal(t, opaque(solid(0x000080, 4)), b.dev.States())
+	assert.Equal(t, 240.0, lb.Hue.Value())
+	assert.Equal(t, 50, lb.Brightness.Value())
+	assert.Contains(t, b.spanNames(), "hue.PUT")
+	assert.Contains(t, b.spanNames(), "lb.Hue.OnSetRemoteValue")
+
+	// the light is turned off last, and on first
+	b.dev.ResetRequests()
+	out = hueDo(t, h, http.MethodPut, "/api/u/lights/1/state", `{"on": false, "hue": 0}`)
+	assert.JSONEq(t, `[{"success": {"/lights/1/state/hue": 0}}, {"success": {"/lights/1/state/on": false}}]`, out)
+	assert.False(t, lb.On.Value())
+	assert.Equal(t, [][]uint32{opaque(solid(0x800000, 4))}, b.rawPayloads(t))
+	assert.Equal(t, solid(0, 4), b.dev.States())
+
+	hueDo(t, h, http.MethodPut, "/api/u/lights/1/state", `{"on": true, "hue": 21845}`)
+	assert.True(t, lb.On.Value())
+	assert.Equal(t, opaque(solid(0x008000, 4)), b.dev.States())
+
+	// xy and ct are shown as the nearest hue and saturation, but reported
+	// as they were set
+	hueDo(t, h, http.MethodPut, "/api/u/lights/1/state", `{"xy": [0.64, 0.33], "bri": 254}`)
+	assert.InDelta(t, 0, lb.Hue.Value(), 1)
+	assert.InDelta(t, 100, lb.Saturation.Value(), 1)
+	l = hueGetLight(t, h)
+	assert.Equal(t, "xy", l.State.ColorMode)
+	assert.Equal(t, []float64{0.64, 0.33}, l.State.XY)
+
+	hueDo(t, h, http.MethodPut, "/api/u/lights/1/state", `{"ct": 366}`)
+	hue, sat := miredToHueSat(366)
+	assert.Equal(t, hue, lb.Hue.Value())
+	assert.Equal(t, sat, lb.Saturation.Value())
+	l = hueGetLight(t, h)
+	assert.Equal(t, "ct", l.State.ColorMode)
+	assert.Equal(t, 366, l.State.CT)
+
+	// until the color is changed in HomeKit
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	assert.Equal(t, "hs", hueGetLight(t, h).State.ColorMode)
+
+	invalid := func(field, value string) string {
+		return `[{"error": {"type": 7, "address": "/lights/1/state/` + field + `", ` +
+			`"description": "invalid value, ` + value + `, for parameter, ` + field + `"}}]`
+	}
+	testdata := []struct {
+		target, body, expected string
+	}{
+		{"/api/u/lights/1/state", `{"bri": 255}`, invalid("bri", "255")},
+		{"/api/u/lights/1/state", `{"hue": 65536}`, invalid("hue", "65536")},
+		{"/api/u/lights/1/state", `{"ct": 100}`, invalid("ct", "100")},
+		{"/api/u/lights/1/state", `{"xy": [0.5]}`, invalid("xy", "[0.5]")},
+		{"/api/u/lights/1/state", `nope`, `[{"error": {"type": 2, "address": "", "description": "body contains invalid json"}}]`},
+		{
+			"/api/u/lights/2/state", `{"on": true}`,
+			`[{"error": {"type": 3, "address": "/lights/2/state", "description": "resource, /lights/2/state, not available"}}]`,
+		},
+	}
+	for _, d := range testdata {
+		assert.JSONEq(t, d.expected, hueDo(t, h, http.MethodPut, d.target, d.body), d.body)
+	}
+
+	out = hueDo(t, h, http.MethodGet, "/api/u", "")
+	state := map[string]json.RawMessage{}
+	require.NoError(t, json.Unmarshal([]byte(out), &state))
+	assert.Contains(t, string(state["lights"]), `"1":`)
+	assert.Contains(t, string(state["config"]), h.bridgeID())
+	assert.JSONEq(t, `{}`, hueDo(t, h, http.MethodGet, "/api/u/groups", ""))
+
+	// the device being unreachable is reported
+	b.dev.SetFaults(wnptest.Faults{ErrorRate: 1})
+	out = hueDo(t, h, http.MethodPut, "/api/u/lights/1/state", `{"hue": 0}`)
+	assert.Contains(t, out, `"type":901`)
+}
+
+func TestHueBridgeAdaptiveLighting(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+	a := setupAdaptiveLighting(t, b, hap.NewMemStore(), time.Now())
+	h := newHueBridge(lb, a.temp, b.strip, "test")
+
+	// color temperature changes go through Adaptive Lighting's
+	// characteristic
+	out := hueDo(t, h, http.MethodPut, "/api/u/lights/1/state", `{"ct": 250}`)
+	assert.JSONEq(t, `[{"success": {"/lights/1/state/ct": 250}}]`, out)
+	assert.Equal(t, 250, a.temp.Value())
+	assert.Contains(t, b.spanNames(), "lb.ColorTemperature.OnSetRemoteValue")
+
+	hue, sat := miredToHueSat(250)
+	assert.Equal(t, hue, lb.Hue.Value())
+	assert.Equal(t, sat, lb.Saturation.Value())
+
+	l := hueGetLight(t, h)
+	assert.Equal(t, "ct", l.State.ColorMode)
+	assert.Equal(t, 250, l.State.CT)
+}
+
+func TestHueDescription(t *testing.T) {
+	h := newHueBridge(nil, nil, nil, "test")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://192.0.2.1:80/description.xml", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/xml", w.Header().Get("Content-Type"))
+
+	body := w.Body.String()
+	assert.Contains(t, body, "<URLBase>http://192.0.2.1:80/</URLBase>")
+	assert.Contains(t, body, "<modelName>Philips hue bridge 2015</modelName>")
+	assert.Contains(t, body, "<modelNumber>BSB002</modelNumber>")
+	assert.Contains(t, body, "<UDN>uuid:"+h.uuid()+"</UDN>")
+}
+
+func TestHostIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/u/config", nil)
+	r.Host = "192.168.1.5:8080"
+	assert.Equal(t, "192.168.1.5", hostIP(r))
+
+	// on port 80 the Host header has no port, so the connection's address
+	// is used
+	r.Host = "hue.local"
+	assert.Equal(t, "hue.local", hostIP(r))
+
+	ctx := context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 80})
+	assert.Equal(t, "192.168.1.5", hostIP(r.WithContext(ctx)))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// identifyMode is the animation shown when the accessory is identified
+type identifyMode string
+
+const (
+	// identifyBlink alternates the strip between lit and off
+	identifyBlink identifyMode = "blink"
+	// identifyPulse fades the strip out and back in
+	identifyPulse identifyMode = "pulse"
+	// identifyChase moves a lit segment along the strip
+	identifyChase identifyMode = "chase"
+)
+
+func parseIdentifyMode(s string) (identifyMode, error) {
+	switch m := identifyMode(s); m {
+	case identifyBlink, identifyPulse, identifyChase:
+		return m, nil
+	default:
+		return "", fmt.Errorf("identify mode must be blink, pulse or chase, not %q", s)
+	}
+}
+
+// identifyConfig returns the identify routine's configuration from the flags
+func (o opts) identifyConfig() (identifyConfig, error) {
+	mode, err := parseIdentifyMode(o.identifyMode)
+	if err != nil {
+		return identifyConfig{}, err
+	}
+
+	cfg := identifyConfig{mode: mode, cycles: o.identifyCycles, period: o.identifyPeriod}
+	if o.identifyColor != "" {
+		c, err := colorful.Hex(o.identifyColor)
+		if err != nil {
+			return identifyConfig{}, fmt.Errorf("invalid identify color: %w", err)
+		}
+		cfg.color = &c
+	}
+	return cfg, nil
+}
+
+// identifyFrameInterval is how often identify animations are updated
+var identifyFrameInterval = 40 * time.Millisecond
+
+// identifyConfig configures the identify routine. The zero value blinks the
+// strip's own colors twice.
+type identifyConfig struct {
+	// color is shown instead of the strip's own colors, when set
+	color  *colorful.Color
+	mode   identifyMode
+	cycles int
+	period time.Duration
+}
+
+func (c identifyConfig) withDefaults() identifyConfig {
+	if c.mode == "" {
+		c.mode = identifyBlink
+	}
+	if c.cycles <= 0 {
+		c.cycles = 2
+	}
+	if c.period <= 0 {
+		c.period = time.Second
+	}
+	return c
+}
+
+// frame renders the animation at the given phase (cycles since it started,
+// e.g. 1.5 is half way through the second cycle), from the lit frame base
+func (c identifyConfig) frame(base []colorful.Color, phase float64) []colorful.Color {
+	_, frac := math.Modf(phase)
+
+	out := make([]colorful.Color, len(base))
+	switch c.mode {
+	case identifyPulse:
+		// off at the start of each cycle, full brightness half way through
+		scale := (1 - math.Cos(2*math.Pi*frac)) / 2
+		for i, p := range base {
+			out[i] = colorful.Color{R: p.R * scale, G: p.G * scale, B: p.B * scale}
+		}
+	case identifyChase:
+		// a segment a sixth of the strip long makes one lap per cycle
+		n := len(base)
+		length := max(1, n/6)
+		head := int(frac * float64(n))
+		for i := 0; i < length; i++ {
+			j := (head + i) % n
+			out[j] = base[j]
+		}
+	default:
+		if frac < 0.5 {
+			copy(out, base)
+		}
+	}
+	return out
+}
+
+// identify runs the identify animation in the background, restoring the
+// frame the strip was showing once it's done. Nothing is done if it's
+// already running.
+func (w *wifineopixel) identify(ctx context.Context) {
+	if !w.identifying.CompareAndSwap(false, true) {
+		zerolog.Ctx(ctx).Debug().Msg("already identifying")
+		return
+	}
+
+	go func() {
+		defer w.identifying.Store(false)
+
+		start := time.Now()
+		if err := w.runIdentify(ctx); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("error during identify")
+			return
+		}
+		observeUpdateDuration("acc", "identify", start)
+	}()
+}
+
+// runIdentify shows the identify animation, then restores the exact frame the
+// strip showed before. If the strip is changed by anything else while the
+// animation runs, it stops there and the change is left alone.
+func (w *wifineopixel) runIdentify(ctx context.Context) error {
+	ctx, span := otel.Tracer("").Start(ctx, "identify")
+	defer span.End()
+
+	cfg := w.identifyCfg.withDefaults()
+	span.SetAttributes(attribute.String("mode", string(cfg.mode)))
+
+	snapshot, base, changes, err := w.identifySnapshot(ctx, cfg)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	interrupted := func() {
+		zerolog.Ctx(ctx).Debug().Msg("strip changed during identify, not restoring")
+		span.SetAttributes(attribute.Bool("interrupted", true))
+	}
+
+	tick := time.NewTicker(identifyFrameInterval)
+	defer tick.Stop()
+
+	begin := time.Now()
+	total := time.Duration(cfg.cycles) * cfg.period
+	var last []colorful.Color
+	for elapsed := time.Duration(0); elapsed < total; elapsed = time.Since(begin) {
+		frame := w.limitFrame(ctx, cfg.frame(base, float64(elapsed)/float64(cfg.period)))
+		if !equalFrames(frame, last) {
+			ok, err := w.showUnchanged(ctx, frame, changes)
+			if err != nil {
+				span.RecordError(err)
+				return err
+			}
+			if !ok {
+				interrupted()
+				return nil
+			}
+			last = frame
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+
+	ok, err := w.showUnchanged(ctx, snapshot, changes)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	if !ok {
+		interrupted()
+	}
+	return nil
+}
+
+// identifySnapshot returns the frame the device is showing, the lit frame the
+// animation is rendered from, and the strip's change count
+func (w *wifineopixel) identifySnapshot(ctx context.Context, cfg identifyConfig) (
+	snapshot, base []colorful.Color, changes uint64, err error,
+) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if !w.isConnected() {
+		return nil, nil, 0, errNotConnected
+	}
+
+	// the device is asked what it's showing, as power limiting means that
+	// may not be the cached state - the DDP controller can't be asked, so
+	// the state is limited the same way again
+	if w.ddp != nil {
+		snapshot = w.limitFrame(ctx, w.currentState())
+	} else {
+		snapshot, err = w.getStates(ctx)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	base = make([]colorful.Color, len(snapshot))
+	switch {
+	case cfg.color != nil:
+		for i := range base {
+			base[i] = *cfg.color
+		}
+	case w.isOn():
+		copy(base, w.currentState())
+	default:
+		// the strip's off, so it's shown as it would be when turned on,
+		// or white if it's never been lit
+		copy(base, w.snapshotOnState())
+		if !lit(base) {
+			for i := range base {
+				base[i] = colorful.Color{R: 1, G: 1, B: 1}
+			}
+		}
+	}
+
+	return snapshot, base, w.changes.Load(), nil
+}
+
+// showUnchanged writes a frame to the device without changing the strip's
+// cached state, as long as nothing else has changed the strip since the
+// given change count. It reports whether the frame was written.
+func (w *wifineopixel) showUnchanged(ctx context.Context, frame []colorful.Color, changes uint64) (bool, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if w.changes.Load() != changes {
+		return false, nil
+	}
+
+	if w.ddp != nil {
+		return true, w.writeDDP(ctx, frame)
+	}
+
+	b := &bytes.Buffer{}
+	if err := json.NewEncoder(b).Encode(colorsToUint32(frame)); err != nil {
+		return false, err
+	}
+
+	resp, err := w.post(ctx, "/raw", "application/json", b)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return true, err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentifyConfig(t *testing.T) {
+	cfg, err := opts{identifyMode: "chase", identifyColor: "#ff0000", identifyCycles: 3, identifyPeriod: time.Second}.identifyConfig()
+	require.NoError(t, err)
+	red := uint32ToColor(red)
+	assert.Equal(t, identifyConfig{mode: identifyChase, color: &red, cycles: 3, period: time.Second}, cfg)
+
+	_, err = opts{identifyMode: "strobe"}.identifyConfig()
+	assert.Error(t, err)
+	_, err = opts{identifyMode: "blink", identifyColor: "red"}.identifyConfig()
+	assert.Error(t, err)
+
+	assert.Equal(t, identifyConfig{mode: identifyBlink, cycles: 2, period: time.Second}, identifyConfig{}.withDefaults())
+}
+
+func TestIdentifyFrame(t *testing.T) {
+	base := frameOf(red, green, 0x0000ff, red, green, 0x0000ff, red, green, 0x0000ff, red, green, 0x0000ff)
+	off := frameOf(make([]uint32, len(base))...)
+
+	blink := identifyConfig{mode: identifyBlink}
+	assert.Equal(t, base, blink.frame(base, 0))
+	assert.Equal(t, off, blink.frame(base, 0.5))
+	assert.Equal(t, base, blink.frame(base, 1.25))
+
+	pulse := identifyConfig{mode: identifyPulse}
+	assert.Equal(t, off, pulse.frame(base, 0))
+	assert.Equal(t, colorsToUint32(base), colorsToUint32(pulse.frame(base, 0.5)))
+	assert.Equal(t, colorsToUint32(frameOf(0x7f0000)), colorsToUint32(pulse.frame(base, 0.25)[:1]))
+
+	// a sixth of the strip, wrapping around the end
+	chase := identifyConfig{mode: identifyChase}
+	assert.Equal(t, colorsToUint32(frameOf(red, green, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)), colorsToUint32(chase.frame(base, 0)))
+	assert.Equal(t, colorsToUint32(frameOf(0, 0, 0, 0, 0, 0, red, green, 0, 0, 0, 0)), colorsToUint32(chase.frame(base, 1.5)))
+	assert.Equal(t, colorsToUint32(frameOf(red, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x0000ff)), colorsToUint32(chase.frame(base, 0.95)))
+}
+
+// identifyDone waits for the identify routine to finish
+func identifyDone(t *testing.T, b *testBridge) {
+	t.Helper()
+	require.Eventually(t, func() bool { return !b.strip.identifying.Load() }, 5*time.Second, time.Millisecond)
+}
+
+func TestIdentify(t *testing.T) {
+	defer func(d time.Duration) { identifyFrameInterval = d }(identifyFrameInterval)
+	identifyFrameInterval = time.Millisecond
+
+	initial := []uint32{red, green, 0, 0x0000ff}
+	b := setupBridge(t, initial)
+	b.strip.identifyCfg = identifyConfig{mode: identifyBlink, cycles: 2, period: 100 * time.Millisecond}
+
+	count := updateCount(t, "acc", "identify")
+
+	// the HAP request isn't held up by the animation
+	b.acc.IdentifyFunc(httptest.NewRequest(http.MethodPost, "/identify", nil))
+	assert.True(t, b.strip.identifying.Load())
+	identifyDone(t, b)
+
+	payloads := b.rawPayloads(t)
+	assert.Equal(t, [][]uint32{
+		opaque(initial), opaque(solid(0, 4)),
+		opaque(initial), opaque(solid(0, 4)),
+		opaque(initial),
+	}, payloads)
+
+	// the exact frame is restored, without changing the cached state
+	assert.Equal(t, opaque(initial), b.dev.States())
+	assert.Equal(t, opaque(initial), colorsToUint32(b.strip.state))
+	assert.Equal(t, count+1, updateCount(t, "acc", "identify"))
+	assert.Contains(t, b.spanNames(), "acc.OnIdentify")
+	assert.Contains(t, b.spanNames(), "identify")
+}
+
+func TestIdentifyOff(t *testing.T) {
+	defer func(d time.Duration) { identifyFrameInterval = d }(identifyFrameInterval)
+	identifyFrameInterval = time.Millisecond
+
+	b := setupBridge(t, solid(red, 4))
+	require.Equal(t, 0, remoteSet(b.acc.Lightbulb.On, false))
+	b.dev.ResetRequests()
+
+	// an off strip is lit to identify it, and turned off again
+	blue := colorful.Color{B: 1}
+	b.strip.identifyCfg = identifyConfig{mode: identifyBlink, color: &blue, cycles: 1, period: 20 * time.Millisecond}
+	b.strip.identify(context.Background())
+	identifyDone(t, b)
+
+	assert.Equal(t, [][]uint32{opaque(solid(0x0000ff, 4)), opaque(solid(0, 4)), opaque(solid(0, 4))}, b.rawPayloads(t))
+	assert.Equal(t, opaque(solid(0, 4)), b.dev.States())
+	assert.False(t, b.strip.isOn())
+}
+
+func TestIdentifyInterrupted(t *testing.T) {
+	defer func(d time.Duration) { identifyFrameInterval = d }(identifyFrameInterval)
+	identifyFrameInterval = time.Millisecond
+
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+	b.strip.identifyCfg = identifyConfig{mode: identifyPulse, cycles: 100, period: time.Second}
+
+	b.strip.identify(context.Background())
+	require.Eventually(t, func() bool { return len(b.dev.Requests()) > 2 }, 5*time.Second, time.Millisecond)
+
+	// identifying again while it's running does nothing
+	b.strip.identify(context.Background())
+
+	// a change made during the animation stops it, and isn't overwritten
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	identifyDone(t, b)
+
+	assert.Equal(t, opaque(solid(green, 4)), b.dev.States())
+	assert.Contains(t, b.spanNames(), "identify")
+}
+
+func TestIdentifyRefresh(t *testing.T) {
+	defer func(d time.Duration) { identifyFrameInterval = d }(identifyFrameInterval)
+	identifyFrameInterval = time.Millisecond
+
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	// a black animation, so the strip reads back as off while it runs
+	b.strip.identifyCfg = identifyConfig{mode: identifyBlink, color: &colorful.Color{}, cycles: 1, period: 500 * time.Millisecond}
+	b.strip.identify(context.Background())
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(opaque(solid(0, 4)), b.dev.States())
+	}, 5*time.Second, time.Millisecond)
+
+	// reading the light's state during the animation doesn't cache it
+	v, status := lb.On.ValueRequest(httptest.NewRequest(http.MethodGet, "/characteristics", nil))
+	assert.Equal(t, 0, status)
+	assert.Equal(t, true, v)
+	_, _, val, err := b.strip.hsv(context.Background())
+	require.NoError(t, err)
+	assert.InDelta(t, 1.0, val, 0.001)
+	require.True(t, b.strip.identifying.Load())
+	identifyDone(t, b)
+
+	assert.Equal(t, opaque(solid(red, 4)), b.dev.States())
+	assert.Equal(t, opaque(solid(red, 4)), colorsToUint32(b.strip.currentState()))
+	assert.True(t, b.strip.isOn())
+
+	// once it's done, the light's read as it was before
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	require.Equal(t, 0, remoteSet(lb.On, true))
+	assert.Equal(t, opaque(solid(red, 4)), b.dev.States())
+}
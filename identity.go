@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/hap"
+)
+
+// deviceSerial returns a serial number for the device, so that bridged strips
+// can be told apart in the Home app. The device's MAC address is used when
+// it's advertised in its mDNS TXT records. Otherwise the serial is a hash of
+// id, which should be something stable - the mDNS instance name for
+// discovered devices (their addresses may change), or the URL otherwise.
+func deviceSerial(txt []string, id string) string {
+	if mac := macFromTXT(txt); mac != "" {
+		return mac
+	}
+
+	sum := sha256.Sum256([]byte(id))
+	return strings.ToUpper(hex.EncodeToString(sum[:6]))
+}
+
+// provisionalSerial returns the serial number the accessory is published
+// with before the device has been found, as some controllers remember the
+// serial number from pairing. It's derived from the -device selector (which
+// may be the device's MAC address), or the accessory's name when any device
+// will do. Devices at a fixed URL get their final serial straight away.
+func provisionalSerial(hostURL, selector, name string) string {
+	switch {
+	case hostURL != "":
+		return deviceSerial(nil, hostURL)
+	case selector != "":
+		return deviceSerial([]string{"mac=" + selector}, selector)
+	default:
+		return deviceSerial(nil, name)
+	}
+}
+
+// serialStoreKey is where the serial number the device was first found with
+// is saved
+const serialStoreKey = "serial"
+
+// savedSerial returns the serial number the accessory is published with: the
+// one saved when the device was first found, or the provisional serial until
+// then
+func savedSerial(store hap.Store, hostURL, selector, name string) string {
+	if b, err := store.Get(serialStoreKey); err == nil && len(b) > 0 {
+		return string(b)
+	}
+	return provisionalSerial(hostURL, selector, name)
+}
+
+// resolveSerial returns the serial number for the device that's been found.
+// The first one resolved is saved and used from then on, even if the
+// device's identity changes (e.g. it starts advertising its MAC address), as
+// controllers see an accessory with a new serial number as a new accessory.
+// The serial's still returned when it can't be saved.
+func resolveSerial(store hap.Store, txt []string, id string) (string, error) {
+	if b, err := store.Get(serialStoreKey); err == nil && len(b) > 0 {
+		return string(b), nil
+	}
+
+	serial := deviceSerial(txt, id)
+	if err := store.Set(serialStoreKey, []byte(serial)); err != nil {
+		return serial, fmt.Errorf("failed to save serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// macFromTXT finds a "mac=..." record, returning the normalized MAC address
+// or "" when there isn't a valid one
+func macFromTXT(txt []string) string {
+	for _, f := range txt {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || !strings.EqualFold(k, "mac") {
+			continue
+		}
+		hw, err := net.ParseMAC(v)
+		if err != nil {
+			continue
+		}
+		return strings.ToUpper(hw.String())
+	}
+	return ""
+}
+
+// firmwareRevision returns the bridge's version from its build info, in the
+// x.y.z form HomeKit requires. Development builds report 0.0.0.
+func firmwareRevision() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "0.0.0"
+	}
+	return parseFirmwareRevision(bi.Main.Version)
+}
+
+// parseFirmwareRevision converts a module version (e.g. "v1.2.3",
+// "v1.2.4-0.20240101120000-abcdef123456+dirty", or "(devel)") to a HomeKit
+// firmware revision, dropping any pre-release or build suffix
+func parseFirmwareRevision(version string) string {
+	v := strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return "0.0.0"
+	}
+	for _, p := range parts {
+		if n, err := strconv.Atoi(p); err != nil || n < 0 {
+			return "0.0.0"
+		}
+	}
+
+	return v
+}
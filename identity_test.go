@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/brutella/hap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceSerial(t *testing.T) {
+	testdata := []struct {
+		id       string
+		expected string
+		txt      []string
+	}{
+		{txt: []string{"mac=5c:cf:7f:00:00:01"}, id: "kitchen", expected: "5C:CF:7F:00:00:01"},
+		{txt: []string{"id=abc", "MAC=5C-CF-7F-00-00-02"}, id: "kitchen", expected: "5C:CF:7F:00:00:02"},
+		{txt: []string{"mac=bogus", "mac=5ccf.7f00.0003"}, id: "kitchen", expected: "5C:CF:7F:00:00:03"},
+	}
+
+	for _, d := range testdata {
+		assert.Equal(t, d.expected, deviceSerial(d.txt, d.id), d.txt)
+	}
+
+	// without a MAC, the serial is derived from the id
+	a := deviceSerial(nil, "http://10.0.0.5:80")
+	assert.Len(t, a, 12)
+	assert.Equal(t, a, deviceSerial([]string{"mac=bogus"}, "http://10.0.0.5:80"))
+	assert.NotEqual(t, a, deviceSerial(nil, "http://10.0.0.6:80"))
+}
+
+func TestProvisionalSerial(t *testing.T) {
+	// the final serial is known up front for devices at a fixed URL
+	assert.Equal(t, deviceSerial(nil, "http://10.0.0.5:80"), provisionalSerial("http://10.0.0.5:80", "kitchen", "Lights"))
+
+	// a MAC address selector is the device's serial once it's found
+	assert.Equal(t, "5C:CF:7F:00:00:01", provisionalSerial("", "5c:cf:7f:00:00:01", "Lights"))
+
+	kitchen := provisionalSerial("", "kitchen", "Lights")
+	assert.Len(t, kitchen, 12)
+	assert.Equal(t, kitchen, provisionalSerial("", "kitchen", "Other"))
+	assert.NotEqual(t, kitchen, provisionalSerial("", "porch", "Lights"))
+
+	lights := provisionalSerial("", "", "Lights")
+	assert.Len(t, lights, 12)
+	assert.NotEqual(t, lights, provisionalSerial("", "", "Other"))
+}
+
+func TestResolveSerial(t *testing.T) {
+	store := hap.NewMemStore()
+
+	// the provisional serial is published until the device is first found
+	assert.Equal(t, provisionalSerial("", "kitchen", "Lights"), savedSerial(store, "", "kitchen", "Lights"))
+
+	serial, err := resolveSerial(store, []string{"mac=5c:cf:7f:00:00:01"}, "kitchen")
+	require.NoError(t, err)
+	assert.Equal(t, "5C:CF:7F:00:00:01", serial)
+
+	// from then on the same serial's published from the start, and kept
+	// when the device is found again
+	assert.Equal(t, "5C:CF:7F:00:00:01", savedSerial(store, "", "kitchen", "Lights"))
+	serial, err = resolveSerial(store, nil, "kitchen")
+	require.NoError(t, err)
+	assert.Equal(t, "5C:CF:7F:00:00:01", serial)
+}
+
+func TestParseFirmwareRevision(t *testing.T) {
+	testdata := []struct {
+		version  string
+		expected string
+	}{
+		{"v1.2.3", "1.2.3"},
+		{"v1.2", "1.2"},
+		{"v0.3.1-rc.1", "0.3.1"},
+		{"v1.2.4-0.20240101120000-abcdef123456+dirty", "1.2.4"},
+		{"v0.0.0-20240101120000-abcdef123456", "0.0.0"},
+		{"(devel)", "0.0.0"},
+		{"", "0.0.0"},
+		{"v1.2.3.4", "0.0.0"},
+	}
+
+	for _, d := range testdata {
+		assert.Equal(t, d.expected, parseFirmwareRevision(d.version), d.version)
+	}
+}
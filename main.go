@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
@@ -20,8 +19,8 @@ import (
 
 	"github.com/brutella/hap"
 	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
 	"github.com/brutella/hap/service"
-	"github.com/hashicorp/mdns"
 	"github.com/lucasb-eyer/go-colorful"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
@@ -47,15 +46,50 @@ func initTraceExporter(ctx context.Context, otlpEndpoint string) (closer func(co
 }
 
 type opts struct {
-	hostURL      string
-	accName      string
-	otlpEndpoint string
-	storagePath  string
-	pin          string
-	addr         string
-	metricsAddr  string
-	enableIPv6   bool
-	debug        bool
+	hostURL           string
+	device            string
+	accName           string
+	model             string
+	manufacturer      string
+	otlpEndpoint      string
+	storagePath       string
+	pin               string
+	addr              string
+	metricsAddr       string
+	schedulePath      string
+	circadianPath     string
+	fillsPath         string
+	led               ledCurrent
+	maxCurrent        float64
+	ledVoltage        float64
+	e131Addr          string
+	e131FPS           float64
+	e131Timeout       time.Duration
+	e131StartChannel  int
+	e131Universe      uint
+	e131Multicast     bool
+	opcAddr           string
+	opcFPS            float64
+	opcTimeout        time.Duration
+	opcChannel        int
+	output            string
+	ddpAddr           string
+	ddpOffset         int
+	ddpChunk          int
+	paletteMode       bool
+	preservePatterns  bool
+	colorSummary      string
+	hueAddr           string
+	identifyMode      string
+	identifyColor     string
+	discoveryInterval time.Duration
+	identifyPeriod    time.Duration
+	identifyCycles    int
+	enableIPv6        bool
+	preferIPv6        bool
+	hueSSDP           bool
+	debug             bool
+	discover          bool
 }
 
 func parseFlags() opts {
@@ -69,16 +103,79 @@ func parseFlags() opts {
 	flag.StringVar(&o.storagePath, "path", defaultPath, usage)
 	flag.StringVar(&o.storagePath, "p", defaultPath, usage+" (shorthand)")
 	flag.StringVar(&o.addr, "addr", "", "address to listen to")
-	flag.StringVar(&o.metricsAddr, "metrics-addr", ":8080", "address to listen to for metrics")
+	flag.StringVar(&o.metricsAddr, "metrics-addr", ":8080", "address to listen to for metrics (and the schedule and fill APIs)")
+	flag.StringVar(&o.schedulePath, "schedule", "", "path to a YAML file of scheduled power and color changes")
+	flag.StringVar(&o.circadianPath, "circadian", "",
+		"path to a YAML file of color temperature and brightness anchor points for the auto-white mode (a default curve is used otherwise)")
+	flag.StringVar(&o.fillsPath, "fills", "", "path to a YAML file of named gradient and palette fills, for the fill API")
+	flag.BoolVar(&o.paletteMode, "palette-mode", false,
+		"keep fills when the color is changed in HomeKit - the hue rotates the fill, and the brightness dims it")
+	flag.StringVar(&o.colorSummary, "color-summary", string(summaryAverage),
+		"how the strip's pixels are summarized as a single color for HomeKit: average (of the lit pixels), dominant, or first (pixel)")
+	flag.BoolVar(&o.preservePatterns, "preserve-patterns", false,
+		"keep any multi-color pattern (e.g. from E1.31 or OPC) when the color is changed in HomeKit, as -palette-mode does for fills")
+	flag.StringVar(&o.identifyMode, "identify", string(identifyBlink),
+		"animation shown when the accessory is identified in the Home app: blink, pulse, or chase")
+	flag.StringVar(&o.identifyColor, "identify-color", "",
+		"color (e.g. #ff0000) of the identify animation (default the strip's own colors)")
+	flag.IntVar(&o.identifyCycles, "identify-cycles", 2, "number of times the identify animation repeats")
+	flag.DurationVar(&o.identifyPeriod, "identify-period", time.Second, "how long each cycle of the identify animation takes")
+	flag.StringVar(&o.hueAddr, "hue-addr", "",
+		"address to serve an emulated Philips Hue bridge's API on, e.g. :80, for apps that only support Hue (disabled when empty)")
+	flag.BoolVar(&o.hueSSDP, "hue-ssdp", true, "answer SSDP searches for the emulated Hue bridge, so apps can discover it")
 	flag.StringVar(&o.hostURL, "host", "", "host URL for wifi neopixel device")
+	flag.StringVar(&o.device, "device", "",
+		"select the device to bridge when several are discovered, by mDNS instance name, hostname, or TXT record (e.g. a MAC)")
 	flag.StringVar(&o.pin, "code", "12344321", "setup code")
 	flag.StringVar(&o.accName, "name", "WiFi NeoPixel", "accessory name")
+	flag.StringVar(&o.model, "model", "WiFi NeoPixel", "accessory model")
+	flag.StringVar(&o.manufacturer, "manufacturer", "Dave Henderson", "accessory manufacturer")
 	flag.StringVar(&o.otlpEndpoint, "otlp-endpoint", "127.0.0.1:55680", "Endpoint for sending OTLP traces")
+	flag.DurationVar(&o.discoveryInterval, "discovery-interval", 30*time.Second,
+		"how often to re-browse mDNS for the device's address (0 to disable)")
+	flag.Float64Var(&o.maxCurrent, "max-current", 0,
+		"maximum estimated current (mA) for the strip to draw - brighter frames are scaled down to fit (0 for no limit)")
+	flag.Float64Var(&o.led.red, "led-red-ma", defaultLEDCurrent.red,
+		"current (mA) drawn by each pixel's red channel at full brightness")
+	flag.Float64Var(&o.led.green, "led-green-ma", defaultLEDCurrent.green,
+		"current (mA) drawn by each pixel's green channel at full brightness")
+	flag.Float64Var(&o.led.blue, "led-blue-ma", defaultLEDCurrent.blue,
+		"current (mA) drawn by each pixel's blue channel at full brightness")
+	flag.Float64Var(&o.ledVoltage, "led-voltage", defaultLEDVoltage, "the strip's supply voltage, for estimating its power draw")
+	flag.StringVar(&o.output, "output", "http", "how to write frames to the device: http (the /raw endpoint) or ddp")
+	flag.StringVar(&o.ddpAddr, "ddp-addr", "",
+		fmt.Sprintf("address of the device's DDP receiver, with -output ddp (default the device's host, on port %d)", ddpPort))
+	flag.IntVar(&o.ddpOffset, "ddp-offset", 0, "number of pixels to skip at the start of the device's DDP output")
+	flag.IntVar(&o.ddpChunk, "ddp-chunk", ddpMaxPixels,
+		fmt.Sprintf("most pixels to send in each DDP packet (1-%d), for controllers that need smaller packets", ddpMaxPixels))
+	flag.StringVar(&o.e131Addr, "e131-addr", "",
+		fmt.Sprintf("address to listen to for E1.31 (sACN) data, e.g. :%d (disabled when empty)", e131Port))
+	flag.UintVar(&o.e131Universe, "e131-universe", 1, "first E1.31 universe mapped onto the strip")
+	flag.IntVar(&o.e131StartChannel, "e131-start-channel", 1, "DMX channel of the first pixel's red channel in the first universe")
+	flag.BoolVar(&o.e131Multicast, "e131-multicast", true, "join the E1.31 multicast groups for the strip's universes")
+	flag.Float64Var(&o.e131FPS, "e131-fps", 20, "maximum rate to write E1.31 frames to the device")
+	flag.DurationVar(&o.e131Timeout, "e131-timeout", 5*time.Second,
+		"how long after E1.31 packets stop to return control of the strip to HomeKit")
+	flag.StringVar(&o.opcAddr, "opc-addr", "",
+		fmt.Sprintf("address to listen to for Open Pixel Control clients, e.g. :%d (disabled when empty)", opcPort))
+	flag.IntVar(&o.opcChannel, "opc-channel", 1, "OPC channel mapped onto the strip (messages to channel 0 are also used)")
+	flag.Float64Var(&o.opcFPS, "opc-fps", 20, "maximum rate to write OPC frames to the device - frames in between are dropped")
+	flag.DurationVar(&o.opcTimeout, "opc-timeout", 5*time.Second,
+		"how long after OPC frames stop to return control of the strip to HomeKit")
 	flag.BoolVar(&o.enableIPv6, "enable-ipv6", false, "enable IPv6")
+	flag.BoolVar(&o.preferIPv6, "prefer-ipv6", false, "connect to discovered devices by IPv6 address when available (implies -enable-ipv6)")
 	flag.BoolVar(&o.debug, "debug", false, "Enable debug logging")
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [discover]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
 	flag.Parse()
 
+	// the discover command lists all devices found by mDNS, and exits
+	o.discover = flag.Arg(0) == "discover"
+
 	return o
 }
 
@@ -89,6 +186,14 @@ func main() {
 
 	ctx, log := initLogger(ctx, o.debug)
 
+	if o.discover {
+		err := newMDNSDiscovery(o.enableIPv6, o.preferIPv6).discover(ctx, os.Stdout)
+		if err != nil {
+			log.Error().Err(err).Msg("discovery failed")
+		}
+		return
+	}
+
 	err := run(ctx, o)
 	if err != nil {
 		log.Error().Err(err).Msg("exiting with error")
@@ -110,6 +215,11 @@ func run(ctx context.Context, o opts) error {
 
 	log.Debug().Msg("starting")
 
+	files, err := o.loadConfigFiles()
+	if err != nil {
+		return err
+	}
+
 	initMetrics()
 
 	mux := http.NewServeMux()
@@ -126,119 +236,274 @@ func run(ctx context.Context, o opts) error {
 		}
 	}()
 
-	tracer := otel.Tracer("")
-	// provide a different context so that triggered spans aren't children of
-	// this one
-	initCtx, span := tracer.Start(ctx, "init")
-	defer span.End()
-
-	// lookup wifi neopixel by mDNS
-	if o.hostURL == "" {
-		o.hostURL, err = mdnsLookup(ctx, "_neopixel._tcp", "local", o.enableIPv6)
-		if err != nil {
-			span.RecordError(err)
-			return fmt.Errorf("failed to init mDNS: %w", err)
-		}
-	}
-
-	strip, err := newWifiNeopixel(initCtx, o.hostURL)
+	strip, err := newStrip(o)
 	if err != nil {
-		span.RecordError(err)
-		return fmt.Errorf("failed to init WiFiNeopixel: %w", err)
+		return err
 	}
 
+	store := hap.NewFsStore(o.storagePath)
+
 	info := accessory.Info{
 		Name:         o.accName,
-		SerialNumber: "0123456789",
-		Model:        "a",
-		// FirmwareRevision:
-		Manufacturer: "Dave Henderson",
+		Model:        o.model,
+		Manufacturer: o.manufacturer,
+		Firmware:     firmwareRevision(),
+		// discovered devices get their own serial number the first time
+		// they're found, which is kept from then on
+		SerialNumber: savedSerial(store, o.hostURL, o.device, o.accName),
 	}
 
 	acc := accessory.NewColoredLightbulb(info)
-	lb := acc.Lightbulb
 
-	err = initLight(initCtx, lb, strip)
-	if err != nil {
+	initResponders(ctx, acc, strip)
+	al := initAdaptiveLighting(ctx, acc, strip, store)
+	auto := initCircadian(ctx, acc, strip, store, files.circadian, al)
+	go auto.run(ctx)
+
+	if err := setupE131(ctx, o, acc.Lightbulb, strip); err != nil {
+		return err
+	}
+	if err := setupOPC(ctx, o, acc.Lightbulb, strip); err != nil {
 		return err
 	}
 
-	initResponders(ctx, acc, strip)
+	if err := setupHue(ctx, o, acc.Lightbulb, al, strip); err != nil {
+		return err
+	}
 
-	store := hap.NewFsStore(o.storagePath)
+	mux.Handle("/fill", &fillHandler{lb: acc.Lightbulb, strip: strip, presets: files.presets})
+
+	if files.schedule != nil {
+		sched := newScheduler(acc.Lightbulb, strip, files.schedule)
+		mux.Handle("/schedule", sched)
+		go sched.run(ctx)
+	}
+
+	// the strip may not be reachable yet (e.g. it's still booting after a
+	// power cycle), so connect in the background - the accessory will show
+	// "No Response" until then
+	go connectDevice(ctx, o, strip, acc, store)
 
 	t, err := hap.NewServer(store, acc.A)
 	if err != nil {
-		span.RecordError(err)
 		return fmt.Errorf("failed to create transport: %w", err)
 	}
 
+	// the saved transition refers to the color temperature's IID, which is
+	// only assigned by NewServer
+	al.restore(ctx)
+
 	t.Pin = o.pin
 	t.Addr = o.addr
 
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	// End the init span before we start the HC transport
-	span.End()
-
-	log.Info().Str("accessory", o.accName).Str("setup_code", o.pin).Msg("starting up")
+	log.Info().Str("accessory", o.accName).Str("firmware", info.Firmware).Str("setup_code", o.pin).Msg("starting up")
 
 	return t.ListenAndServe(ctx)
 }
 
-func mdnsLookup(ctx context.Context, svc, domain string, enableIPv6 bool) (string, error) {
+// configFiles are the optional configuration files named by the flags
+type configFiles struct {
+	schedule  *scheduleConfig
+	presets   fillPresets
+	circadian *circadianConfig
+}
+
+// loadConfigFiles reads and validates the configuration files, so that
+// mistakes are found before anything's started
+func (o opts) loadConfigFiles() (files configFiles, err error) {
+	files.presets = fillPresets{}
+	files.circadian = defaultCircadianConfig()
+
+	if o.schedulePath != "" {
+		files.schedule, err = loadSchedule(o.schedulePath)
+		if err != nil {
+			return files, err
+		}
+	}
+	if o.fillsPath != "" {
+		files.presets, err = loadFillPresets(o.fillsPath)
+		if err != nil {
+			return files, err
+		}
+	}
+	if o.circadianPath != "" {
+		files.circadian, err = loadCircadianConfig(o.circadianPath)
+		if err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// newStrip returns the strip, configured from the flags
+func newStrip(o opts) (*wifineopixel, error) {
+	strip := newWifiNeopixel()
+	strip.power = powerLimiter{led: o.led, maxCurrent: o.maxCurrent}
+	strip.meter = newPowerMeter(o.accName, o.led, o.ledVoltage)
+	strip.pattern.paletteMode = o.paletteMode
+	strip.pattern.preserve = o.preservePatterns
+
+	var err error
+	strip.summary, err = parseColorSummary(o.colorSummary)
+	if err != nil {
+		return nil, err
+	}
+	strip.identifyCfg, err = o.identifyConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setupDDP(o, strip); err != nil {
+		return nil, err
+	}
+	return strip, nil
+}
+
+// setupDDP sets the strip to be written with DDP, when that output's chosen
+func setupDDP(o opts, strip *wifineopixel) (err error) {
+	switch o.output {
+	case "http":
+	case "ddp":
+		strip.ddp, err = newDDPOutput(o.ddpAddr, o.ddpOffset, o.ddpChunk)
+	default:
+		err = fmt.Errorf("unknown output %q, must be http or ddp", o.output)
+	}
+	return err
+}
+
+// setupE131 listens for E1.31 frames, when an address is given
+func setupE131(ctx context.Context, o opts, lb *service.ColoredLightbulb, strip *wifineopixel) error {
+	if o.e131Addr == "" {
+		return nil
+	}
+
+	if o.e131Universe > 63999 {
+		return fmt.Errorf("E1.31 universe must be between 1 and 63999, not %d", o.e131Universe)
+	}
+	rcv, err := newE131Receiver(lb, strip, uint16(o.e131Universe), o.e131StartChannel, o.e131FPS, o.e131Timeout)
+	if err != nil {
+		return err
+	}
+	return rcv.listen(ctx, o.e131Addr, o.e131Multicast)
+}
+
+// setupOPC listens for OPC clients, when an address is given
+func setupOPC(ctx context.Context, o opts, lb *service.ColoredLightbulb, strip *wifineopixel) error {
+	if o.opcAddr == "" {
+		return nil
+	}
+
+	srv, err := newOPCServer(lb, strip, o.opcChannel, o.opcFPS, o.opcTimeout)
+	if err != nil {
+		return err
+	}
+	return srv.listen(ctx, o.opcAddr)
+}
+
+// setupHue serves the Hue API, and answers SSDP searches for it if enabled,
+// when an address is given
+func setupHue(ctx context.Context, o opts, lb *service.ColoredLightbulb, al *adaptiveLighting, strip *wifineopixel) error {
+	if o.hueAddr == "" {
+		return nil
+	}
+
+	hue := newHueBridge(lb, al.temp, strip, o.accName)
+	port, err := hue.listen(ctx, o.hueAddr)
+	if err != nil {
+		return err
+	}
+	if !o.hueSSDP {
+		return nil
+	}
+
+	ssdp := &ssdpResponder{bridge: hue, port: port}
+	return ssdp.listen(ctx, fmt.Sprintf(":%d", ssdpGroup.Port))
+}
+
+// connectDevice initializes the strip, retrying with backoff until it
+// succeeds or ctx is cancelled.
+func connectDevice(ctx context.Context, o opts, strip *wifineopixel, acc *accessory.ColoredLightbulb, store hap.Store) {
 	log := zerolog.Ctx(ctx)
-	_, span := otel.Tracer("").Start(ctx, "mDNS host lookup")
-	defer span.End()
 
-	hostURL := ""
+	const (
+		minBackoff = 1 * time.Second
+		maxBackoff = 1 * time.Minute
+	)
 
-	suffix := fmt.Sprintf("%s.%s.", svc, domain)
-	// Make a channel for results and start listening
-	entriesCh := make(chan *mdns.ServiceEntry, 4)
-	go func() {
-		for {
-			select {
-			case entry, ok := <-entriesCh:
-				if !ok {
-					return
-				}
-
-				if strings.HasSuffix(entry.Name, suffix) {
-					log.Info().Str("host", entry.Host).Str("name", entry.Name).IPAddr("addr", entry.Addr).Int("port", entry.Port).Msg("found neopixel")
-					span.AddEvent("mDNS: got entry",
-						trace.WithAttributes(
-							attribute.String("entry.host", entry.Host),
-							attribute.String("entry.name", entry.Name),
-							attribute.Stringer("entry.addr", entry.Addr),
-							attribute.Int("entry.port", entry.Port),
-						))
-					hostURL = "http://" + entry.Addr.String()
-				}
-			case <-ctx.Done():
-				return
-			}
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		err := initDevice(ctx, o, strip, acc, store, attempt)
+		if err == nil {
+			return
 		}
-	}()
 
-	// Start the lookup
-	opts := &mdns.QueryParam{
-		Timeout:             5 * time.Second,
-		Domain:              domain,
-		Service:             svc,
-		Entries:             entriesCh,
-		WantUnicastResponse: true,
-		DisableIPv6:         !enableIPv6,
-	}
-	err := mdns.Query(opts)
-	close(entriesCh)
+		log.Warn().Err(err).Int("attempt", attempt).Dur("retry_in", backoff).
+			Msg("device unavailable, will retry")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// initDevice makes a single attempt at finding the device, reading its
+// state, and populating the accessory's characteristics from it.
+func initDevice(ctx context.Context, o opts, strip *wifineopixel, acc *accessory.ColoredLightbulb, store hap.Store, attempt int) error {
+	// provide a different context so that triggered spans aren't children of
+	// this one
+	initCtx, span := otel.Tracer("").Start(ctx, "init",
+		trace.WithAttributes(attribute.Int("attempt", attempt)))
+	defer span.End()
+
+	// lookup wifi neopixel by mDNS
+	disco := newMDNSDiscovery(o.enableIPv6, o.preferIPv6)
+	dev := &foundDevice{url: o.hostURL}
+	if dev.url == "" {
+		var err error
+		dev, err = disco.lookup(initCtx, o.device)
+		if err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("failed to init mDNS: %w", err)
+		}
+	}
+
+	err := strip.connect(initCtx, dev.url)
 	if err != nil {
-		err = fmt.Errorf("neopixel not found: %w", err)
-	} else if hostURL == "" {
-		err = fmt.Errorf("neopixel not found")
+		span.RecordError(err)
+		return fmt.Errorf("failed to init WiFiNeopixel: %w", err)
 	}
-	return hostURL, err
+
+	err = initLight(initCtx, acc.Lightbulb, strip)
+	if err != nil {
+		return err
+	}
+
+	id := dev.instance
+	if id == "" {
+		id = dev.url
+	}
+	serial, err := resolveSerial(store, dev.txt, id)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to save the serial number")
+	}
+	acc.Info.SerialNumber.SetValue(serial)
+	span.SetAttributes(attribute.String("serial", serial))
+
+	// follow the device around the network if it was found by mDNS
+	if dev.instance != "" && o.discoveryInterval > 0 {
+		go disco.watch(ctx, strip, dev.instance, o.discoveryInterval)
+	}
+
+	zerolog.Ctx(ctx).Info().Str("url", dev.url).Str("serial", serial).Msg("connected to device")
+
+	return nil
 }
 
 // initialize the HomeControl lightbulb service with the same values currently displaying on the WNP strip
@@ -256,18 +521,22 @@ func initLight(ctx context.Context, lb *service.ColoredLightbulb, strip *wifineo
 	lb.Hue.SetValue(h)
 	lb.Saturation.SetValue(s * 100)
 	_ = lb.Brightness.SetValue(int(v * 100))
+	lb.On.SetValue(strip.isOn())
+	strip.pattern.setColor(lb.Hue.Value(), lb.Saturation.Value(), lb.Brightness.Value())
 	return nil
 }
 
-func updateColor(ctx context.Context, lb *service.ColoredLightbulb, strip *wifineopixel) {
+// updateColor sets the strip to the given HomeKit hue (degrees), saturation
+// (percent) and brightness (percent)
+func updateColor(ctx context.Context, strip *wifineopixel, hue, sat float64, bri int) error {
 	tracer := otel.Tracer("")
 	ctx, span := tracer.Start(ctx, "updateColor")
 	defer span.End()
 	log := zerolog.Ctx(ctx)
 
-	h := lb.Hue.Value()
-	s := lb.Saturation.Value() / 100
-	v := float64(lb.Brightness.Value()) / 100
+	h := hue
+	s := sat / 100
+	v := float64(bri) / 100
 
 	span.SetAttributes(
 		attribute.Float64("hue", h),
@@ -276,122 +545,160 @@ func updateColor(ctx context.Context, lb *service.ColoredLightbulb, strip *wifin
 	)
 
 	log.Debug().Float64("hue", h).Float64("sat", s).Float64("val", v).Msg("updateColor")
-	c := colorful.Hsv(h, s, v)
-	if err := strip.setSolid(ctx, c); err != nil {
+
+	if !strip.isConnected() {
+		span.RecordError(errNotConnected)
+		return errNotConnected
+	}
+
+	// patterns being kept are changed relative to the new color
+	var err error
+	if p := strip.pattern.get(strip.snapshotOnState()); p != nil {
+		span.SetAttributes(attribute.Bool("pattern", true))
+		err = strip.setState(ctx, strip.pattern.render(p, hue, sat, bri))
+	} else {
+		err = strip.setSolid(ctx, colorful.Hsv(h, s, v))
+	}
+	if err != nil {
 		err = fmt.Errorf("updateColor failed: %w", err)
 		log.Error().Err(err).Send()
 		span.RecordError(err)
+		return err
+	}
+	strip.pattern.setColor(hue, sat, bri)
+	return nil
+}
+
+// cachedValueRequest returns a ValueRequestFunc that serves the
+// characteristic's cached value, but fails with a communication failure
+// while the device is unreachable, so the Home app shows "No Response"
+// instead of stale values
+func cachedValueRequest(c *characteristic.C, strip *wifineopixel) func(*http.Request) (interface{}, int) {
+	return func(*http.Request) (interface{}, int) {
+		if !strip.available() {
+			return nil, hapStatusCommunicationFailure
+		}
+		return c.Val, 0
+	}
+}
+
+// onValueRequest returns a ValueRequestFunc for the On characteristic, that
+// reads the strip's state from the device, so out-of-band changes are noticed
+func onValueRequest(ctx context.Context, strip *wifineopixel) func(*http.Request) (interface{}, int) {
+	tracer := otel.Tracer("")
+	log := zerolog.Ctx(ctx)
+
+	return func(*http.Request) (interface{}, int) {
+		ctx, span := tracer.Start(ctx, "lb.On.ValueRequest")
+		defer span.End()
+
+		if !strip.isConnected() {
+			span.RecordError(errNotConnected)
+			return nil, hapStatusCommunicationFailure
+		}
+
+		start := time.Now()
+		log.Debug().Msg("lb.On.ValueRequest()")
+		err := strip.refresh(ctx)
+		observeUpdateDuration("on", "remoteGet", start)
+		if err != nil {
+			log.Error().Err(err).Msg("error during lb.On.ValueRequest")
+			span.RecordError(err)
+			return nil, hapStatusCommunicationFailure
+		}
+
+		return strip.isOn(), 0
+	}
+}
+
+// setOn returns an OnSetRemoteValue handler for the On characteristic, that
+// turns the strip on or off
+func setOn(ctx context.Context, strip *wifineopixel) func(bool) error {
+	tracer := otel.Tracer("")
+	log := zerolog.Ctx(ctx)
+
+	return func(on bool) error {
+		ctx, span := tracer.Start(ctx, "lb.On.OnSetRemoteValue")
+		defer span.End()
+		span.SetAttributes(attribute.Bool("value", on))
+
+		start := time.Now()
+		log.Debug().Bool("on", on).Msg("lb.On.OnSetRemoteValue")
+		var err error
+		if on {
+			err = strip.on(ctx)
+		} else {
+			err = strip.clear(ctx)
+		}
+		if err != nil {
+			log.Error().Err(err).Bool("on", on).Msg("error during lb.On.OnSetRemoteValue")
+			span.RecordError(err)
+		}
+		observeUpdateDuration("on", "remoteUpdate", start)
+		return err
 	}
 }
 
+// initResponders wires the lightbulb's characteristics up to the strip.
+// Writes are handled with OnSetRemoteValue, so that when the device can't be
+// updated the write fails with a HAP communication failure status, and the
+// characteristic keeps its last known good value.
 func initResponders(ctx context.Context, acc *accessory.ColoredLightbulb, strip *wifineopixel) {
 	lb := acc.Lightbulb
 	tracer := otel.Tracer("")
 
 	log := zerolog.Ctx(ctx)
 
-	lb.Hue.OnValueRemoteUpdate(func(value float64) {
-		ctx, span := tracer.Start(ctx, "lb.Hue.OnValueRemoteUpdate")
+	lb.Hue.ValueRequestFunc = cachedValueRequest(lb.Hue.C, strip)
+	lb.Saturation.ValueRequestFunc = cachedValueRequest(lb.Saturation.C, strip)
+	lb.Brightness.ValueRequestFunc = cachedValueRequest(lb.Brightness.C, strip)
+
+	lb.Hue.OnSetRemoteValue(func(value float64) error {
+		ctx, span := tracer.Start(ctx, "lb.Hue.OnSetRemoteValue")
 		defer span.End()
 		span.SetAttributes(attribute.Float64("value", value))
 
 		start := time.Now()
 		log.Debug().Float64("hue", value).Msg("Changed Hue")
-		updateColor(ctx, lb, strip)
+		err := updateColor(ctx, strip, value, lb.Saturation.Value(), lb.Brightness.Value())
 		observeUpdateDuration("hue", "remoteUpdate", start)
+		return err
 	})
 
-	lb.Saturation.OnValueRemoteUpdate(func(value float64) {
-		ctx, span := tracer.Start(ctx, "lb.Saturation.OnValueRemoteUpdate")
+	lb.Saturation.OnSetRemoteValue(func(value float64) error {
+		ctx, span := tracer.Start(ctx, "lb.Saturation.OnSetRemoteValue")
 		defer span.End()
 		span.SetAttributes(attribute.Float64("value", value))
 
 		start := time.Now()
 		log.Debug().Float64("sat", value).Msg("Changed Saturation")
-		updateColor(ctx, lb, strip)
+		err := updateColor(ctx, strip, lb.Hue.Value(), value, lb.Brightness.Value())
 		observeUpdateDuration("sat", "remoteUpdate", start)
+		return err
 	})
 
-	lb.Brightness.OnValueRemoteUpdate(func(value int) {
-		ctx, span := tracer.Start(ctx, "lb.Brightness.OnValueRemoteUpdate")
+	lb.Brightness.OnSetRemoteValue(func(value int) error {
+		ctx, span := tracer.Start(ctx, "lb.Brightness.OnSetRemoteValue")
 		defer span.End()
 		span.SetAttributes(attribute.Int("value", value))
 
 		start := time.Now()
 		log.Debug().Int("val", value).Msg("Changed Brightness")
-		updateColor(ctx, lb, strip)
+		err := updateColor(ctx, strip, lb.Hue.Value(), lb.Saturation.Value(), value)
 		observeUpdateDuration("val", "remoteUpdate", start)
+		return err
 	})
 
-	lb.On.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
-		_, span := tracer.Start(ctx, "lb.On.ValueRequest")
-		defer span.End()
-
-		start := time.Now()
-		log.Debug().Msg("lb.On.ValueRequest()")
-		isOn := strip.isOn()
-		observeUpdateDuration("on", "remoteGet", start)
-
-		return isOn, 0
-	}
-
-	lb.On.OnValueRemoteUpdate(func(on bool) {
-		ctx, span := tracer.Start(ctx, "lb.On.OnValueRemoteUpdate")
-		defer span.End()
-		span.SetAttributes(attribute.Bool("value", on))
-
-		start := time.Now()
-		log.Debug().Bool("on", on).Msg("lb.On.OnValueRemoteUpdate")
-		var err error
-		if on {
-			err = strip.on(ctx)
-		} else {
-			err = strip.clear(ctx)
-		}
-		if err != nil {
-			log.Error().Err(err).Bool("on", on).Msg("error during lb.On.OnValueRemoteUpdate")
-		}
-		lb.On.SetValue(on)
-		observeUpdateDuration("on", "remoteUpdate", start)
-	})
+	lb.On.ValueRequestFunc = onValueRequest(ctx, strip)
+	lb.On.OnSetRemoteValue(setOn(ctx, strip))
 
+	// identifying takes a few seconds, so it's done in the background
+	// rather than holding up the HAP request
 	acc.IdentifyFunc = func(r *http.Request) {
 		ctx, span := tracer.Start(ctx, "acc.OnIdentify")
 		defer span.End()
 
-		start := time.Now()
 		log.Debug().Msg("acc.OnIdentify()")
-		var err error
-		initialOn := strip.isOn()
-		if !initialOn {
-			err = strip.on(ctx)
-			if err != nil {
-				log.Error().Err(err).Bool("initialOn", initialOn).Msg("error during acc.OnIdentify")
-				return
-			}
-			time.Sleep(500 * time.Millisecond)
-		}
-		for i := 0; i < 4; i++ {
-			if i%2 == 0 {
-				err = strip.clear(ctx)
-			} else {
-				err = strip.on(ctx)
-			}
-			if err != nil {
-				log.Error().Err(err).Bool("initialOn", initialOn).Int("i", i).Msg("error during acc.OnIdentify blinking")
-				return
-			}
-			time.Sleep(500 * time.Millisecond)
-		}
-
-		if initialOn {
-			time.Sleep(500 * time.Millisecond)
-			err = strip.on(ctx)
-			if err != nil {
-				log.Error().Err(err).Bool("initialOn", initialOn).Msg("error during acc.OnIdentify")
-				return
-			}
-		}
-		observeUpdateDuration("acc", "identify", start)
+		strip.identify(ctx)
 	}
 }
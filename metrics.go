@@ -16,6 +16,16 @@ var (
 	clientObservers   = map[string]prometheus.ObserverVec{}
 	clientGauges      = map[string]prometheus.Gauge{}
 	clientCounterVecs = map[string]*prometheus.CounterVec{}
+
+	discoveryEvents *prometheus.CounterVec
+
+	powerLimitedFrames prometheus.Counter
+	powerLimitScale    prometheus.Gauge
+	powerWatts         *prometheus.GaugeVec
+	energyWattHours    *prometheus.CounterVec
+
+	e131Packets *prometheus.CounterVec
+	opcFrames   *prometheus.CounterVec
 )
 
 func initMetrics() {
@@ -23,7 +33,7 @@ func initMetrics() {
 	prometheus.MustRegister(prommod.NewCollector(ns), collectors.NewBuildInfoCollector())
 
 	// hue: Hue, sat: Saturation, val: Value/Brightness, on: On, acc: Accessory (identify event)
-	for _, sub := range []string{"hue", "sat", "val", "on", "acc"} {
+	for _, sub := range []string{"hue", "sat", "val", "on", "temp", "acc"} {
 		updateMetrics[sub+"UpdateDurationHist"] = promauto.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: ns,
 			Subsystem: sub,
@@ -39,6 +49,10 @@ func initMetrics() {
 	}
 
 	initClientMetrics(ns)
+	initDiscoveryMetrics(ns)
+	initPowerMetrics(ns)
+	initE131Metrics(ns)
+	initOPCMetrics(ns)
 }
 
 func observeUpdateDuration(sub, event string, start time.Time) {
@@ -48,6 +62,62 @@ func observeUpdateDuration(sub, event string, start time.Time) {
 	updateMetrics[sub+"UpdateDurationSumm"].With(l).Observe(diff.Seconds())
 }
 
+func initDiscoveryMetrics(ns string) {
+	discoveryEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "discovery",
+		Name:      "rediscovery_events_total",
+		Help:      "A counter of mDNS rediscovery outcomes, by event.",
+	}, []string{"event"})
+}
+
+func observeDiscoveryEvent(event string) {
+	discoveryEvents.With(prometheus.Labels{"event": event}).Inc()
+}
+
+func initPowerMetrics(ns string) {
+	powerLimitedFrames = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "power",
+		Name:      "limited_frames_total",
+		Help:      "A counter of frames scaled down to stay under the maximum current.",
+	})
+	powerLimitScale = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "power",
+		Name:      "limit_scale_ratio",
+		Help:      "The brightness scale applied to the last frame by the power limiter (1 when not limited).",
+	})
+	powerWatts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "power",
+		Name:      "estimated_watts",
+		Help:      "The strip's estimated power draw, from the frame it's displaying.",
+	}, []string{"device"})
+	energyWattHours = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "power",
+		Name:      "estimated_energy_watt_hours_total",
+		Help:      "A counter of the strip's estimated energy use.",
+	}, []string{"device"})
+}
+
+func observePowerLimited() {
+	powerLimitedFrames.Inc()
+}
+
+func observePowerScale(scale float64) {
+	powerLimitScale.Set(scale)
+}
+
+func observePower(device string, watts float64) {
+	powerWatts.With(prometheus.Labels{"device": device}).Set(watts)
+}
+
+func observeEnergy(device string, wh float64) {
+	energyWattHours.With(prometheus.Labels{"device": device}).Add(wh)
+}
+
 func initClientMetrics(ns string) {
 	sub := "client"
 	clientGauges["clientInFlightGauge"] = promauto.NewGauge(prometheus.GaugeOpts{
@@ -150,3 +220,29 @@ func instrumentHTTPClientTrace(name string) *promhttp.InstrumentTrace {
 		WroteRequest:         observe("wrote_request"),
 	}
 }
+
+func initE131Metrics(ns string) {
+	e131Packets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "e131",
+		Name:      "packets_total",
+		Help:      "A counter of E1.31 packets received, by how they were handled.",
+	}, []string{"result"})
+}
+
+func observeE131Packet(result string) {
+	e131Packets.With(prometheus.Labels{"result": result}).Inc()
+}
+
+func initOPCMetrics(ns string) {
+	opcFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "opc",
+		Name:      "frames_total",
+		Help:      "A counter of OPC frames received, forwarded to the device, and dropped.",
+	}, []string{"event"})
+}
+
+func observeOPCFrame(event string) {
+	opcFrames.With(prometheus.Labels{"event": event}).Inc()
+}
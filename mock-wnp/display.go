@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// display renders the simulated strip as a live truecolor bar in the
+// terminal, redrawn in place whenever the pixels change
+type display struct {
+	out io.Writer
+	// stats is rendered as a footer when set
+	stats  *requestStats
+	states []uint32
+	// lines is how many lines were drawn last time, so they can be
+	// overwritten
+	lines int
+	mu    sync.Mutex
+}
+
+func newDisplay(out io.Writer, stats *requestStats) *display {
+	return &display{out: out, stats: stats}
+}
+
+// update redraws the strip with new pixel values
+func (d *display) update(states []uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.states = states
+	d.draw()
+}
+
+// run periodically redraws the footer, so that rates decay when requests
+// stop. It blocks until ctx is cancelled.
+func (d *display) run(ctx context.Context) {
+	if d.stats == nil {
+		return
+	}
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			d.mu.Lock()
+			d.draw()
+			d.mu.Unlock()
+		}
+	}
+}
+
+// draw must be called with d.mu held
+func (d *display) draw() {
+	lines := renderStrip(d.states, termWidth())
+	if d.stats != nil {
+		lines = append(lines, d.stats.summary(time.Now()))
+	}
+
+	b := &strings.Builder{}
+	// move back to the start of the previous drawing
+	if d.lines > 0 {
+		fmt.Fprintf(b, "\x1b[%dF", d.lines)
+	}
+	for _, l := range lines {
+		b.WriteString("\x1b[2K")
+		b.WriteString(l)
+		b.WriteString("\n")
+	}
+	// clear anything left over from a taller drawing
+	b.WriteString("\x1b[J")
+
+	d.lines = len(lines)
+	_, _ = io.WriteString(d.out, b.String())
+}
+
+func termWidth() int {
+	w, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || w <= 0 {
+		return 80
+	}
+	return w
+}
+
+// renderStrip renders each pixel as a coloured block, wrapping onto as many
+// lines as needed to fit in width columns. Pixels are two columns wide when
+// the whole strip fits on one line. Unlit pixels are shown as dim dots so
+// the strip's length is still visible.
+func renderStrip(states []uint32, width int) []string {
+	cell := "██"
+	off := "··"
+	if len(states)*2 > width {
+		cell = "█"
+		off = "·"
+	}
+	perLine := max(width/len([]rune(cell)), 1)
+
+	lines := []string{}
+	for start := 0; start < len(states); start += perLine {
+		end := min(start+perLine, len(states))
+
+		b := &strings.Builder{}
+		for _, s := range states[start:end] {
+			r, g, bl := (s>>16)&0xff, (s>>8)&0xff, s&0xff
+			if r == 0 && g == 0 && bl == 0 {
+				fmt.Fprintf(b, "\x1b[38;2;64;64;64m%s", off)
+				continue
+			}
+			fmt.Fprintf(b, "\x1b[38;2;%d;%d;%dm%s", r, g, bl, cell)
+		}
+		b.WriteString("\x1b[0m")
+		lines = append(lines, b.String())
+	}
+
+	return lines
+}
+
+// requestStats keeps a sliding window of request timings, for the display
+// footer
+type requestStats struct {
+	samples []requestSample
+	window  time.Duration
+	mu      sync.Mutex
+}
+
+type requestSample struct {
+	// at is when the request completed
+	at       time.Time
+	duration time.Duration
+}
+
+func newRequestStats(window time.Duration) *requestStats {
+	return &requestStats{window: window}
+}
+
+// observe records a request that started at start and took d. Concurrent
+// requests can finish out of order, so samples are inserted in order of
+// completion, for summary to find the start of the window.
+func (s *requestStats) observe(start time.Time, d time.Duration) {
+	done := start.Add(d)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].at.After(done) })
+	s.samples = slices.Insert(s.samples, i, requestSample{at: done, duration: d})
+}
+
+// summary describes the request rate and latency over the window ending at
+// now, discarding older samples
+func (s *requestStats) summary(now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.Add(-s.window)
+	i := sort.Search(len(s.samples), func(i int) bool { return !s.samples[i].at.Before(cutoff) })
+	s.samples = s.samples[i:]
+
+	if len(s.samples) == 0 {
+		return fmt.Sprintf("\x1b[2m0.0 req/s (last %s)\x1b[0m", s.window)
+	}
+
+	durations := make([]time.Duration, len(s.samples))
+	total := time.Duration(0)
+	for i, sample := range s.samples {
+		durations[i] = sample.duration
+		total += sample.duration
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	rate := float64(len(s.samples)) / s.window.Seconds()
+	avg := total / time.Duration(len(durations))
+	p95 := durations[(len(durations)-1)*95/100]
+
+	return fmt.Sprintf("\x1b[2m%.1f req/s, latency avg %s p95 %s max %s (last %s)\x1b[0m",
+		rate, avg.Round(time.Microsecond), p95.Round(time.Microsecond),
+		durations[len(durations)-1].Round(time.Microsecond), s.window)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderStrip(t *testing.T) {
+	// two columns per pixel when the strip fits on one line
+	lines := renderStrip([]uint32{0xff0000, 0, 0x0000ff}, 80)
+	assert.Equal(t, []string{
+		"\x1b[38;2;255;0;0m██\x1b[38;2;64;64;64m··\x1b[38;2;0;0;255m██\x1b[0m",
+	}, lines)
+
+	// alpha is ignored
+	lines = renderStrip([]uint32{0xff00ff00}, 80)
+	assert.Equal(t, []string{"\x1b[38;2;0;255;0m██\x1b[0m"}, lines)
+
+	// one column per pixel, wrapping, when it doesn't
+	lines = renderStrip([]uint32{0x010203, 0x010203, 0x010203, 0, 0}, 2)
+	assert.Equal(t, []string{
+		"\x1b[38;2;1;2;3m█\x1b[38;2;1;2;3m█\x1b[0m",
+		"\x1b[38;2;1;2;3m█\x1b[38;2;64;64;64m·\x1b[0m",
+		"\x1b[38;2;64;64;64m·\x1b[0m",
+	}, lines)
+
+	assert.Empty(t, renderStrip(nil, 80))
+}
+
+func TestRequestStats(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := newRequestStats(10 * time.Second)
+
+	assert.Equal(t, "\x1b[2m0.0 req/s (last 10s)\x1b[0m", s.summary(now))
+
+	// a slow request that started first completes last, and one that
+	// completed before the window is dropped even though it started after
+	// the slow one
+	s.observe(now.Add(-15*time.Second), 9*time.Second)
+	s.observe(now.Add(-14*time.Second), 20*time.Millisecond)
+	s.observe(now.Add(-5*time.Second), 10*time.Millisecond)
+	s.observe(now.Add(-4*time.Second), 30*time.Millisecond)
+	assert.Equal(t, "\x1b[2m0.3 req/s, latency avg 3.013333s p95 30ms max 9s (last 10s)\x1b[0m", s.summary(now))
+	assert.Len(t, s.samples, 3)
+
+	for i := 1; i < len(s.samples); i++ {
+		assert.False(t, s.samples[i].at.Before(s.samples[i-1].at))
+	}
+
+	// everything ages out
+	assert.Equal(t, "\x1b[2m0.0 req/s (last 10s)\x1b[0m", s.summary(now.Add(time.Minute)))
+}
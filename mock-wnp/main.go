@@ -1,77 +1,178 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"image/color"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/hairyhenderson/wnp-bridge/wnptest"
+	"github.com/hashicorp/mdns"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05"})
-	states := []uint32{0, 0, 0, 0, 0, 0, 0, 0}
-	slock := &sync.RWMutex{}
+	addr := flag.String("addr", ":8888", "address to listen to")
+	size := flag.Int("size", 8, "number of pixels in the simulated strip")
+	debug := flag.Bool("debug", false, "Enable debug logging")
+	showStrip := flag.Bool("display", false, "render the simulated strip in the terminal (suppresses info logs)")
+	showStats := flag.Bool("display-stats", false, "show request rate and latency below the rendered strip (implies -display)")
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/clear", func(w http.ResponseWriter, r *http.Request) {
-		log.Info().Msg("/clear")
-		dump, _ := httputil.DumpRequest(r, false)
-		log.Debug().Bytes("req", dump).Msg("/clear")
-		w.WriteHeader(http.StatusOK)
-	})
+	faults := wnptest.Faults{}
+	latency := flag.String("latency", "",
+		"latency to add to each request (e.g. fixed:200ms, uniform:100ms-500ms, normal:300ms,50ms, exponential:200ms,2s)")
+	flag.Float64Var(&faults.ErrorRate, "error-rate", 0, "probability (0-1) of responding with a 500 error")
+	flag.Float64Var(&faults.DropRate, "drop-rate", 0, "probability (0-1) of dropping the connection without responding")
+	flag.Float64Var(&faults.MalformedRate, "malformed-rate", 0, "probability (0-1) of returning truncated JSON")
+	flag.IntVar(&faults.MaxConcurrent, "max-concurrent", 0, "maximum concurrent requests (0 for unlimited, 1 to mimic the ESP8266)")
 
-	mux.HandleFunc("/raw", func(w http.ResponseWriter, r *http.Request) {
-		log.Info().Msg("/raw")
-		dump, _ := httputil.DumpRequest(r, false)
-		log.Debug().Bytes("req", dump).Msg("/raw")
-
-		d := json.NewDecoder(r.Body)
-		defer r.Body.Close()
-		slock.Lock()
-		defer slock.Unlock()
-		_ = d.Decode(&states)
-		log.Debug().Uints32("states", states).Msgf("/raw color: %v", uint32ToColor(states[0]))
-		w.WriteHeader(http.StatusOK)
-	})
+	adv := wnptest.Advertisement{}
+	flag.StringVar(&adv.Instance, "mdns-instance", "", "advertise the device over mDNS with this instance name (disabled when empty)")
+	flag.StringVar(&adv.HostName, "mdns-host", "", "hostname to advertise over mDNS (default <instance>.local.)")
+	flag.IntVar(&adv.Port, "mdns-port", 0, "port to advertise over mDNS (default the port from -addr)")
+	mdnsIPs := flag.String("mdns-ips", "", "comma-separated IP addresses to advertise over mDNS (default this host's addresses)")
+	mdnsTXT := stringSlice{}
+	flag.Var(&mdnsTXT, "mdns-txt", "TXT record to advertise over mDNS, e.g. mac=5c:cf:7f:00:00:01 (may be repeated)")
+	flag.Parse()
 
-	mux.HandleFunc("/size", func(w http.ResponseWriter, r *http.Request) {
-		log.Info().Msg("/size")
-		dump, _ := httputil.DumpRequest(r, false)
-		log.Debug().Bytes("req", dump).Msg("/size")
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05"})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	*showStrip = *showStrip || *showStats
+	if *showStrip {
+		// info logs for each request would scroll the strip away
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	}
+	if *debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	}
 
-		w.Header().Set("Content-Type", "text/plain")
-		_, _ = w.Write([]byte("8"))
-		w.WriteHeader(http.StatusOK)
-	})
+	var err error
+	faults.Latency, err = wnptest.ParseLatency(*latency)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
 
-	mux.HandleFunc("/states", func(w http.ResponseWriter, r *http.Request) {
-		log.Info().Msg("/states")
-		dump, _ := httputil.DumpRequest(r, false)
-		log.Debug().Bytes("req", dump).Msg("/states")
-
-		slock.RLock()
-		defer slock.RUnlock()
-		e := json.NewEncoder(w)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_ = e.Encode(states)
-	})
+	dev := wnptest.New(*size)
+	dev.SetFaults(faults)
+
+	var stats *requestStats
+	if *showStats {
+		stats = newRequestStats(10 * time.Second)
+	}
+	if *showStrip {
+		disp := newDisplay(os.Stdout, stats)
+		dev.OnChange(disp.update)
+		disp.update(dev.States())
+		go disp.run(context.Background())
+	}
+
+	// faults can be changed at runtime with the admin endpoint, e.g.:
+	//   curl -d error_rate=0.2 -d latency=uniform:100ms-1s localhost:8888/admin/faults
+	mux := http.NewServeMux()
+	mux.Handle("/admin/faults", dev.AdminHandler())
+	mux.Handle("/", logRequests(dev, stats))
 
 	srv := &http.Server{
-		Addr: ":8888", Handler: mux, ReadHeaderTimeout: 2 * time.Second,
+		Addr: *addr, Handler: mux, ReadHeaderTimeout: 2 * time.Second,
+	}
+
+	if adv.Instance != "" {
+		adv.TXT = mdnsTXT
+		mdnsSrv, err := advertise(adv, *addr, *mdnsIPs)
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		//nolint:errcheck
+		defer mdnsSrv.Shutdown()
 	}
 
+	log.Info().Str("addr", *addr).Int("size", *size).
+		Stringer("latency", faults.Latency).Float64("error_rate", faults.ErrorRate).
+		Float64("drop_rate", faults.DropRate).Float64("malformed_rate", faults.MalformedRate).
+		Int("max_concurrent", faults.MaxConcurrent).
+		Msg("starting mock WiFi NeoPixel")
+
 	if err := srv.ListenAndServe(); err != nil {
 		log.Error().Err(err).Send()
 	}
 }
 
+// advertise fills in defaults from the listen address and starts advertising
+// the device over mDNS
+func advertise(adv wnptest.Advertisement, addr, ips string) (*mdns.Server, error) {
+	if adv.Port == 0 {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		adv.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ips != "" {
+		for _, s := range strings.Split(ips, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: s}
+			}
+			adv.IPs = append(adv.IPs, ip)
+		}
+	}
+
+	srv, err := wnptest.Advertise(adv)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("instance", adv.Instance).Int("port", adv.Port).Strs("txt", adv.TXT).
+		Msg("advertising over mDNS")
+
+	return srv, nil
+}
+
+// stringSlice is a flag.Value that can be set more than once
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// logRequests logs each request, and records its timing in stats (if set)
+func logRequests(dev *wnptest.Device, stats *requestStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Info().Msg(r.URL.Path)
+		dump, _ := httputil.DumpRequest(r, false)
+		log.Debug().Bytes("req", dump).Msg(r.URL.Path)
+
+		start := time.Now()
+		dev.ServeHTTP(w, r)
+		if stats != nil {
+			stats.observe(start, time.Since(start))
+		}
+
+		if r.URL.Path == "/raw" || r.URL.Path == "/clear" {
+			states := dev.States()
+			if len(states) > 0 {
+				log.Debug().Uints32("states", states).Msgf("%s color: %v", r.URL.Path, uint32ToColor(states[0]))
+			}
+		}
+	})
+}
+
 func uint32ToColor(u uint32) color.Color {
 	rgba := color.RGBA{
 		uint8(u>>16) & 255,
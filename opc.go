@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/brutella/hap/service"
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/rs/zerolog"
+)
+
+// Open Pixel Control - see http://openpixelcontrol.org
+const (
+	opcPort = 7890
+
+	// opcBroadcast is the channel that addresses every output
+	opcBroadcast = 0
+
+	opcCommandSetPixels = 0
+)
+
+// opcMessage is an Open Pixel Control message
+type opcMessage struct {
+	data    []byte
+	channel byte
+	command byte
+}
+
+// readOPC reads a single message. The returned message's data is only valid
+// until the next read.
+func readOPC(r io.Reader, buf []byte) (*opcMessage, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, buf, err
+	}
+
+	n := int(binary.BigEndian.Uint16(header[2:]))
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, buf, err
+	}
+
+	return &opcMessage{channel: header[0], command: header[1], data: buf}, buf, nil
+}
+
+// opcServer drives the strip from Open Pixel Control clients, such as
+// generative LED art tools. Frames are written to the device no faster than
+// the frame rate allows, and when the device can't keep up, older frames are
+// dropped in favour of the latest. Once frames stop for longer than timeout,
+// the strip is set back to the lightbulb's HomeKit state.
+type opcServer struct {
+	takeover
+
+	// frame is the latest frame received, waiting to be written
+	frame   []colorful.Color
+	channel byte
+}
+
+func newOPCServer(lb *service.ColoredLightbulb, strip *wifineopixel, channel int,
+	maxFPS float64, timeout time.Duration,
+) (*opcServer, error) {
+	if channel < 1 || channel > 255 {
+		return nil, fmt.Errorf("OPC channel must be between 1 and 255, not %d", channel)
+	}
+	if maxFPS <= 0 {
+		return nil, fmt.Errorf("OPC frame rate must be positive, not %g", maxFPS)
+	}
+
+	s := &opcServer{
+		takeover: takeover{
+			lb:       lb,
+			strip:    strip,
+			id:       "opc",
+			name:     "OPC client",
+			interval: time.Duration(float64(time.Second) / maxFPS),
+			timeout:  timeout,
+			now:      time.Now,
+		},
+		channel: byte(channel),
+	}
+	s.src = s
+	return s, nil
+}
+
+// listen accepts OPC clients on addr (e.g. ":7890") until ctx is cancelled
+func (s *opcServer) listen(ctx context.Context, addr string) error {
+	log := zerolog.Ctx(ctx)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for OPC: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	log.Info().Stringer("addr", l.Addr()).Uint8("channel", s.channel).Msg("listening for OPC")
+
+	go s.run(ctx)
+	go s.serve(ctx, l)
+
+	return nil
+}
+
+func (s *opcServer) serve(ctx context.Context, l net.Listener) {
+	log := zerolog.Ctx(ctx)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Err(err).Msg("OPC accept failed")
+			}
+			return
+		}
+
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// serveConn reads messages from a client until it disconnects
+func (s *opcServer) serveConn(ctx context.Context, conn net.Conn) {
+	log := zerolog.Ctx(ctx).With().Stringer("client", conn.RemoteAddr()).Logger()
+	log.Debug().Msg("OPC client connected")
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	var buf []byte
+	for {
+		var m *opcMessage
+		var err error
+		m, buf, err = readOPC(r, buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				log.Warn().Err(err).Msg("OPC client read failed")
+			}
+			log.Debug().Msg("OPC client disconnected")
+			return
+		}
+
+		s.handle(ctx, m)
+	}
+}
+
+// handle stores a message's frame, to be written by the next flush. Only
+// "set pixel colors" messages for the server's channel (or the broadcast
+// channel) are used - anything else is ignored.
+func (s *opcServer) handle(ctx context.Context, m *opcMessage) {
+	if m.command != opcCommandSetPixels || (m.channel != s.channel && m.channel != opcBroadcast) {
+		return
+	}
+
+	observeOPCFrame("received")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := int(s.pixels.Load())
+	if n == 0 {
+		observeOPCFrame("dropped")
+		return
+	}
+
+	s.received(ctx)
+
+	// a frame that hasn't been written yet is superseded
+	if s.frame != nil {
+		observeOPCFrame("dropped")
+	}
+	s.frame = mapOPCFrame(m.data, n)
+}
+
+// mapOPCFrame maps RGB pixel data onto a strip of n pixels. Pixels beyond
+// the data are black, and data beyond the strip is ignored.
+func mapOPCFrame(data []byte, n int) []colorful.Color {
+	frame := make([]colorful.Color, n)
+	for i := range frame {
+		if 3*i+2 >= len(data) {
+			break
+		}
+		frame[i] = colorful.Color{
+			R: float64(data[3*i]) / 255,
+			G: float64(data[3*i+1]) / 255,
+			B: float64(data[3*i+2]) / 255,
+		}
+	}
+	return frame
+}
+
+// pending returns the latest frame, if it hasn't been written yet
+func (s *opcServer) pending(int) []colorful.Color {
+	frame := s.frame
+	s.frame = nil
+	return frame
+}
+
+// reset discards the frame waiting to be written, counting it as dropped
+func (s *opcServer) reset() {
+	if s.frame != nil {
+		observeOPCFrame("dropped")
+	}
+	s.frame = nil
+}
+
+// written counts frames the device couldn't be sent as dropped, so that
+// every frame received is counted as either forwarded or dropped
+func (s *opcServer) written(err error) {
+	if err != nil {
+		observeOPCFrame("dropped")
+		return
+	}
+	observeOPCFrame("forwarded")
+}
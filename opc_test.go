@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hairyhenderson/wnp-bridge/wnptest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// opcData builds an OPC message
+func opcData(channel, command byte, data []byte) []byte {
+	b := make([]byte, 4+len(data))
+	b[0], b[1] = channel, command
+	binary.BigEndian.PutUint16(b[2:], uint16(len(data)))
+	copy(b[4:], data)
+	return b
+}
+
+func TestReadOPC(t *testing.T) {
+	r := bytes.NewReader(append(opcData(1, 0, []byte{1, 2, 3}), opcData(0, 255, nil)...))
+
+	m, buf, err := readOPC(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, &opcMessage{channel: 1, command: 0, data: []byte{1, 2, 3}}, m)
+
+	m, _, err = readOPC(r, buf)
+	require.NoError(t, err)
+	assert.Equal(t, byte(255), m.command)
+	assert.Empty(t, m.data)
+
+	_, _, err = readOPC(r, buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// truncated messages
+	_, _, err = readOPC(bytes.NewReader(opcData(1, 0, []byte{1, 2, 3})[:5]), nil)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestMapOPCFrame(t *testing.T) {
+	// short data leaves the rest of the strip black, and partial pixels are
+	// ignored
+	frame := mapOPCFrame([]byte{0xff, 0x80, 0, 0, 0, 0xff, 0xff}, 3)
+	assert.Equal(t, []uint32{0xffff8000, 0xff0000ff, 0xff000000}, colorsToUint32(frame))
+
+	// data beyond the strip is ignored
+	frame = mapOPCFrame([]byte{0xff, 0, 0, 0, 0xff, 0}, 1)
+	assert.Equal(t, []uint32{0xffff0000}, colorsToUint32(frame))
+}
+
+func opcFrameCount(t *testing.T, event string) float64 {
+	t.Helper()
+
+	m := &dto.Metric{}
+	require.NoError(t, opcFrames.With(prometheus.Labels{"event": event}).Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestOPCServer(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	_, err := newOPCServer(lb, b.strip, 0, 20, time.Second)
+	assert.Error(t, err)
+	_, err = newOPCServer(lb, b.strip, 1, 0, time.Second)
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s, err := newOPCServer(lb, b.strip, 2, 100, time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.flush(ctx)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	// frames are flushed from the test, rather than by run, so the strip
+	// is only used from here
+	go s.serve(ctx, l)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	received := opcFrameCount(t, "received")
+	forwarded := opcFrameCount(t, "forwarded")
+	dropped := opcFrameCount(t, "dropped")
+
+	send := func(channel, command byte, data []byte) {
+		t.Helper()
+
+		_, err := client.Write(opcData(channel, command, data))
+		require.NoError(t, err)
+	}
+
+	active := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.active
+	}
+
+	// other channels and commands are ignored
+	send(3, 0, []byte{0xff, 0xff, 0xff})
+	send(2, 255, []byte{0xff, 0xff, 0xff})
+
+	first := []byte{0xff, 0, 0, 0xff, 0, 0, 0xff, 0, 0, 0xff, 0, 0}
+	frame := []byte{0, 0, 0xff, 0, 0xff, 0, 0xff, 0, 0, 0xff, 0xff, 0xff}
+	send(2, 0, first)
+	// the broadcast channel is used too
+	send(0, 0, frame)
+	require.Eventually(t, func() bool {
+		return opcFrameCount(t, "received") == received+2
+	}, time.Second, time.Millisecond)
+	assert.True(t, active())
+
+	// the first frame was superseded before it could be written
+	s.flush(ctx)
+	s.flush(ctx)
+	assert.Equal(t, [][]uint32{opaque([]uint32{0x0000ff, 0x00ff00, 0xff0000, 0xffffff})}, b.rawPayloads(t))
+	assert.Equal(t, forwarded+1, opcFrameCount(t, "forwarded"))
+	assert.Equal(t, dropped+1, opcFrameCount(t, "dropped"))
+	assert.Contains(t, b.spanNames(), "opc.write")
+
+	// once frames stop, HomeKit gets the strip back
+	now = now.Add(time.Hour)
+	s.flush(ctx)
+	assert.False(t, active())
+	assert.Equal(t, opaque(solid(red, 4)), b.dev.States())
+	assert.Contains(t, b.spanNames(), "opc.release")
+
+	// turning the light on after an OPC client has had control restores its
+	// HomeKit color rather than the last OPC frame
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	send(2, 0, frame)
+	require.Eventually(t, active, time.Second, time.Millisecond)
+	s.flush(ctx)
+	assert.Equal(t, opaque([]uint32{0x0000ff, 0x00ff00, 0xff0000, 0xffffff}), b.dev.States())
+
+	now = now.Add(time.Hour)
+	s.flush(ctx)
+	assert.False(t, active())
+	assert.Equal(t, solid(0, 4), b.dev.States())
+	require.Equal(t, 0, remoteSet(lb.On, true))
+	assert.Equal(t, opaque(solid(red, 4)), b.dev.States())
+
+	// frames that can't be written are dropped, so every frame received is
+	// either forwarded or dropped
+	b.dev.SetFaults(wnptest.Faults{ErrorRate: 1})
+	send(2, 0, frame)
+	require.Eventually(t, active, time.Second, time.Millisecond)
+	s.flush(ctx)
+	b.dev.SetFaults(wnptest.Faults{})
+
+	assert.Equal(t, received+4, opcFrameCount(t, "received"))
+	assert.Equal(t, forwarded+2, opcFrameCount(t, "forwarded"))
+	assert.Equal(t, dropped+2, opcFrameCount(t, "dropped"))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// pattern is a multi-color frame that HomeKit color changes are applied
+// relative to, rather than replacing it with a solid color
+type pattern struct {
+	frame []colorful.Color
+	// hue (degrees), sat and val (0-1) are the HomeKit color at which the
+	// frame is shown as it is
+	hue, sat, val float64
+}
+
+// capturePattern makes a pattern from a frame set by other means (e.g.
+// E1.31), to be shown as it is at the HomeKit color c. Solid frames aren't
+// patterns, and patterns can't be scaled from zero brightness, so nil is
+// returned for them.
+func capturePattern(frame []colorful.Color, c *homeKitColor) *pattern {
+	if uniformFrame(frame) || c == nil || c.bri <= 0 {
+		return nil
+	}
+
+	return &pattern{frame: frame, hue: c.hue, sat: c.sat / 100, val: float64(c.bri) / 100}
+}
+
+// at renders the pattern for the given HomeKit hue (degrees), saturation and
+// brightness (percent). The pattern's hues are rotated, and its saturation
+// and value are scaled, by the difference from the pattern's own color.
+func (p *pattern) at(hue, sat float64, bri int) []colorful.Color {
+	dHue := hue - p.hue
+	satScale := 1.0
+	if p.sat > 0 {
+		satScale = sat / 100 / p.sat
+	}
+	valScale := float64(bri) / 100 / p.val
+
+	frame := make([]colorful.Color, len(p.frame))
+	for i, c := range p.frame {
+		h, s, v := c.Hsv()
+		frame[i] = colorful.Hsv(math.Mod(h+dHue+360, 360), math.Min(s*satScale, 1), math.Min(v*valScale, 1))
+	}
+	return frame
+}
+
+// uniformFrame reports whether every pixel in the frame is the same color, as
+// the device sees it
+func uniformFrame(frame []colorful.Color) bool {
+	for _, c := range frame {
+		if colorToUint32(c) != colorToUint32(frame[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalFrames reports whether two frames are the same, as the device sees
+// them
+func equalFrames(a, b []colorful.Color) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if colorToUint32(a[i]) != colorToUint32(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// patternState tracks the pattern the strip is displaying, if any. Fills are
+// kept in palette mode, and with preserve set, any multi-color frame is kept.
+// Otherwise HomeKit color changes replace the pattern with a solid color.
+type patternState struct {
+	current *pattern
+	// fill is the fill the current pattern was rendered from, if any
+	fill *fillSpec
+	// shown is the frame most recently rendered from the current pattern,
+	// so that changes made to the strip by other means can be noticed
+	shown []colorful.Color
+	// color is the HomeKit color most recently shown on the strip, which
+	// patterns set by other means are taken to be shown at
+	color       *homeKitColor
+	paletteMode bool
+	preserve    bool
+	mu          sync.Mutex
+}
+
+// homeKitColor is a HomeKit hue (degrees), saturation and brightness
+// (percent)
+type homeKitColor struct {
+	hue, sat float64
+	bri      int
+}
+
+// get returns the pattern that HomeKit color changes should be applied to,
+// given the frame the strip shows when it's on, or nil when the strip should
+// be set to a solid color
+func (s *patternState) get(onState []colorful.Color) *pattern {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the strip has been changed by something else since the pattern was
+	// shown, or fills aren't kept. A pattern dimmed to black isn't kept as
+	// the strip's on state, so that can't tell whether it's been changed -
+	// it's kept, so brightening it again restores it.
+	changed := lit(s.shown) && !equalFrames(onState, s.shown)
+	if s.current != nil && (changed || (!s.paletteMode && !s.preserve)) {
+		s.current, s.fill, s.shown = nil, nil, nil
+	}
+
+	// the pattern is kept at the color HomeKit shows, so that only the
+	// characteristic being changed affects it
+	if s.current == nil && s.preserve {
+		s.current = capturePattern(onState, s.color)
+	}
+
+	return s.current
+}
+
+// setColor records the HomeKit color shown on the strip
+func (s *patternState) setColor(hue, sat float64, bri int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.color = &homeKitColor{hue: hue, sat: sat, bri: bri}
+}
+
+// render renders the pattern for the given HomeKit color, remembering the
+// frame so later changes are still applied relative to the pattern
+func (s *patternState) render(p *pattern, hue, sat float64, bri int) []colorful.Color {
+	frame := p.at(hue, sat, bri)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shown = frame
+	return frame
+}
+
+// set records the pattern being shown, and the fill it was rendered from
+func (s *patternState) set(p *pattern, fill *fillSpec, shown []colorful.Color) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current, s.fill, s.shown = p, fill, shown
+}
+
+// fillSpec returns the spec of the fill being displayed, or nil
+func (s *patternState) fillSpec() *fillSpec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fill
+}
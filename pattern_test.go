@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func frameOf(u ...uint32) []colorful.Color {
+	frame := make([]colorful.Color, len(u))
+	for i, c := range u {
+		frame[i] = uint32ToColor(c)
+	}
+	return frame
+}
+
+func TestCapturePattern(t *testing.T) {
+	c := &homeKitColor{hue: 120, sat: 50, bri: 80}
+
+	assert.Nil(t, capturePattern(nil, c))
+	assert.Nil(t, capturePattern(frameOf(red, red), c))
+	assert.Nil(t, capturePattern(frameOf(red, green), nil))
+	assert.Nil(t, capturePattern(frameOf(red, green), &homeKitColor{}))
+
+	p := capturePattern(frameOf(red, green), c)
+	require.NotNil(t, p)
+	assert.Equal(t, &pattern{frame: frameOf(red, green), hue: 120, sat: 0.5, val: 0.8}, p)
+}
+
+func TestPatternAt(t *testing.T) {
+	p := &pattern{frame: frameOf(red, green, 0x0000ff, 0), hue: 0, sat: 1, val: 1}
+
+	assert.Equal(t, opaque([]uint32{red, green, 0x0000ff, 0}), colorsToUint32(p.at(0, 100, 100)))
+	assert.Equal(t, opaque([]uint32{0x800000, 0x008000, 0x000080, 0}), colorsToUint32(p.at(0, 100, 50)))
+	assert.Equal(t, opaque([]uint32{green, 0x0000ff, red, 0}), colorsToUint32(p.at(120, 100, 100)))
+	assert.Equal(t, opaque([]uint32{0x808080, 0x808080, 0x808080, 0}), colorsToUint32(p.at(0, 0, 50)))
+
+	// values are capped when brightening past the pattern's own
+	p.val = 0.5
+	assert.Equal(t, opaque([]uint32{red, green, 0x0000ff, 0}), colorsToUint32(p.at(0, 100, 100)))
+}
+
+func TestPreservePatterns(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+	b.strip.pattern.preserve = true
+
+	// a pattern set by other means, e.g. E1.31
+	require.NoError(t, b.strip.setState(context.Background(), frameOf(red, green, 0x0000ff, 0)))
+
+	require.Equal(t, 0, remoteSet(lb.Brightness, 50))
+	assert.Equal(t, opaque([]uint32{0x800000, 0x008000, 0x000080, 0}), b.dev.States())
+	assert.Contains(t, b.spanNames(), "updateColor")
+
+	// dimming is relative to the original pattern, so nothing's lost
+	require.Equal(t, 0, remoteSet(lb.Brightness, 1))
+	require.Equal(t, 0, remoteSet(lb.Brightness, 100))
+	assert.Equal(t, opaque([]uint32{red, green, 0x0000ff, 0}), b.dev.States())
+
+	// dimming all the way to black and back keeps the pattern too
+	require.Equal(t, 0, remoteSet(lb.Brightness, 0))
+	assert.Equal(t, opaque(solid(0, 4)), b.dev.States())
+	require.Equal(t, 0, remoteSet(lb.Brightness, 50))
+	assert.Equal(t, opaque([]uint32{0x800000, 0x008000, 0x000080, 0}), b.dev.States())
+	require.Equal(t, 0, remoteSet(lb.Brightness, 100))
+
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	assert.Equal(t, opaque([]uint32{green, 0x0000ff, red, 0}), b.dev.States())
+
+	// the pattern survives the light being turned off and on
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	require.Equal(t, 0, remoteSet(lb.On, true))
+	require.Equal(t, 0, remoteSet(lb.Hue, 0.0))
+	assert.Equal(t, opaque([]uint32{red, green, 0x0000ff, 0}), b.dev.States())
+
+	// a new pattern replaces it - and although it doesn't match HomeKit's
+	// red, it's only dimmed, as brightness is all that's changed
+	require.NoError(t, b.strip.setState(context.Background(), frameOf(0x0000ff, 0xffffff, 0x0000ff, 0xffffff)))
+	require.Equal(t, 0, remoteSet(lb.Brightness, 50))
+	assert.Equal(t, opaque([]uint32{0x000080, 0x808080, 0x000080, 0x808080}), b.dev.States())
+
+	// solid colors are still changed as before
+	require.NoError(t, b.strip.setSolid(context.Background(), uint32ToColor(red)))
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	assert.Equal(t, opaque(solid(0x008000, 4)), b.dev.States())
+
+	// and without preserve, patterns are replaced
+	b.strip.pattern.preserve = false
+	require.NoError(t, b.strip.setState(context.Background(), frameOf(red, green, 0x0000ff, 0)))
+	require.Equal(t, 0, remoteSet(lb.Brightness, 100))
+	assert.Equal(t, opaque(solid(green, 4)), b.dev.States())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ledCurrent is the current drawn by each of a pixel's channels at full
+// brightness, in milliamps. Typical WS2812B LEDs draw about 20mA per channel.
+type ledCurrent struct {
+	red, green, blue float64
+}
+
+var defaultLEDCurrent = ledCurrent{red: 20, green: 20, blue: 20}
+
+// defaultLEDVoltage is the usual supply voltage for WS2812B strips
+const defaultLEDVoltage = 5.0
+
+// frameCurrent estimates the current a frame draws, in milliamps. The
+// channels are PWM-driven, so each draws current in proportion to its 8-bit
+// value.
+func (l ledCurrent) frameCurrent(frame []colorful.Color) float64 {
+	total := 0.0
+	for _, c := range frame {
+		c = c.Clamped()
+		total += c.R*l.red + c.G*l.green + c.B*l.blue
+	}
+	return total
+}
+
+// powerLimiter scales frames down to keep the strip's estimated current
+// under a budget, so that bright frames don't overload the power supply
+type powerLimiter struct {
+	led ledCurrent
+	// maxCurrent is the budget in milliamps - 0 means unlimited
+	maxCurrent float64
+}
+
+// limit returns the frame scaled to fit the budget, and the scale factor
+// applied (1 when the frame already fits). The frame itself isn't modified.
+func (p powerLimiter) limit(frame []colorful.Color) ([]colorful.Color, float64) {
+	if p.maxCurrent <= 0 {
+		return frame, 1
+	}
+
+	current := p.led.frameCurrent(frame)
+	if current <= p.maxCurrent {
+		return frame, 1
+	}
+
+	scale := p.maxCurrent / current
+	out := make([]colorful.Color, len(frame))
+	for i, c := range frame {
+		c = c.Clamped()
+		out[i] = colorful.Color{R: c.R * scale, G: c.G * scale, B: c.B * scale}
+	}
+
+	return out, scale
+}
+
+// limitFrame applies the strip's power limit to a frame that's about to be
+// written, recording whether it had to be scaled
+func (w *wifineopixel) limitFrame(ctx context.Context, frame []colorful.Color) []colorful.Color {
+	out, scale := w.power.limit(frame)
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.Float64("power.estimated_ma", w.power.led.frameCurrent(frame)),
+		attribute.Bool("power.limited", scale < 1),
+	)
+	if scale < 1 {
+		span.SetAttributes(attribute.Float64("power.scale", scale))
+		observePowerLimited()
+	}
+	observePowerScale(scale)
+
+	return out
+}
+
+// powerMeter estimates a strip's power draw from the frames it displays,
+// and accumulates its energy use
+type powerMeter struct {
+	now func() time.Time
+	// last is when the power draw last changed
+	last   time.Time
+	device string
+	led    ledCurrent
+	// voltage is the strip's supply voltage
+	voltage float64
+	watts   float64
+	mu      sync.Mutex
+}
+
+func newPowerMeter(device string, led ledCurrent, voltage float64) *powerMeter {
+	return &powerMeter{device: device, led: led, voltage: voltage, now: time.Now}
+}
+
+// observe records that the strip is now displaying frame. The energy used
+// since the last observation is accounted for at the previous frame's power.
+func (m *powerMeter) observe(frame []colorful.Color) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if !m.last.IsZero() {
+		observeEnergy(m.device, m.watts*now.Sub(m.last).Hours())
+	}
+
+	m.last = now
+	m.watts = m.led.frameCurrent(frame) / 1000 * m.voltage
+	observePower(m.device, m.watts)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameCurrent(t *testing.T) {
+	l := ledCurrent{red: 20, green: 15, blue: 10}
+
+	assert.Equal(t, 0.0, l.frameCurrent(nil))
+	assert.Equal(t, 45.0, l.frameCurrent([]colorful.Color{{R: 1, G: 1, B: 1}}))
+	assert.Equal(t, 10.0+15.0, l.frameCurrent([]colorful.Color{{R: 0.5}, {G: 1}}))
+	// out-of-gamut colors are clamped
+	assert.Equal(t, 20.0, l.frameCurrent([]colorful.Color{{R: 2, G: -1}}))
+}
+
+func TestPowerLimiter(t *testing.T) {
+	white := []colorful.Color{{R: 1, G: 1, B: 1}, {R: 1, G: 1, B: 1}}
+
+	// unlimited
+	p := powerLimiter{led: defaultLEDCurrent}
+	out, scale := p.limit(white)
+	assert.Equal(t, white, out)
+	assert.Equal(t, 1.0, scale)
+
+	// within budget
+	p.maxCurrent = 120
+	out, scale = p.limit(white)
+	assert.Equal(t, white, out)
+	assert.Equal(t, 1.0, scale)
+
+	p.maxCurrent = 60
+	out, scale = p.limit(white)
+	assert.Equal(t, 0.5, scale)
+	assert.Equal(t, []colorful.Color{{R: 0.5, G: 0.5, B: 0.5}, {R: 0.5, G: 0.5, B: 0.5}}, out)
+	assert.InDelta(t, 60, p.led.frameCurrent(out), 0.001)
+	// the original frame is untouched
+	assert.Equal(t, 1.0, white[0].R)
+}
+
+func TestPowerLimitedWrites(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	limited := func() float64 {
+		m := &dto.Metric{}
+		require.NoError(t, powerLimitedFrames.Write(m))
+		return m.GetCounter().GetValue()
+	}
+	count := limited()
+
+	// four red pixels draw 80mA, so a 40mA budget halves them
+	b.strip.power.maxCurrent = 40
+
+	require.Equal(t, 0, remoteSet(lb.Brightness, 100))
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	assert.Equal(t, opaque(solid(0x008000, 4)), b.dev.States())
+	assert.Equal(t, count+1, limited())
+
+	// the requested frame is kept, so it can be restored in full once the
+	// budget allows
+	assert.Equal(t, opaque(solid(green, 4)), colorsToUint32(b.strip.state))
+
+	var attrs []string
+	for _, s := range b.spans.Ended() {
+		if s.Name() != "setState" {
+			continue
+		}
+		for _, a := range s.Attributes() {
+			attrs = append(attrs, string(a.Key))
+		}
+	}
+	assert.Contains(t, attrs, "power.limited")
+	assert.Contains(t, attrs, "power.scale")
+
+	// turning the strip off and on restores the requested frame, limited
+	// again, rather than compounding the limit
+	for i := 0; i < 2; i++ {
+		require.Equal(t, 0, remoteSet(lb.On, false))
+		require.Equal(t, 0, remoteSet(lb.On, true))
+	}
+	assert.Equal(t, opaque(solid(0x008000, 4)), b.dev.States())
+	assert.Equal(t, opaque(solid(green, 4)), colorsToUint32(b.strip.state))
+	assert.Equal(t, opaque(solid(green, 4)), colorsToUint32(b.strip.onState))
+	count = limited()
+
+	// frames within the budget are left alone
+	require.Equal(t, 0, remoteSet(lb.Brightness, 50))
+	assert.Equal(t, opaque(solid(0x008000, 4)), b.dev.States())
+	assert.Equal(t, count, limited())
+}
+
+func powerReadings(t *testing.T, device string) (watts, wh float64) {
+	t.Helper()
+
+	l := prometheus.Labels{"device": device}
+	m := &dto.Metric{}
+	require.NoError(t, powerWatts.With(l).Write(m))
+	watts = m.GetGauge().GetValue()
+
+	m = &dto.Metric{}
+	require.NoError(t, energyWattHours.With(l).Write(m))
+	return watts, m.GetCounter().GetValue()
+}
+
+func TestPowerMeter(t *testing.T) {
+	initMetricsOnce.Do(initMetrics)
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	m := newPowerMeter("meter-test", ledCurrent{red: 20, green: 20, blue: 20}, 5)
+	m.now = func() time.Time { return now }
+
+	// 2 white pixels draw 120mA, or 0.6W at 5V
+	m.observe([]colorful.Color{{R: 1, G: 1, B: 1}, {R: 1, G: 1, B: 1}})
+	watts, wh := powerReadings(t, "meter-test")
+	assert.InDelta(t, 0.6, watts, 0.0001)
+	assert.Equal(t, 0.0, wh)
+
+	now = now.Add(2 * time.Hour)
+	m.observe([]colorful.Color{{R: 1}, {}})
+	watts, wh = powerReadings(t, "meter-test")
+	assert.InDelta(t, 0.1, watts, 0.0001)
+	assert.InDelta(t, 1.2, wh, 0.0001)
+
+	now = now.Add(30 * time.Minute)
+	m.observe([]colorful.Color{{}, {}})
+	watts, wh = powerReadings(t, "meter-test")
+	assert.Equal(t, 0.0, watts)
+	assert.InDelta(t, 1.25, wh, 0.0001)
+}
+
+func TestPowerMeterWrites(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+	b.strip.meter = newPowerMeter("bridge-test", defaultLEDCurrent, defaultLEDVoltage)
+	b.strip.power.maxCurrent = 40
+
+	// the limited frame is what's measured
+	require.Equal(t, 0, remoteSet(lb.Hue, 120.0))
+	watts, _ := powerReadings(t, "bridge-test")
+	assert.InDelta(t, 0.2, watts, 0.01)
+
+	// polling updates it too
+	b.dev.SetStates(solid(0xffffff, 4))
+	_, status := lb.On.ValueRequest(nil)
+	require.Equal(t, 0, status)
+	watts, wh := powerReadings(t, "bridge-test")
+	assert.InDelta(t, 1.2, watts, 0.01)
+	assert.Greater(t, wh, 0.0)
+}
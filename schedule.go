@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"gopkg.in/yaml.v3"
+)
+
+// scheduleTransitionStep is how often the strip is updated during a
+// scheduled transition
+var scheduleTransitionStep = time.Second
+
+// scheduleConfig is the scheduler's configuration file, e.g.:
+//
+//	latitude: 45.50
+//	longitude: -73.57
+//	entries:
+//	  - name: dusk
+//	    sun: sunset
+//	    offset: -15m
+//	    on: true
+//	    color: "#ffb060"
+//	    brightness: 60
+//	    transition: 10m
+//	  - name: party
+//	    cron: "0 20 * * 6"
+//	    fill:
+//	      colors: ["#ff4000", "#ff00a0", "#4000ff"]
+//	  - name: midnight
+//	    cron: "0 0 * * *"
+//	    on: false
+type scheduleConfig struct {
+	Latitude  *float64         `yaml:"latitude"`
+	Longitude *float64         `yaml:"longitude"`
+	Entries   []*scheduleEntry `yaml:"entries"`
+}
+
+// scheduleEntry is something to do to the light at certain times - either on
+// a cron schedule (evaluated in the local time zone), or at an offset from
+// sunrise or sunset
+type scheduleEntry struct {
+	schedule cron.Schedule
+	hue, sat *float64
+	fill     *fill
+
+	On     *bool  `yaml:"on"`
+	Bright *int   `yaml:"brightness"`
+	Name   string `yaml:"name"`
+	Cron   string `yaml:"cron"`
+	// Sun is either "sunrise" or "sunset"
+	Sun string `yaml:"sun"`
+	// Color is a hex RGB color, e.g. "#ff8800"
+	Color  string        `yaml:"color"`
+	Offset time.Duration `yaml:"offset"`
+	// Transition is how long to take to change color and brightness
+	Transition time.Duration `yaml:"transition"`
+	// Fill is a gradient or palette to show instead of a color
+	Fill *fillSpec `yaml:"fill"`
+}
+
+// loadSchedule reads and validates the scheduler's configuration file
+func loadSchedule(path string) (*scheduleConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule: %w", err)
+	}
+
+	return parseSchedule(b)
+}
+
+func parseSchedule(b []byte) (*scheduleConfig, error) {
+	cfg := &scheduleConfig{}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse schedule: %w", err)
+	}
+
+	for i, e := range cfg.Entries {
+		if e.Name == "" {
+			e.Name = fmt.Sprintf("entry %d", i+1)
+		}
+		if err := e.init(); err != nil {
+			return nil, fmt.Errorf("invalid schedule entry %q: %w", e.Name, err)
+		}
+		if e.Sun != "" && (cfg.Latitude == nil || cfg.Longitude == nil) {
+			return nil, fmt.Errorf("invalid schedule entry %q: latitude and longitude are needed for sunrise and sunset times", e.Name)
+		}
+	}
+
+	return cfg, nil
+}
+
+// init validates the entry, and parses its schedule and color
+func (e *scheduleEntry) init() error {
+	if err := e.initTrigger(); err != nil {
+		return err
+	}
+
+	if e.On == nil && e.Color == "" && e.Bright == nil && e.Fill == nil {
+		return errors.New("at least one of on, color, brightness or fill must be set")
+	}
+
+	if err := e.initFill(); err != nil {
+		return err
+	}
+	if err := e.initColor(); err != nil {
+		return err
+	}
+
+	return e.validateBrightness()
+}
+
+// initTrigger validates when the entry runs, and parses its cron schedule
+func (e *scheduleEntry) initTrigger() error {
+	switch {
+	case e.Cron != "" && e.Sun != "":
+		return errors.New("only one of cron or sun can be set")
+	case e.Cron != "":
+		s, err := cron.ParseStandard(e.Cron)
+		if err != nil {
+			return err
+		}
+		e.schedule = s
+	case e.Sun == "sunrise", e.Sun == "sunset":
+	case e.Sun != "":
+		return fmt.Errorf("sun must be sunrise or sunset, not %q", e.Sun)
+	default:
+		return errors.New("one of cron or sun must be set")
+	}
+
+	if e.Offset != 0 && e.Sun == "" {
+		return errors.New("offset can only be used with sun")
+	}
+	return nil
+}
+
+// initFill validates and parses the entry's fill, if it has one
+func (e *scheduleEntry) initFill() error {
+	if e.Fill == nil {
+		return nil
+	}
+	if e.Color != "" || e.Transition != 0 {
+		return errors.New("fill can't be used with color or transition")
+	}
+	f, err := e.Fill.parse()
+	if err != nil {
+		return fmt.Errorf("invalid fill: %w", err)
+	}
+	e.fill = f
+	return nil
+}
+
+func (e *scheduleEntry) validateBrightness() error {
+	if e.Bright != nil && (*e.Bright < 0 || *e.Bright > 100) {
+		return fmt.Errorf("brightness must be between 0 and 100, not %d", *e.Bright)
+	}
+	return nil
+}
+
+// initColor parses the entry's color, if it has one, as a HomeKit hue and
+// saturation
+func (e *scheduleEntry) initColor() error {
+	if e.Color == "" {
+		return nil
+	}
+	c, err := colorful.Hex(e.Color)
+	if err != nil {
+		return fmt.Errorf("invalid color: %w", err)
+	}
+	h, s, _ := c.Hsv()
+	s *= 100
+	e.hue, e.sat = &h, &s
+	return nil
+}
+
+// next returns the first time after t that the entry should run, or false if
+// there isn't one (e.g. the sun won't set again for longer than the next
+// year)
+func (e *scheduleEntry) next(t time.Time, lat, lon float64) (time.Time, bool) {
+	if e.schedule != nil {
+		n := e.schedule.Next(t)
+		return n, !n.IsZero()
+	}
+
+	// start from the day before, in case the offset pushes the time into
+	// the next day
+	y, m, d := t.Date()
+	for i := -1; i <= 366; i++ {
+		day := time.Date(y, m, d+i, 12, 0, 0, 0, t.Location())
+		rise, set, ok := sunTimes(day, lat, lon)
+		if !ok {
+			continue
+		}
+
+		at := set
+		if e.Sun == "sunrise" {
+			at = rise
+		}
+		at = at.Add(e.Offset)
+
+		if at.After(t) {
+			return at, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// scheduler changes the light at scheduled times, without needing a HomeKit
+// home hub. Changes are written to the lightbulb's characteristics the same
+// way a HomeKit controller's are, so the strip is updated by the same
+// responders, and paired controllers are notified.
+type scheduler struct {
+	lb *service.ColoredLightbulb
+	// strip is only used directly to show fills, which HomeKit has no
+	// characteristics for
+	strip *wifineopixel
+	cfg   *scheduleConfig
+	now   func() time.Time
+	// cancel stops the transition in progress, so that a later entry
+	// doesn't have to wait for it
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+func newScheduler(lb *service.ColoredLightbulb, strip *wifineopixel, cfg *scheduleConfig) *scheduler {
+	return &scheduler{lb: lb, strip: strip, cfg: cfg, now: time.Now}
+}
+
+func (s *scheduler) location() (lat, lon float64) {
+	if s.cfg.Latitude != nil && s.cfg.Longitude != nil {
+		return *s.cfg.Latitude, *s.cfg.Longitude
+	}
+	return 0, 0
+}
+
+// next returns the next entries due, all of which are due at the same time
+func (s *scheduler) next(t time.Time) (at time.Time, due []*scheduleEntry) {
+	lat, lon := s.location()
+	for _, e := range s.cfg.Entries {
+		n, ok := e.next(t, lat, lon)
+		switch {
+		case !ok:
+		case at.IsZero() || n.Before(at):
+			at, due = n, []*scheduleEntry{e}
+		case n.Equal(at):
+			due = append(due, e)
+		}
+	}
+	return at, due
+}
+
+// run applies entries as they become due, until ctx is cancelled
+func (s *scheduler) run(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+
+	for {
+		at, due := s.next(s.now())
+		if len(due) == 0 {
+			log.Warn().Msg("no scheduled entries will run again")
+			return
+		}
+
+		log.Debug().Time("at", at).Str("entry", due[0].Name).Msg("waiting for next scheduled entry")
+
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.start(ctx, due...)
+	}
+}
+
+// start applies the entries in the background, interrupting any transition
+// that's still in progress
+func (s *scheduler) start(ctx context.Context, entries ...*scheduleEntry) {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		for _, e := range entries {
+			if err := s.apply(ctx, e); err != nil {
+				zerolog.Ctx(ctx).Error().Err(err).Str("entry", e.Name).Msg("scheduled entry failed")
+			}
+		}
+	}()
+}
+
+// apply changes the light as described by the entry. A light being turned
+// on is turned on before the transition, and one being turned off is turned
+// off after it.
+func (s *scheduler) apply(ctx context.Context, e *scheduleEntry) error {
+	ctx, span := otel.Tracer("").Start(ctx, "scheduler.apply")
+	defer span.End()
+	span.SetAttributes(attribute.String("entry", e.Name))
+
+	zerolog.Ctx(ctx).Info().Str("entry", e.Name).Msg("running scheduled entry")
+
+	err := s.applyEntry(ctx, e)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func (s *scheduler) applyEntry(ctx context.Context, e *scheduleEntry) error {
+	lb := s.lb
+
+	if e.On != nil && *e.On {
+		if err := remoteWrite(ctx, lb.On.C, true); err != nil {
+			return err
+		}
+	}
+
+	if e.fill != nil {
+		if e.Bright != nil {
+			_ = lb.Brightness.SetValue(*e.Bright)
+		}
+		if err := applyFill(ctx, lb, s.strip, e.fill); err != nil {
+			return err
+		}
+	} else if err := s.transition(ctx, e); err != nil {
+		return err
+	}
+
+	if e.On != nil && !*e.On {
+		return remoteWrite(ctx, lb.On.C, false)
+	}
+
+	return nil
+}
+
+// transition changes the color and brightness, gradually if the entry has a
+// transition
+func (s *scheduler) transition(ctx context.Context, e *scheduleEntry) error {
+	lb := s.lb
+
+	hue, sat, bri := lb.Hue.Value(), lb.Saturation.Value(), lb.Brightness.Value()
+	toHue, toSat, toBri := hue, sat, bri
+	if e.hue != nil {
+		toHue, toSat = *e.hue, *e.sat
+	}
+	if e.Bright != nil {
+		toBri = *e.Bright
+	}
+
+	// take the short way around the hue circle
+	dHue := math.Mod(toHue-hue+540, 360) - 180
+
+	steps := 1
+	if e.Transition > 0 && lb.On.Value() {
+		steps = max(int(e.Transition/scheduleTransitionStep), 1)
+	}
+
+	tick := time.NewTicker(scheduleTransitionStep)
+	defer tick.Stop()
+
+	for i := 1; i <= steps; i++ {
+		if i > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick.C:
+			}
+		}
+
+		p := float64(i) / float64(steps)
+		h := math.Mod(hue+dHue*p+360, 360)
+		sv := sat + (toSat-sat)*p
+		b := int(math.Round(float64(bri) + float64(toBri-bri)*p))
+
+		if err := s.setColor(ctx, h, sv, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setColor writes whichever of hue, saturation and brightness have changed
+func (s *scheduler) setColor(ctx context.Context, hue, sat float64, bri int) error {
+	lb := s.lb
+	if hue != lb.Hue.Value() {
+		if err := remoteWrite(ctx, lb.Hue.C, hue); err != nil {
+			return err
+		}
+	}
+	if sat != lb.Saturation.Value() {
+		if err := remoteWrite(ctx, lb.Saturation.C, sat); err != nil {
+			return err
+		}
+	}
+	if bri != lb.Brightness.Value() {
+		if err := remoteWrite(ctx, lb.Brightness.C, bri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteWrite writes v to the characteristic as if a HomeKit controller had
+// written it, so the write is handled by the characteristic's responders
+func remoteWrite(ctx context.Context, c *characteristic.C, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "/characteristics", nil)
+	if err != nil {
+		return err
+	}
+
+	if _, status := c.SetValueRequest(v, req); status != 0 {
+		return fmt.Errorf("failed to set %s to %v: HAP status %d", c.Type, v, status)
+	}
+	return nil
+}
+
+// scheduleStatus describes a schedule entry, for the API
+type scheduleStatus struct {
+	Next       *time.Time `json:"next,omitempty"`
+	On         *bool      `json:"on,omitempty"`
+	Brightness *int       `json:"brightness,omitempty"`
+	Name       string     `json:"name"`
+	Cron       string     `json:"cron,omitempty"`
+	Sun        string     `json:"sun,omitempty"`
+	Offset     string     `json:"offset,omitempty"`
+	Color      string     `json:"color,omitempty"`
+	Transition string     `json:"transition,omitempty"`
+}
+
+// ServeHTTP lists the schedule's entries as JSON, in the order they'll next
+// run
+func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, span := otel.Tracer("").Start(r.Context(), "scheduler.list")
+	defer span.End()
+
+	now := s.now()
+	lat, lon := s.location()
+
+	entries := make([]scheduleStatus, 0, len(s.cfg.Entries))
+	for _, e := range s.cfg.Entries {
+		st := scheduleStatus{
+			Name:       e.Name,
+			Cron:       e.Cron,
+			Sun:        e.Sun,
+			On:         e.On,
+			Color:      e.Color,
+			Brightness: e.Bright,
+		}
+		if e.Offset != 0 {
+			st.Offset = e.Offset.String()
+		}
+		if e.Transition != 0 {
+			st.Transition = e.Transition.String()
+		}
+		if n, ok := e.next(now, lat, lon); ok {
+			st.Next = &n
+		}
+		entries = append(entries, st)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].Next, entries[j].Next
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return a.Before(*b)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		span.RecordError(err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hairyhenderson/wnp-bridge/wnptest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSchedule = `
+latitude: 51.5074
+longitude: -0.1278
+entries:
+  - name: dusk
+    sun: sunset
+    offset: -15m
+    on: true
+    color: "#00ff00"
+    brightness: 50
+    transition: 10m
+  - name: midnight
+    cron: "0 0 * * *"
+    on: false
+  - cron: "30 6 * * 1-5"
+    brightness: 100
+`
+
+func TestParseSchedule(t *testing.T) {
+	cfg, err := parseSchedule([]byte(testSchedule))
+	require.NoError(t, err)
+	require.Len(t, cfg.Entries, 3)
+
+	dusk := cfg.Entries[0]
+	assert.Equal(t, "dusk", dusk.Name)
+	assert.Equal(t, -15*time.Minute, dusk.Offset)
+	assert.Equal(t, 10*time.Minute, dusk.Transition)
+	assert.True(t, *dusk.On)
+	assert.Equal(t, 120.0, *dusk.hue)
+	assert.Equal(t, 100.0, *dusk.sat)
+	assert.Equal(t, 50, *dusk.Bright)
+
+	assert.False(t, *cfg.Entries[1].On)
+	assert.Equal(t, "entry 3", cfg.Entries[2].Name)
+
+	testdata := []string{
+		`entries: [{cron: "0 0 * * *"}]`,
+		`entries: [{on: true}]`,
+		`entries: [{cron: "0 0 * * *", sun: sunset, on: true}]`,
+		`entries: [{cron: "0 0 * *", on: true}]`,
+		`entries: [{cron: "0 0 * * *", offset: 1h, on: true}]`,
+		`entries: [{sun: noon, on: true}]`,
+		`entries: [{sun: sunset, on: true}]`,
+		`entries: [{cron: "0 0 * * *", color: orange}]`,
+		`entries: [{cron: "0 0 * * *", brightness: 101}]`,
+		`entries: [{cron: "0 0 * * *", transition: soon, on: true}]`,
+		`entries: [{cron: "0 0 * * *", fill: {colors: []}}]`,
+		`entries: [{cron: "0 0 * * *", color: "#ff0000", fill: {colors: ["#00ff00"]}}]`,
+	}
+	for _, d := range testdata {
+		_, err := parseSchedule([]byte(d))
+		assert.Error(t, err, d)
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	cfg, err := parseSchedule([]byte(testSchedule))
+	require.NoError(t, err)
+	s := newScheduler(nil, nil, cfg)
+
+	// a Friday afternoon
+	now := time.Date(2024, 6, 21, 15, 0, 0, 0, time.UTC)
+	at, due := s.next(now)
+	require.Len(t, due, 1)
+	assert.Equal(t, "dusk", due[0].Name)
+	assert.WithinDuration(t, time.Date(2024, 6, 21, 20, 6, 0, 0, time.UTC), at, 2*time.Minute)
+
+	at, due = s.next(at)
+	require.Len(t, due, 1)
+	assert.Equal(t, "midnight", due[0].Name)
+	assert.Equal(t, time.Date(2024, 6, 22, 0, 0, 0, 0, time.UTC), at)
+
+	// the weekday entry is skipped on the weekend
+	at, due = s.next(at)
+	require.Len(t, due, 1)
+	assert.Equal(t, "dusk", due[0].Name)
+	assert.Equal(t, 22, at.Day())
+
+	at, due = s.next(time.Date(2024, 6, 24, 1, 0, 0, 0, time.UTC))
+	require.Len(t, due, 1)
+	assert.Equal(t, "entry 3", due[0].Name)
+	assert.Equal(t, time.Date(2024, 6, 24, 6, 30, 0, 0, time.UTC), at)
+
+	// an offset can push the time into the next day
+	e := &scheduleEntry{Sun: "sunset", Offset: 5 * time.Hour, On: new(bool)}
+	require.NoError(t, e.init())
+	at, ok := e.next(time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC), 51.5074, -0.1278)
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Date(2024, 6, 21, 1, 21, 0, 0, time.UTC).AddDate(0, 0, 1), at, 2*time.Minute)
+
+	// in Tromsø, the sun doesn't set again until late July
+	at, ok = e.next(time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC), 69.65, 18.96)
+	require.True(t, ok)
+	assert.Equal(t, time.July, at.Month())
+}
+
+func TestSchedulerApply(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+	ctx := context.Background()
+
+	cfg, err := parseSchedule([]byte(testSchedule))
+	require.NoError(t, err)
+	s := newScheduler(lb, b.strip, cfg)
+
+	// without a transition, the change is made at once
+	bright := &scheduleEntry{Cron: "@daily", Bright: new(int)}
+	*bright.Bright = 50
+	require.NoError(t, bright.init())
+	require.NoError(t, s.apply(ctx, bright))
+	assert.Equal(t, 50, lb.Brightness.Value())
+	assert.Equal(t, [][]uint32{opaque(solid(0x800000, 4))}, b.rawPayloads(t))
+
+	// the midnight entry turns the light off
+	b.dev.ResetRequests()
+	require.NoError(t, s.apply(ctx, cfg.Entries[1]))
+	assert.False(t, lb.On.Value())
+	assert.Equal(t, solid(0, 4), b.dev.States())
+
+	// dusk turns it on, then fades to green
+	orig := scheduleTransitionStep
+	scheduleTransitionStep = time.Millisecond
+	t.Cleanup(func() { scheduleTransitionStep = orig })
+
+	dusk := *cfg.Entries[0]
+	dusk.Transition = 4 * time.Millisecond
+	b.dev.ResetRequests()
+	require.NoError(t, s.apply(ctx, &dusk))
+	assert.True(t, lb.On.Value())
+	assert.Equal(t, 120.0, lb.Hue.Value())
+	assert.Equal(t, 100.0, lb.Saturation.Value())
+	assert.Equal(t, 50, lb.Brightness.Value())
+	assert.Equal(t, opaque(solid(0x008000, 4)), b.dev.States())
+
+	// the first payload is the strip being turned on, then the hue
+	// changes in 4 steps of 30°
+	payloads := b.rawPayloads(t)
+	require.Len(t, payloads, 5)
+	assert.Equal(t, opaque(solid(0x800000, 4)), payloads[0])
+	assert.Equal(t, opaque(solid(0x804000, 4)), payloads[1])
+
+	assert.Contains(t, b.spanNames(), "scheduler.apply")
+	assert.Contains(t, b.spanNames(), "lb.Hue.OnSetRemoteValue")
+
+	// a transition is interrupted when the context is cancelled
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	dusk.Color = "#0000ff"
+	require.NoError(t, dusk.init())
+	assert.ErrorIs(t, s.apply(ctx, &dusk), context.Canceled)
+
+	// failures are reported
+	b.dev.SetFaults(wnptest.Faults{ErrorRate: 1})
+	assert.Error(t, s.apply(context.Background(), cfg.Entries[1]))
+}
+
+func TestSchedulerFill(t *testing.T) {
+	b := setupBridge(t, solid(red, 4))
+	lb := b.acc.Lightbulb
+
+	cfg, err := parseSchedule([]byte(`entries: [{cron: "0 20 * * *", brightness: 50, fill: {space: rgb, colors: ["#ff0000", "#0000ff"]}}]`))
+	require.NoError(t, err)
+	s := newScheduler(lb, b.strip, cfg)
+
+	require.Equal(t, 0, remoteSet(lb.On, false))
+	b.dev.ResetRequests()
+
+	// the fill is shown at the entry's brightness, turning the light on
+	require.NoError(t, s.apply(context.Background(), cfg.Entries[0]))
+	assert.Equal(t, [][]uint32{opaque([]uint32{0x800000, 0x55002a, 0x2a0055, 0x000080})}, b.rawPayloads(t))
+	assert.True(t, lb.On.Value())
+	assert.Equal(t, 50, lb.Brightness.Value())
+	assert.NotNil(t, b.strip.pattern.fillSpec())
+}
+
+func TestScheduleAPI(t *testing.T) {
+	cfg, err := parseSchedule([]byte(testSchedule))
+	require.NoError(t, err)
+	s := newScheduler(nil, nil, cfg)
+	s.now = func() time.Time { return time.Date(2024, 6, 21, 15, 0, 0, 0, time.UTC) }
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/schedule", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	entries := []scheduleStatus{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&entries))
+	require.Len(t, entries, 3)
+
+	// listed in the order they'll run
+	assert.Equal(t, "dusk", entries[0].Name)
+	assert.Equal(t, "sunset", entries[0].Sun)
+	assert.Equal(t, "-15m0s", entries[0].Offset)
+	assert.Equal(t, "10m0s", entries[0].Transition)
+	assert.Equal(t, "#00ff00", entries[0].Color)
+	assert.Equal(t, "midnight", entries[1].Name)
+	assert.Equal(t, time.Date(2024, 6, 22, 0, 0, 0, 0, time.UTC), entries[1].Next.UTC())
+	assert.Equal(t, "entry 3", entries[2].Name)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/schedule", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/ipv4"
+)
+
+// ssdpGroup is the SSDP multicast group, which Hue apps send M-SEARCH
+// requests to when looking for bridges
+var ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// ssdpResponder answers SSDP searches for the emulated Hue bridge, pointing
+// to its UPnP description on the Hue API's port
+type ssdpResponder struct {
+	bridge *hueBridge
+	port   int
+}
+
+// listen answers SSDP searches received on addr (normally ":1900") until ctx
+// is cancelled, joining the SSDP multicast group
+func (s *ssdpResponder) listen(ctx context.Context, addr string) error {
+	log := zerolog.Ctx(ctx)
+
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SSDP: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := ipv4.NewPacketConn(conn).JoinGroup(nil, ssdpGroup); err != nil {
+		log.Error().Err(err).Msg("failed to join SSDP multicast group")
+	}
+
+	log.Info().Stringer("addr", conn.LocalAddr()).Msg("answering SSDP searches for the Hue bridge")
+
+	go s.serve(ctx, conn)
+
+	return nil
+}
+
+func (s *ssdpResponder) serve(ctx context.Context, conn net.PacketConn) {
+	log := zerolog.Ctx(ctx)
+
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Err(err).Msg("SSDP receive failed")
+			}
+			return
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil {
+			log.Debug().Err(err).Stringer("src", src).Msg("ignoring invalid SSDP packet")
+			continue
+		}
+
+		ip, err := localIPFor(src)
+		if err != nil {
+			log.Warn().Err(err).Stringer("src", src).Msg("can't answer SSDP search")
+			continue
+		}
+
+		for _, resp := range s.handle(req, ip) {
+			if _, err := conn.WriteTo(resp, src); err != nil {
+				log.Warn().Err(err).Stringer("src", src).Msg("failed to send SSDP response")
+			}
+		}
+	}
+}
+
+// handle returns the responses to an SSDP request, advertising the
+// description at the local address ip - none unless it's a search for the
+// bridge
+func (s *ssdpResponder) handle(req *http.Request, ip net.IP) [][]byte {
+	if req.Method != "M-SEARCH" || strings.Trim(req.Header.Get("MAN"), `"`) != "ssdp:discover" {
+		return nil
+	}
+
+	uuid := "uuid:" + s.bridge.uuid()
+
+	// responses to ssdp:all cover each of the bridge's search targets, as
+	// Hue bridges do
+	var targets []string
+	switch st := req.Header.Get("ST"); st {
+	case "ssdp:all":
+		targets = []string{"upnp:rootdevice", uuid, "urn:schemas-upnp-org:device:basic:1"}
+	case "upnp:rootdevice", uuid, "urn:schemas-upnp-org:device:basic:1":
+		targets = []string{st}
+	default:
+		return nil
+	}
+
+	location := fmt.Sprintf("http://%s/description.xml", net.JoinHostPort(ip.String(), fmt.Sprint(s.port)))
+
+	resps := make([][]byte, 0, len(targets))
+	for _, st := range targets {
+		usn := uuid
+		if st != uuid {
+			usn += "::" + st
+		}
+
+		resps = append(resps, []byte("HTTP/1.1 200 OK\r\n"+
+			"HOST: 239.255.255.250:1900\r\n"+
+			"EXT:\r\n"+
+			"CACHE-CONTROL: max-age=100\r\n"+
+			"LOCATION: "+location+"\r\n"+
+			"SERVER: Linux/3.14.0 UPnP/1.0 IpBridge/1.41.0\r\n"+
+			"hue-bridgeid: "+s.bridge.bridgeID()+"\r\n"+
+			"ST: "+st+"\r\n"+
+			"USN: "+usn+"\r\n\r\n"))
+	}
+	return resps
+}
+
+// localIPFor returns the local IP address that packets to addr are sent
+// from, which is the one the client can reach the bridge at
+func localIPFor(addr net.Addr) (net.IP, error) {
+	conn, err := net.Dial("udp4", addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to find local address: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mSearch(st string) string {
+	return "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 3\r\n" +
+		"ST: " + st + "\r\n\r\n"
+}
+
+func TestSSDPHandle(t *testing.T) {
+	s := &ssdpResponder{bridge: newHueBridge(nil, nil, nil, "test"), port: 8000}
+	ip := net.IPv4(192, 0, 2, 1)
+	uuid := "uuid:" + s.bridge.uuid()
+
+	handle := func(msg string) []*http.Response {
+		t.Helper()
+
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(msg)))
+		require.NoError(t, err)
+
+		resps := []*http.Response{}
+		for _, b := range s.handle(req, ip) {
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+			require.NoError(t, err)
+			resps = append(resps, resp)
+		}
+		return resps
+	}
+
+	resps := handle(mSearch("ssdp:all"))
+	require.Len(t, resps, 3)
+	assert.Equal(t, "upnp:rootdevice", resps[0].Header.Get("ST"))
+	assert.Equal(t, uuid+"::upnp:rootdevice", resps[0].Header.Get("USN"))
+	assert.Equal(t, uuid, resps[1].Header.Get("USN"))
+	for _, resp := range resps {
+		assert.Equal(t, "http://192.0.2.1:8000/description.xml", resp.Header.Get("LOCATION"))
+		assert.Equal(t, s.bridge.bridgeID(), resp.Header.Get("hue-bridgeid"))
+	}
+
+	resps = handle(mSearch("urn:schemas-upnp-org:device:basic:1"))
+	require.Len(t, resps, 1)
+	assert.Equal(t, uuid+"::urn:schemas-upnp-org:device:basic:1", resps[0].Header.Get("USN"))
+
+	assert.Empty(t, handle(mSearch("urn:dial-multiscreen-org:service:dial:1")))
+	assert.Empty(t, handle(strings.Replace(mSearch("ssdp:all"), "ssdp:discover", "ssdp:alive", 1)))
+	assert.Empty(t, handle("NOTIFY * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nNT: upnp:rootdevice\r\n\r\n"))
+}
+
+func TestSSDPListen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// find a free port
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.LocalAddr().String()
+	l.Close()
+
+	s := &ssdpResponder{bridge: newHueBridge(nil, nil, nil, "test"), port: 8000}
+	require.NoError(t, s.listen(ctx, addr))
+
+	conn, err := net.Dial("udp4", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(mSearch("upnp:rootdevice")))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8000/description.xml", resp.Header.Get("LOCATION"))
+}
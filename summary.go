@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// colorSummary is a strategy for summarizing the strip's pixels as the single
+// color HomeKit shows for the light
+type colorSummary string
+
+const (
+	// summaryAverage is the perceptual average (in CIE L*a*b*) of the lit
+	// pixels, at their average brightness
+	summaryAverage colorSummary = "average"
+	// summaryDominant is the most common color among the lit pixels,
+	// weighted by their brightness
+	summaryDominant colorSummary = "dominant"
+	// summaryFirst is the first pixel's color
+	summaryFirst colorSummary = "first"
+)
+
+func parseColorSummary(s string) (colorSummary, error) {
+	switch cs := colorSummary(s); cs {
+	case summaryAverage, summaryDominant, summaryFirst:
+		return cs, nil
+	default:
+		return "", fmt.Errorf("color summary must be average, dominant or first, not %q", s)
+	}
+}
+
+// dominantHueBuckets is the number of hue ranges pixels are grouped into to
+// find the dominant color, and dominantMinSat is the saturation below which
+// pixels are grouped together as white instead
+const (
+	dominantHueBuckets = 12
+	dominantMinSat     = 0.2
+)
+
+// summarize returns the hue (degrees), saturation and value (0-1) HomeKit
+// should show for the frame. Unlit pixels are ignored (except by the first
+// strategy), so a partially lit strip isn't shown as dimmer than it is.
+func (cs colorSummary) summarize(frame []colorful.Color) (h, s, v float64) {
+	if len(frame) == 0 {
+		return 0, 0, 0
+	}
+
+	if cs == summaryFirst {
+		return frame[0].Hsv()
+	}
+
+	lit := make([]colorful.Color, 0, len(frame))
+	for _, c := range frame {
+		if _, _, cv := c.Hsv(); cv > 0 {
+			lit = append(lit, c)
+		}
+	}
+	if len(lit) == 0 {
+		return 0, 0, 0
+	}
+
+	if cs == summaryDominant {
+		lit = dominantPixels(lit)
+	}
+
+	// a solid color is shown exactly, without the noise converting to and
+	// from L*a*b* adds
+	if uniformFrame(lit) {
+		return lit[0].Hsv()
+	}
+
+	return averageColor(lit)
+}
+
+// averageColor averages the pixels' colors in CIE L*a*b*, returning the
+// average's hue and saturation, with the pixels' average value
+func averageColor(pixels []colorful.Color) (h, s, v float64) {
+	var l, a, b float64
+	for _, c := range pixels {
+		cl, ca, cb := c.Lab()
+		l, a, b = l+cl, a+ca, b+cb
+		_, _, cv := c.Hsv()
+		v += cv
+	}
+
+	n := float64(len(pixels))
+	h, s, _ = colorful.Lab(l/n, a/n, b/n).Clamped().Hsv()
+	return h, s, v / n
+}
+
+// dominantPixels groups the pixels by hue, returning the group with the most
+// total brightness
+func dominantPixels(pixels []colorful.Color) []colorful.Color {
+	groups := make([][]colorful.Color, dominantHueBuckets+1)
+	weights := make([]float64, len(groups))
+	for _, c := range pixels {
+		h, s, v := c.Hsv()
+
+		// low-saturation pixels are grouped as white, and hue ranges are
+		// centred on multiples of 30° so reds either side of 0° are
+		// grouped together
+		i := dominantHueBuckets
+		if s >= dominantMinSat {
+			width := 360.0 / dominantHueBuckets
+			i = int(math.Mod(h+width/2, 360)/width) % dominantHueBuckets
+		}
+
+		groups[i] = append(groups[i], c)
+		weights[i] += v
+	}
+
+	best := 0
+	for i := range weights {
+		if weights[i] > weights[best] {
+			best = i
+		}
+	}
+	return groups[best]
+}
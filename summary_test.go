@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseColorSummary(t *testing.T) {
+	cs, err := parseColorSummary("dominant")
+	require.NoError(t, err)
+	assert.Equal(t, summaryDominant, cs)
+
+	_, err = parseColorSummary("median")
+	assert.Error(t, err)
+}
+
+func TestSummarize(t *testing.T) {
+	h, s, v := summaryAverage.summarize(nil)
+	assert.Equal(t, []float64{0, 0, 0}, []float64{h, s, v})
+
+	// unlit pixels don't count
+	h, s, v = summaryAverage.summarize(frameOf(0, red, red))
+	assert.Equal(t, []float64{0, 1, 1}, []float64{h, s, v})
+	h, s, v = summaryDominant.summarize(frameOf(0, red, red))
+	assert.Equal(t, []float64{0, 1, 1}, []float64{h, s, v})
+	// except for the first pixel
+	h, s, v = summaryFirst.summarize(frameOf(0, red, red))
+	assert.Equal(t, []float64{0, 0, 0}, []float64{h, s, v})
+
+	h, s, v = summaryAverage.summarize(frameOf(0, 0))
+	assert.Equal(t, []float64{0, 0, 0}, []float64{h, s, v})
+
+	// red and blue average to a purple, at their brightness
+	h, _, v = summaryAverage.summarize(frameOf(red, 0x0000ff))
+	assert.Greater(t, h, 270.0)
+	assert.Less(t, h, 330.0)
+	assert.Equal(t, 1.0, v)
+
+	// brightness is averaged
+	_, _, v = summaryAverage.summarize(frameOf(0x800000, red))
+	assert.InDelta(t, 0.75, v, 0.01)
+
+	testdata := []struct {
+		frame    []uint32
+		hue, sat float64
+	}{
+		{[]uint32{red, red, 0x0000ff}, 0, 1},
+		// dim pixels count for less
+		{[]uint32{0x200000, 0x200000, 0x0000ff}, 240, 1},
+		{[]uint32{0xffffff, 0xffffff, red}, 0, 0},
+		// reds either side of 0° are grouped together
+		{[]uint32{0xff0015, 0xff1500, 0x0000ff}, 0, 1},
+	}
+	for _, d := range testdata {
+		h, s, _ := summaryDominant.summarize(frameOf(d.frame...))
+		assert.InDelta(t, d.hue, h, 2, "%x", d.frame)
+		assert.InDelta(t, d.sat, s, 0.05, "%x", d.frame)
+	}
+}
+
+func TestInitLightSummary(t *testing.T) {
+	// a strip whose first pixel is off doesn't look off
+	b := setupBridge(t, []uint32{0, red, red, 0})
+	lb := b.acc.Lightbulb
+	assert.True(t, lb.On.Value())
+	assert.Equal(t, 100, lb.Brightness.Value())
+	assert.Equal(t, 100.0, lb.Saturation.Value())
+	assert.Contains(t, b.spanNames(), "hsv")
+
+	b.strip.summary = summaryFirst
+	require.NoError(t, initLight(context.Background(), lb, b.strip))
+	assert.Equal(t, 0, lb.Brightness.Value())
+}
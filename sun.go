@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// j2000 is the epoch of the Julian dates used in sunTimes (2451545.0)
+var j2000 = time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// sunTimes calculates the times of sunrise and sunset on the given day, at
+// the given latitude and longitude (in degrees, east positive), using the
+// sunrise equation. It needs no network access, and is accurate to a minute
+// or two, which is plenty for turning lights on. It returns false when the
+// sun doesn't rise or set that day (polar day or night).
+func sunTimes(day time.Time, lat, lon float64) (rise, set time.Time, ok bool) {
+	const deg = math.Pi / 180
+
+	y, m, d := day.Date()
+	n := math.Round(time.Date(y, m, d, 12, 0, 0, 0, time.UTC).Sub(j2000).Hours() / 24)
+
+	// mean solar noon
+	jStar := n - lon/360
+	// solar mean anomaly
+	ma := math.Mod(357.5291+0.98560028*jStar, 360)
+	// equation of the center
+	c := 1.9148*math.Sin(ma*deg) + 0.02*math.Sin(2*ma*deg) + 0.0003*math.Sin(3*ma*deg)
+	// ecliptic longitude
+	l := math.Mod(ma+c+180+102.9372, 360)
+	// solar transit, relative to J2000
+	transit := jStar + 0.0053*math.Sin(ma*deg) - 0.0069*math.Sin(2*l*deg)
+	// declination of the sun
+	sinDecl := math.Sin(l*deg) * math.Sin(23.4397*deg)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+
+	// hour angle, allowing for refraction and the size of the sun's disc
+	cosHA := (math.Sin(-0.833*deg) - math.Sin(lat*deg)*sinDecl) / (math.Cos(lat*deg) * cosDecl)
+	if cosHA < -1 || cosHA > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	ha := math.Acos(cosHA) / deg
+
+	toTime := func(j float64) time.Time {
+		return j2000.Add(time.Duration(j * 24 * float64(time.Hour))).Round(time.Second).In(day.Location())
+	}
+
+	return toTime(transit - ha/360), toTime(transit + ha/360), true
+}
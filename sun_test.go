@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSunTimes(t *testing.T) {
+	est := time.FixedZone("EST", -5*60*60)
+	aedt := time.FixedZone("AEDT", 11*60*60)
+
+	testdata := []struct {
+		day       time.Time
+		rise, set time.Time
+		lat, lon  float64
+	}{
+		{
+			// London, summer solstice
+			day: time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC), lat: 51.5074, lon: -0.1278,
+			rise: time.Date(2024, 6, 21, 3, 43, 0, 0, time.UTC),
+			set:  time.Date(2024, 6, 21, 20, 21, 0, 0, time.UTC),
+		},
+		{
+			// New York, winter solstice
+			day: time.Date(2024, 12, 21, 0, 0, 0, 0, est), lat: 40.7128, lon: -74.006,
+			rise: time.Date(2024, 12, 21, 7, 16, 0, 0, est),
+			set:  time.Date(2024, 12, 21, 16, 32, 0, 0, est),
+		},
+		{
+			// Sydney, equinox
+			day: time.Date(2024, 3, 20, 0, 0, 0, 0, aedt), lat: -33.8688, lon: 151.2093,
+			rise: time.Date(2024, 3, 20, 6, 58, 0, 0, aedt),
+			set:  time.Date(2024, 3, 20, 19, 7, 0, 0, aedt),
+		},
+	}
+
+	for _, d := range testdata {
+		rise, set, ok := sunTimes(d.day, d.lat, d.lon)
+		assert.True(t, ok)
+		assert.WithinDuration(t, d.rise, rise, 2*time.Minute)
+		assert.WithinDuration(t, d.set, set, 2*time.Minute)
+		assert.Equal(t, d.day.Location(), rise.Location())
+	}
+
+	// Tromsø has no sunrise in December, and no sunset in June
+	_, _, ok := sunTimes(time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC), 69.65, 18.96)
+	assert.False(t, ok)
+	_, _, ok = sunTimes(time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC), 69.65, 18.96)
+	assert.False(t, ok)
+}
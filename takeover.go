@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brutella/hap/service"
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// frameSource is an external input (e.g. E1.31 or OPC) that sends frames
+// for the strip
+type frameSource interface {
+	// pending returns the frame waiting to be written to a strip of n
+	// pixels, or nil if there isn't one. The takeover's mu is held.
+	pending(n int) []colorful.Color
+	// reset discards any pending frame, once the source has stopped. The
+	// takeover's mu is held.
+	reset()
+	// written is called once a frame has been written, or failed to be
+	written(err error)
+}
+
+// takeover hands control of the strip to an external source while it's
+// sending frames, writing them no more often than the interval allows. Once
+// frames stop for longer than timeout, the strip is set back to the
+// lightbulb's HomeKit state.
+type takeover struct {
+	lb    *service.ColoredLightbulb
+	strip *wifineopixel
+	src   frameSource
+	now   func() time.Time
+
+	// id prefixes span names, and name describes the source in logs
+	id   string
+	name string
+
+	// savedOnState is the strip's on state from before the source took
+	// control, so that turning the light on afterwards doesn't restore the
+	// source's last frame
+	savedOnState []colorful.Color
+	lastFrame    time.Time
+	// pixels is the strip's length, once it's known - the strip's length
+	// is only known once it's connected, and the flush loop keeps track of
+	// it so the strip isn't touched when frames are received
+	pixels atomic.Int64
+	// interval is the minimum time between writes to the device
+	interval time.Duration
+	timeout  time.Duration
+	// active is set while frames are arriving, and taken once the strip
+	// has been written to
+	active bool
+	taken  bool
+	mu     sync.Mutex
+}
+
+// received records that the source sent a frame, taking control of the
+// strip if it didn't have it already. t.mu must be held.
+func (t *takeover) received(ctx context.Context) {
+	if !t.active {
+		zerolog.Ctx(ctx).Info().Msgf("%s took control of the strip", t.name)
+		t.active = true
+		t.taken = false
+	}
+	t.lastFrame = t.now()
+}
+
+// stopped hands control back on the next flush, when the source says it's
+// done. t.mu must be held.
+func (t *takeover) stopped() {
+	if t.active {
+		t.lastFrame = time.Time{}
+	}
+}
+
+// run writes received frames to the strip, no more often than the interval
+// allows, and releases control once frames stop
+func (t *takeover) run(ctx context.Context) {
+	tick := time.NewTicker(t.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			t.flush(ctx)
+		}
+	}
+}
+
+// flush writes the pending frame, if there is one, or hands the strip back
+// to HomeKit if frames have stopped
+func (t *takeover) flush(ctx context.Context) {
+	if t.strip.isConnected() {
+		t.pixels.Store(int64(t.strip.pixelCount()))
+	}
+
+	t.mu.Lock()
+	if t.active && t.now().Sub(t.lastFrame) >= t.timeout {
+		t.active = false
+		t.src.reset()
+		taken := t.taken
+		t.mu.Unlock()
+
+		if taken {
+			t.release(ctx)
+		}
+		return
+	}
+
+	frame := t.src.pending(int(t.pixels.Load()))
+	if frame == nil {
+		t.mu.Unlock()
+		return
+	}
+	if !t.taken {
+		t.taken = true
+		t.savedOnState = t.strip.snapshotOnState()
+	}
+	t.mu.Unlock()
+
+	ctx, span := otel.Tracer("").Start(ctx, t.id+".write")
+	defer span.End()
+	span.SetAttributes(attribute.Int("pixels", len(frame)))
+
+	err := t.strip.setState(ctx, frame)
+	if err != nil {
+		span.RecordError(err)
+		zerolog.Ctx(ctx).Warn().Err(err).Msgf("failed to write %s frame", t.name)
+	}
+	t.src.written(err)
+}
+
+// release sets the strip back to the lightbulb's HomeKit state
+func (t *takeover) release(ctx context.Context) {
+	ctx, span := otel.Tracer("").Start(ctx, t.id+".release")
+	defer span.End()
+
+	log := zerolog.Ctx(ctx)
+	log.Info().Msgf("%s stopped, returning control to HomeKit", t.name)
+
+	lb := t.lb
+	var err error
+	if lb.On.Value() {
+		err = updateColor(ctx, t.strip, lb.Hue.Value(), lb.Saturation.Value(), lb.Brightness.Value())
+	} else {
+		t.mu.Lock()
+		saved := t.savedOnState
+		t.mu.Unlock()
+		t.strip.restoreOnState(saved)
+		err = t.strip.clear(ctx)
+	}
+	if err != nil {
+		span.RecordError(err)
+		log.Error().Err(err).Msgf("failed to restore the strip after %s", t.name)
+	}
+}
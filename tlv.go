@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// The hap module's tlv8 package maps TLV8 onto structs, which doesn't cope
+// with the nested lists and variable-width integers used by characteristics
+// like the Adaptive Lighting transition control point. These helpers work
+// with TLV8 items directly instead.
+
+// tlvItem is a single TLV8 item
+type tlvItem struct {
+	val []byte
+	typ byte
+}
+
+type tlvItems []tlvItem
+
+// decodeTLV splits b into TLV8 items. Values longer than 255 bytes are
+// encoded as consecutive fragments of the same type, which are joined back
+// together.
+func decodeTLV(b []byte) (tlvItems, error) {
+	items := tlvItems{}
+	fragmented := false
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("truncated TLV8 header")
+		}
+		typ, n := b[0], int(b[1])
+		if len(b) < 2+n {
+			return nil, fmt.Errorf("truncated TLV8 item of type %#x", typ)
+		}
+		val := b[2 : 2+n]
+		b = b[2+n:]
+
+		if fragmented && items[len(items)-1].typ == typ {
+			last := &items[len(items)-1]
+			last.val = append(last.val, val...)
+		} else {
+			items = append(items, tlvItem{typ: typ, val: append([]byte{}, val...)})
+		}
+		fragmented = n == 255
+	}
+	return items, nil
+}
+
+// get returns the value of the first item of the given type
+func (t tlvItems) get(typ byte) ([]byte, bool) {
+	for _, item := range t {
+		if item.typ == typ {
+			return item.val, true
+		}
+	}
+	return nil, false
+}
+
+// split breaks a list into its entries, each of which starts with an item
+// of type first. Items of type 0 are separators, and are dropped.
+func (t tlvItems) split(first byte) []tlvItems {
+	entries := []tlvItems{}
+	for _, item := range t {
+		if item.typ == 0 {
+			continue
+		}
+		if item.typ == first || len(entries) == 0 {
+			entries = append(entries, tlvItems{})
+		}
+		entries[len(entries)-1] = append(entries[len(entries)-1], item)
+	}
+	return entries
+}
+
+// appendTLV appends an item to b, fragmenting values longer than 255 bytes
+func appendTLV(b []byte, typ byte, val []byte) []byte {
+	for {
+		n := min(len(val), 255)
+		b = append(b, typ, byte(n))
+		b = append(b, val[:n]...)
+		val = val[n:]
+
+		// a value of exactly 255 bytes still needs an empty fragment, so
+		// that it isn't joined with a following item of the same type
+		if n < 255 {
+			return b
+		}
+	}
+}
+
+// appendTLVList appends a list of entries which all have the same type, with
+// separators between them
+func appendTLVList(b []byte, typ byte, vals ...[]byte) []byte {
+	for i, val := range vals {
+		if i > 0 {
+			b = append(b, 0, 0)
+		}
+		b = appendTLV(b, typ, val)
+	}
+	return b
+}
+
+// tlvUint encodes v as a little-endian integer, in as few of 1, 2, 4 or 8
+// bytes as it fits in
+func tlvUint(v uint64) []byte {
+	switch {
+	case v <= math.MaxUint8:
+		return []byte{byte(v)}
+	case v <= math.MaxUint16:
+		return binary.LittleEndian.AppendUint16(nil, uint16(v))
+	case v <= math.MaxUint32:
+		return binary.LittleEndian.AppendUint32(nil, uint32(v))
+	default:
+		return binary.LittleEndian.AppendUint64(nil, v)
+	}
+}
+
+// parseTLVUint decodes a little-endian integer of 1, 2, 4 or 8 bytes
+func parseTLVUint(b []byte) (uint64, error) {
+	switch len(b) {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(b)), nil
+	case 8:
+		return binary.LittleEndian.Uint64(b), nil
+	default:
+		return 0, fmt.Errorf("invalid TLV8 integer length %d", len(b))
+	}
+}
+
+// parseTLVFloat decodes a little-endian 32-bit float
+func parseTLVFloat(b []byte) (float64, error) {
+	if len(b) != 4 {
+		return 0, fmt.Errorf("invalid TLV8 float length %d", len(b))
+	}
+	return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLVFragments(t *testing.T) {
+	long := bytes.Repeat([]byte{0xaa}, 300)
+	exact := bytes.Repeat([]byte{0xbb}, 255)
+
+	b := appendTLV(nil, 0x01, long)
+	assert.Len(t, b, 2+255+2+45)
+
+	b = appendTLV(nil, 0x02, exact)
+	b = appendTLV(b, 0x02, []byte{1})
+	items, err := decodeTLV(b)
+	require.NoError(t, err)
+	assert.Equal(t, tlvItems{{typ: 0x02, val: exact}, {typ: 0x02, val: []byte{1}}}, items)
+
+	items, err = decodeTLV(appendTLV(nil, 0x01, long))
+	require.NoError(t, err)
+	assert.Equal(t, tlvItems{{typ: 0x01, val: long}}, items)
+
+	_, err = decodeTLV([]byte{0x01, 0x05, 0x00})
+	assert.Error(t, err)
+}
+
+func TestTLVList(t *testing.T) {
+	b := appendTLVList(nil, 0x01, []byte{1}, []byte{2})
+	assert.Equal(t, []byte{0x01, 1, 1, 0, 0, 0x01, 1, 2}, b)
+
+	items, err := decodeTLV(append(b, 0x02, 1, 3))
+	require.NoError(t, err)
+	assert.Equal(t, []tlvItems{
+		{{typ: 0x01, val: []byte{1}}},
+		{{typ: 0x01, val: []byte{2}}, {typ: 0x02, val: []byte{3}}},
+	}, items.split(0x01))
+}
+
+func TestTLVUint(t *testing.T) {
+	for _, v := range []uint64{0, 0xff, 0x100, 0xffff, 0x10000, 0x100000000} {
+		n, err := parseTLVUint(tlvUint(v))
+		require.NoError(t, err)
+		assert.Equal(t, v, n)
+	}
+	assert.Len(t, tlvUint(0x1234), 2)
+
+	_, err := parseTLVUint([]byte{1, 2, 3})
+	assert.Error(t, err)
+}
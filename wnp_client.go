@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image/color"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lucasb-eyer/go-colorful"
@@ -23,17 +27,56 @@ import (
 )
 
 type wifineopixel struct {
-	address *url.URL
+	// address is swapped out when the device is rediscovered at a new
+	// location, so it must only be accessed through addr/setAddress
+	address atomic.Pointer[url.URL]
 	hc      *http.Client
+	// state is the frame the strip is showing, and onState the frame it's
+	// restored to when turned on - both are guarded by stateMu, and only
+	// accessed through methods that hand out copies
+	stateMu sync.RWMutex
 	state   []colorful.Color
 	onState []colorful.Color
+	// power limits the current drawn by frames written to the strip
+	power powerLimiter
+	// meter estimates the power drawn by the frames the strip displays
+	meter *powerMeter
+	// ddp, when set, is used to write frames instead of the HTTP API
+	ddp *ddpOutput
+	// pattern is the multi-color pattern being displayed, if any
+	pattern patternState
+	// summary is how the strip's pixels are summarized as a single color
+	// for HomeKit (average when empty)
+	summary colorSummary
+	// identifyCfg configures the identify routine
+	identifyCfg identifyConfig
+	// identifying is set while the identify routine runs
+	identifying atomic.Bool
+	// writeMu serializes writes that change the strip's state, and reads
+	// of it, and changes counts the writes, so animations (e.g. identify)
+	// can avoid overwriting them
+	writeMu sync.Mutex
+	changes atomic.Uint64
+	// connected is set once the device has answered and state is known
+	connected atomic.Bool
+	// healthy records whether the most recent request to the device
+	// succeeded
+	healthy atomic.Bool
 }
 
-func newWifiNeopixel(ctx context.Context, addr string) (*wifineopixel, error) {
-	u, err := url.Parse(addr)
-	if err != nil {
-		return nil, err
-	}
+// errNotConnected is returned when the device hasn't been reached yet
+var errNotConnected = errors.New("device not connected")
+
+// errEmptyFrame is returned when asked to write a frame with no pixels
+var errEmptyFrame = errors.New("frame has no pixels")
+
+// hapStatusCommunicationFailure is the HAP status code for "Unable to
+// communicate with requested service", shown as "No Response" in the Home app
+const hapStatusCommunicationFailure = -70402
+
+// newWifiNeopixel creates a client for a device that hasn't been found yet -
+// use connect to point it at the device
+func newWifiNeopixel() *wifineopixel {
 	client := &http.Client{
 		Transport: instrumentHTTPClient("wnp_client", &http.Transport{
 			DialContext: (&net.Dialer{
@@ -48,38 +91,123 @@ func newWifiNeopixel(ctx context.Context, addr string) (*wifineopixel, error) {
 			DisableKeepAlives:     false,
 		}),
 	}
-	strip := &wifineopixel{
-		address: u,
-		hc:      client,
+	return &wifineopixel{
+		hc:    client,
+		power: powerLimiter{led: defaultLEDCurrent},
+		meter: newPowerMeter("", defaultLEDCurrent, defaultLEDVoltage),
 	}
-	err = strip.initState(ctx)
+}
+
+// connect points the client at the device at addr and reads its initial
+// state
+func (w *wifineopixel) connect(ctx context.Context, addr string) error {
+	err := w.setAddress(addr)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	err = w.initState(ctx)
+	if err != nil {
+		return err
 	}
-	return strip, nil
+	w.connected.Store(true)
+	return nil
+}
+
+func (w *wifineopixel) isConnected() bool {
+	return w.connected.Load()
+}
+
+// available reports whether the device has been connected, and whether the
+// most recent request to it succeeded
+func (w *wifineopixel) available() bool {
+	return w.connected.Load() && w.healthy.Load()
+}
+
+func (w *wifineopixel) addr() *url.URL {
+	return w.address.Load()
+}
+
+func (w *wifineopixel) setAddress(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+	w.address.Store(u)
+	return nil
 }
 
 func (w *wifineopixel) initState(ctx context.Context) (err error) {
 	ctx, span := otel.Tracer("").Start(ctx, "initState")
 	defer span.End()
 
-	w.state, err = w.getStates(ctx)
+	state, err := w.getStates(ctx)
 	if err != nil {
 		return err
 	}
-	if w.isOn() {
-		w.onState = w.state
-	}
-	if w.isOff() {
+
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+
+	w.state = state
+	w.onState = slices.Clone(state)
+	if !lit(state) {
 		// init to red by default
-		w.onState = make([]colorful.Color, len(w.state))
-		for i := range w.state {
+		for i := range w.onState {
 			w.onState[i] = colorful.LinearRgb(0xff, 0x00, 0x00)
 		}
 	}
 	return nil
 }
 
+// currentState returns a copy of the frame the strip is showing
+func (w *wifineopixel) currentState() []colorful.Color {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	return slices.Clone(w.state)
+}
+
+// snapshotOnState returns a copy of the frame the strip is restored to when
+// turned on
+func (w *wifineopixel) snapshotOnState() []colorful.Color {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	return slices.Clone(w.onState)
+}
+
+// restoreOnState sets the frame the strip is restored to when turned on,
+// without changing what it's showing
+func (w *wifineopixel) restoreOnState(frame []colorful.Color) {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	w.onState = slices.Clone(frame)
+}
+
+// pixelCount returns the strip's length, which is only known once it's
+// connected
+func (w *wifineopixel) pixelCount() int {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	return len(w.state)
+}
+
+// cacheState records the frame the strip is showing
+func (w *wifineopixel) cacheState(state []colorful.Color) {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	w.state = slices.Clone(state)
+}
+
+// cacheWrittenState records a frame written to the strip, and remembers it
+// for on() to restore if it's lit
+func (w *wifineopixel) cacheWrittenState(state []colorful.Color) {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	w.state = slices.Clone(state)
+	if lit(state) {
+		w.onState = slices.Clone(state)
+	}
+}
+
 func (w *wifineopixel) get(ctx context.Context, path string) (*http.Response, error) {
 	return w.do(ctx, "GET", path, "", nil)
 }
@@ -89,7 +217,11 @@ func (w *wifineopixel) post(ctx context.Context, path, contentType string, body
 }
 
 func (w *wifineopixel) do(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, method, w.address.String()+path, body)
+	addr := w.addr()
+	if addr == nil {
+		return nil, errNotConnected
+	}
+	req, err := http.NewRequestWithContext(ctx, method, addr.String()+path, body)
 	if err != nil {
 		return nil, err
 	}
@@ -108,6 +240,15 @@ func (w *wifineopixel) do(ctx context.Context, method, path, contentType string,
 		tagsFromResponse(span, res)
 	}
 
+	if err == nil && res.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("%s %s: unexpected status %d", method, path, res.StatusCode)
+		_, _ = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		res = nil
+	}
+
+	w.healthy.Store(err == nil)
+
 	if err != nil {
 		span.RecordError(err)
 	}
@@ -119,9 +260,20 @@ func (w *wifineopixel) clear(ctx context.Context) error {
 	ctx, span := otel.Tracer("").Start(ctx, "clear")
 	defer span.End()
 
+	if !w.isConnected() {
+		return errNotConnected
+	}
+
+	if w.ddp != nil {
+		return w.setState(ctx, make([]colorful.Color, w.pixelCount()))
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	defer w.changes.Add(1)
+
 	resp, err := w.get(ctx, "/clear")
 	if err != nil {
-		resp.Body.Close()
 		return err
 	}
 	body, err := io.ReadAll(resp.Body)
@@ -130,10 +282,11 @@ func (w *wifineopixel) clear(ctx context.Context) error {
 		return err
 	}
 	log.Debug().Msgf("clear: %v", string(body))
-	w.state, err = w.getStates(ctx)
+	state, err := w.getStates(ctx)
 	if err != nil {
 		return err
 	}
+	w.cacheState(state)
 	return nil
 }
 
@@ -141,8 +294,30 @@ func (w *wifineopixel) on(ctx context.Context) error {
 	ctx, span := otel.Tracer("").Start(ctx, "on")
 	defer span.End()
 
+	if !w.isConnected() {
+		return errNotConnected
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	defer w.changes.Add(1)
+
+	onState := w.snapshotOnState()
+	frame := w.limitFrame(ctx, onState)
+
+	// the DDP controller can't be asked what it's showing, so the frame is
+	// assumed to have been displayed
+	if w.ddp != nil {
+		if err := w.writeDDP(ctx, frame); err != nil {
+			return err
+		}
+		w.cacheState(onState)
+		w.meter.observe(frame)
+		return nil
+	}
+
 	b := &bytes.Buffer{}
-	err := json.NewEncoder(b).Encode(colorsToUint32(w.onState))
+	err := json.NewEncoder(b).Encode(colorsToUint32(frame))
 	if err != nil {
 		return err
 	}
@@ -151,7 +326,6 @@ func (w *wifineopixel) on(ctx context.Context) error {
 	log.Debug().Str("body", b.String()).Msg("sending body")
 	resp, err := w.post(ctx, "/raw", "application/json", b)
 	if err != nil {
-		resp.Body.Close()
 		return err
 	}
 	body, err := io.ReadAll(resp.Body)
@@ -160,11 +334,13 @@ func (w *wifineopixel) on(ctx context.Context) error {
 		return err
 	}
 	log.Debug().Str("body", string(body)).Msg("on")
-	w.state, err = w.getStates(ctx)
-	if w.isOn() {
-		w.onState = w.state
-	}
-	return err
+
+	// as with setState, the requested frame is kept rather than the limited
+	// one the device shows, so limiting isn't compounded by turning the
+	// strip off and on
+	w.cacheState(onState)
+	w.meter.observe(frame)
+	return nil
 }
 
 func (w *wifineopixel) setState(ctx context.Context, state []colorful.Color) error {
@@ -172,13 +348,30 @@ func (w *wifineopixel) setState(ctx context.Context, state []colorful.Color) err
 	defer span.End()
 	span.SetAttributes(attribute.String("state", fmt.Sprintf("%v", state)))
 
-	if _, _, v := state[0].Hsv(); v > 0 && w.isOn() {
-		w.onState = w.state
+	if !w.isConnected() {
+		return errNotConnected
+	}
+	if len(state) == 0 {
+		return errEmptyFrame
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	defer w.changes.Add(1)
+
+	frame := w.limitFrame(ctx, state)
+
+	if w.ddp != nil {
+		if err := w.writeDDP(ctx, frame); err != nil {
+			return err
+		}
+		w.cacheWrittenState(state)
+		w.meter.observe(frame)
+		return nil
 	}
-	w.state = state
 
 	b := &bytes.Buffer{}
-	err := json.NewEncoder(b).Encode(colorsToUint32(state))
+	err := json.NewEncoder(b).Encode(colorsToUint32(frame))
 	if err != nil {
 		return err
 	}
@@ -189,17 +382,64 @@ func (w *wifineopixel) setState(ctx context.Context, state []colorful.Color) err
 		return err
 	}
 	defer resp.Body.Close()
+
+	// only update the cached state once the device has accepted it, and
+	// remember lit states so on() can restore them
+	w.cacheWrittenState(state)
+	w.meter.observe(frame)
+
 	body, err := io.ReadAll(resp.Body)
 	log.Debug().Msgf("setState: %v", string(body))
 	return err
 }
 
+// writeDDP sends a frame with the DDP output, recording whether it could be
+// sent in the same way as HTTP requests
+func (w *wifineopixel) writeDDP(ctx context.Context, frame []colorful.Color) error {
+	err := w.ddp.write(ctx, w.addr(), frame)
+	w.healthy.Store(err == nil)
+	return err
+}
+
+// refresh re-reads the strip's state from the device
+func (w *wifineopixel) refresh(ctx context.Context) error {
+	ctx, span := otel.Tracer("").Start(ctx, "refresh")
+	defer span.End()
+
+	if _, err := w.readState(ctx); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// readState reads the strip's state from the device, and caches it. The
+// cached state is returned instead when the device can't say what the strip
+// is showing: the DDP controller can't be asked (and its HTTP API doesn't
+// know about frames sent with DDP), and the identify animation isn't the
+// strip's state.
+func (w *wifineopixel) readState(ctx context.Context) ([]colorful.Color, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if w.ddp != nil || w.identifying.Load() {
+		return w.currentState(), nil
+	}
+
+	state, err := w.getStates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w.cacheState(state)
+	return state, nil
+}
+
 func (w *wifineopixel) setSolid(ctx context.Context, c colorful.Color) error {
 	ctx, span := otel.Tracer("").Start(ctx, "setSolid")
 	defer span.End()
 
 	log.Debug().Msgf("setSolid(%v)", c)
-	s := make([]colorful.Color, len(w.onState))
+	s := make([]colorful.Color, w.pixelCount())
 	for i := range s {
 		s[i] = c
 	}
@@ -207,17 +447,18 @@ func (w *wifineopixel) setSolid(ctx context.Context, c colorful.Color) error {
 }
 
 func (w *wifineopixel) isOff() bool {
-	for _, s := range w.state {
-		r, g, b, _ := s.RGBA()
-		if r != 0 || g != 0 || b != 0 {
-			return false
-		}
-	}
-	return true
+	return !w.isOn()
 }
 
 func (w *wifineopixel) isOn() bool {
-	for _, s := range w.state {
+	w.stateMu.RLock()
+	defer w.stateMu.RUnlock()
+	return lit(w.state)
+}
+
+// lit reports whether any of the frame's pixels are on
+func lit(frame []colorful.Color) bool {
+	for _, s := range frame {
 		r, g, b, _ := s.RGBA()
 		if r != 0 || g != 0 || b != 0 {
 			return true
@@ -230,11 +471,18 @@ func (w *wifineopixel) hsv(ctx context.Context) (h, s, v float64, err error) {
 	ctx, span := otel.Tracer("").Start(ctx, "hsv")
 	defer span.End()
 
-	c, err := w.getState(ctx, 0)
+	state, err := w.readState(ctx)
 	if err != nil {
 		return 0, 0, 0, err
 	}
-	h, s, v = c.Hsv()
+
+	summary := w.summary
+	if summary == "" {
+		summary = summaryAverage
+	}
+	span.SetAttributes(attribute.String("summary", string(summary)))
+
+	h, s, v = summary.summarize(state)
 	return h, s, v, nil
 }
 
@@ -266,21 +514,13 @@ func (w *wifineopixel) getStates(ctx context.Context) ([]colorful.Color, error)
 		c[i] = uint32ToColor(s)
 	}
 
-	log.Debug().Msgf("uint32ToColor(%v) = %v", states[0], c[0])
-
-	return c, nil
-}
-
-func (w *wifineopixel) getState(ctx context.Context, pixel int) (state colorful.Color, err error) {
-	ctx, span := otel.Tracer("").Start(ctx, "getState")
-	defer span.End()
-
-	w.state, err = w.getStates(ctx)
-	if err != nil {
-		return colorful.Color{}, err
+	if len(states) > 0 {
+		log.Debug().Msgf("uint32ToColor(%v) = %v", states[0], c[0])
 	}
 
-	return w.state[pixel], nil
+	w.meter.observe(c)
+
+	return c, nil
 }
 
 func colorToUint32(c colorful.Color) uint32 {
@@ -0,0 +1,393 @@
+package wnptest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Faults configures the ways the fake device misbehaves, to mimic the real
+// (slow and flaky) ESP8266 firmware. The zero value is a well-behaved device.
+type Faults struct {
+	// Latency is added before each request is handled
+	Latency Latency
+	// ErrorRate is the probability (0-1) of responding with a 500 error
+	ErrorRate float64
+	// DropRate is the probability (0-1) of closing the connection without
+	// responding at all
+	DropRate float64
+	// MalformedRate is the probability (0-1) of truncating JSON responses
+	MalformedRate float64
+	// MaxConcurrent limits how many requests are handled at once - further
+	// requests stall until a slot is free. Zero means unlimited.
+	MaxConcurrent int
+}
+
+// LatencyDistribution is the shape of the latency added to requests
+type LatencyDistribution string
+
+// Supported latency distributions
+const (
+	// LatencyNone adds no latency
+	LatencyNone LatencyDistribution = ""
+	// LatencyFixed always adds Mean
+	LatencyFixed LatencyDistribution = "fixed"
+	// LatencyUniform adds between Min and Max
+	LatencyUniform LatencyDistribution = "uniform"
+	// LatencyNormal adds a normally-distributed latency around Mean, with
+	// standard deviation StdDev
+	LatencyNormal LatencyDistribution = "normal"
+	// LatencyExponential adds an exponentially-distributed latency with the
+	// given Mean - mostly short, with occasional long stalls
+	LatencyExponential LatencyDistribution = "exponential"
+)
+
+// Latency describes a distribution of request latencies. Values are never
+// negative, and are capped at Max when it's set.
+type Latency struct {
+	Distribution LatencyDistribution
+	Min          time.Duration
+	Max          time.Duration
+	Mean         time.Duration
+	StdDev       time.Duration
+}
+
+// ParseLatency parses a latency distribution from a string, in one of these
+// forms:
+//
+//	fixed:200ms
+//	uniform:100ms-500ms
+//	normal:300ms,50ms       (mean, standard deviation)
+//	exponential:200ms       (mean)
+//	exponential:200ms,2s    (mean, max)
+//
+// An empty string (or "none") means no latency.
+func ParseLatency(s string) (Latency, error) {
+	if s == "" || s == "none" {
+		return Latency{}, nil
+	}
+
+	dist, args, ok := strings.Cut(s, ":")
+	if !ok {
+		return Latency{}, fmt.Errorf("invalid latency %q: missing distribution", s)
+	}
+
+	l := Latency{Distribution: LatencyDistribution(dist)}
+	if err := l.parseArgs(args); err != nil {
+		return Latency{}, fmt.Errorf("invalid latency %q: %w", s, err)
+	}
+
+	return l, nil
+}
+
+// parseArgs parses the distribution's parameters, the part of the latency
+// string after the colon
+func (l *Latency) parseArgs(args string) (err error) {
+	switch l.Distribution {
+	case LatencyFixed:
+		l.Mean, err = time.ParseDuration(args)
+	case LatencyUniform:
+		lo, hi, ok := strings.Cut(args, "-")
+		if !ok {
+			return errors.New("uniform needs min-max")
+		}
+		l.Min, l.Max, err = parseDurations(lo, hi)
+	case LatencyNormal:
+		mean, stddev, ok := strings.Cut(args, ",")
+		if !ok {
+			return errors.New("normal needs mean,stddev")
+		}
+		l.Mean, l.StdDev, err = parseDurations(mean, stddev)
+	case LatencyExponential:
+		mean, limit, ok := strings.Cut(args, ",")
+		if ok {
+			l.Mean, l.Max, err = parseDurations(mean, limit)
+		} else {
+			l.Mean, err = time.ParseDuration(mean)
+		}
+	default:
+		return fmt.Errorf("unknown distribution %q", l.Distribution)
+	}
+	return err
+}
+
+func parseDurations(a, b string) (time.Duration, time.Duration, error) {
+	da, err := time.ParseDuration(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	db, err := time.ParseDuration(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	return da, db, nil
+}
+
+// String formats l in the form accepted by ParseLatency
+func (l Latency) String() string {
+	switch l.Distribution {
+	case LatencyFixed:
+		return fmt.Sprintf("fixed:%s", l.Mean)
+	case LatencyUniform:
+		return fmt.Sprintf("uniform:%s-%s", l.Min, l.Max)
+	case LatencyNormal:
+		return fmt.Sprintf("normal:%s,%s", l.Mean, l.StdDev)
+	case LatencyExponential:
+		if l.Max > 0 {
+			return fmt.Sprintf("exponential:%s,%s", l.Mean, l.Max)
+		}
+		return fmt.Sprintf("exponential:%s", l.Mean)
+	default:
+		return "none"
+	}
+}
+
+// sample picks a latency from the distribution
+func (l Latency) sample(rnd *rand.Rand) time.Duration {
+	var d float64
+	switch l.Distribution {
+	case LatencyFixed:
+		d = float64(l.Mean)
+	case LatencyUniform:
+		d = float64(l.Min) + rnd.Float64()*float64(l.Max-l.Min)
+	case LatencyNormal:
+		d = float64(l.Mean) + rnd.NormFloat64()*float64(l.StdDev)
+	case LatencyExponential:
+		d = rnd.ExpFloat64() * float64(l.Mean)
+	default:
+		return 0
+	}
+
+	d = math.Max(d, 0)
+	if l.Max > 0 {
+		d = math.Min(d, float64(l.Max))
+	}
+	return time.Duration(d)
+}
+
+// SetFaults replaces the device's fault configuration
+func (d *Device) SetFaults(f Faults) {
+	d.faultMu.Lock()
+	defer d.faultMu.Unlock()
+	d.faults = f
+
+	// wake any stalled requests, in case the limit was raised
+	close(d.released)
+	d.released = make(chan struct{})
+}
+
+// Faults returns the device's current fault configuration
+func (d *Device) Faults() Faults {
+	d.faultMu.Lock()
+	defer d.faultMu.Unlock()
+	return d.faults
+}
+
+// roll returns true with probability p
+func (d *Device) roll(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	d.faultMu.Lock()
+	defer d.faultMu.Unlock()
+	return d.rnd.Float64() < p
+}
+
+func (d *Device) sampleLatency() time.Duration {
+	d.faultMu.Lock()
+	defer d.faultMu.Unlock()
+	return d.faults.Latency.sample(d.rnd)
+}
+
+// acquire waits for a free request slot, returning false if ctx is done
+// first
+func (d *Device) acquire(ctx context.Context) bool {
+	for {
+		d.faultMu.Lock()
+		limit := d.faults.MaxConcurrent
+		if limit <= 0 || d.active < limit {
+			d.active++
+			d.faultMu.Unlock()
+			return true
+		}
+		released := d.released
+		d.faultMu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (d *Device) release() {
+	d.faultMu.Lock()
+	defer d.faultMu.Unlock()
+	d.active--
+	close(d.released)
+	d.released = make(chan struct{})
+}
+
+// injectFaults applies the configured faults to a request, returning false
+// when the request has been dealt with and shouldn't be handled normally.
+// The caller must call release when it returns true.
+func (d *Device) injectFaults(w http.ResponseWriter, r *http.Request) bool {
+	if !d.acquire(r.Context()) {
+		return false
+	}
+
+	if l := d.sampleLatency(); l > 0 {
+		select {
+		case <-time.After(l):
+		case <-r.Context().Done():
+			d.release()
+			return false
+		}
+	}
+
+	f := d.Faults()
+
+	if d.roll(f.DropRate) {
+		d.release()
+		dropConnection(w)
+		return false
+	}
+
+	if d.roll(f.ErrorRate) {
+		d.release()
+		http.Error(w, "injected fault", http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// dropConnection closes the underlying connection without responding,
+// like a device resetting a keep-alive connection
+func dropConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		// fall back to aborting the response, which also closes the
+		// connection
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
+// writeJSON encodes v to w, truncating it if a malformed response is due
+func (d *Device) writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if d.roll(d.Faults().MalformedRate) {
+		b = b[:len(b)/2]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// AdminHandler returns a handler for viewing and changing the device's
+// faults at runtime. GET returns the current faults as JSON, and POST
+// accepts form values with the same names:
+//
+//	latency         - a distribution, as accepted by ParseLatency
+//	error_rate      - probability (0-1) of a 500 response
+//	drop_rate       - probability (0-1) of dropping the connection
+//	malformed_rate  - probability (0-1) of truncated JSON
+//	max_concurrent  - concurrent request limit (0 for unlimited)
+//
+// Values not present in a POST are left unchanged.
+func (d *Device) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			f, err := parseFaultsForm(r, d.Faults())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			d.SetFaults(f)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		f := d.Faults()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"latency":        f.Latency.String(),
+			"error_rate":     f.ErrorRate,
+			"drop_rate":      f.DropRate,
+			"malformed_rate": f.MalformedRate,
+			"max_concurrent": f.MaxConcurrent,
+		})
+	})
+}
+
+func parseFaultsForm(r *http.Request, f Faults) (Faults, error) {
+	if err := r.ParseForm(); err != nil {
+		return f, err
+	}
+
+	if v, ok := r.Form["latency"]; ok {
+		l, err := ParseLatency(v[0])
+		if err != nil {
+			return f, err
+		}
+		f.Latency = l
+	}
+
+	if err := parseRates(r.Form, &f); err != nil {
+		return f, err
+	}
+
+	if v, ok := r.Form["max_concurrent"]; ok {
+		n, err := strconv.Atoi(v[0])
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("invalid max_concurrent %q", v[0])
+		}
+		f.MaxConcurrent = n
+	}
+
+	return f, nil
+}
+
+// parseRates sets the fault rates given in the form
+func parseRates(form url.Values, f *Faults) error {
+	rates := map[string]*float64{
+		"error_rate":     &f.ErrorRate,
+		"drop_rate":      &f.DropRate,
+		"malformed_rate": &f.MalformedRate,
+	}
+	for k, p := range rates {
+		v, ok := form[k]
+		if !ok {
+			continue
+		}
+		rate, err := strconv.ParseFloat(v[0], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid %s %q: must be between 0 and 1", k, v[0])
+		}
+		*p = rate
+	}
+
+	return nil
+}
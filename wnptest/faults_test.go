@@ -0,0 +1,165 @@
+package wnptest
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLatency(t *testing.T) {
+	testdata := []struct {
+		in       string
+		expected Latency
+	}{
+		{"", Latency{}},
+		{"none", Latency{}},
+		{"fixed:200ms", Latency{Distribution: LatencyFixed, Mean: 200 * time.Millisecond}},
+		{"uniform:100ms-1s", Latency{Distribution: LatencyUniform, Min: 100 * time.Millisecond, Max: time.Second}},
+		{"normal:300ms,50ms", Latency{Distribution: LatencyNormal, Mean: 300 * time.Millisecond, StdDev: 50 * time.Millisecond}},
+		{"exponential:200ms", Latency{Distribution: LatencyExponential, Mean: 200 * time.Millisecond}},
+		{"exponential:200ms,2s", Latency{Distribution: LatencyExponential, Mean: 200 * time.Millisecond, Max: 2 * time.Second}},
+	}
+
+	for _, d := range testdata {
+		actual, err := ParseLatency(d.in)
+		require.NoError(t, err, d.in)
+		assert.Equal(t, d.expected, actual, d.in)
+
+		// round-trips
+		again, err := ParseLatency(actual.String())
+		require.NoError(t, err, d.in)
+		assert.Equal(t, actual, again, d.in)
+	}
+
+	for _, in := range []string{"200ms", "bogus:1s", "fixed:abc", "uniform:1s", "normal:1s", "exponential:1s,x"} {
+		_, err := ParseLatency(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestLatencySample(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1)) //nolint:gosec
+
+	l := Latency{Distribution: LatencyUniform, Min: 10 * time.Millisecond, Max: 20 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		s := l.sample(rnd)
+		assert.GreaterOrEqual(t, s, l.Min)
+		assert.LessOrEqual(t, s, l.Max)
+	}
+
+	l = Latency{Distribution: LatencyExponential, Mean: time.Second, Max: 2 * time.Second}
+	for i := 0; i < 100; i++ {
+		s := l.sample(rnd)
+		assert.GreaterOrEqual(t, s, time.Duration(0))
+		assert.LessOrEqual(t, s, l.Max)
+	}
+
+	l = Latency{Distribution: LatencyNormal, Mean: 0, StdDev: time.Second}
+	for i := 0; i < 100; i++ {
+		assert.GreaterOrEqual(t, l.sample(rnd), time.Duration(0))
+	}
+
+	assert.Equal(t, time.Duration(0), Latency{}.sample(rnd))
+}
+
+func TestFaults(t *testing.T) {
+	srv, dev := NewServer(2)
+	defer srv.Close()
+
+	dev.SetFaults(Faults{ErrorRate: 1})
+	code, _ := do(t, http.MethodGet, srv.URL+"/states", "")
+	assert.Equal(t, http.StatusInternalServerError, code)
+
+	dev.SetFaults(Faults{MalformedRate: 1})
+	code, body := do(t, http.MethodGet, srv.URL+"/states", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Error(t, json.Unmarshal([]byte(body), &[]uint32{}))
+
+	dev.SetFaults(Faults{DropRate: 1})
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/states", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	assert.Error(t, err)
+
+	dev.SetFaults(Faults{Latency: Latency{Distribution: LatencyFixed, Mean: 50 * time.Millisecond}})
+	start := time.Now()
+	code, _ = do(t, http.MethodGet, srv.URL+"/size", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	dev.SetFaults(Faults{})
+	code, _ = do(t, http.MethodGet, srv.URL+"/states", "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	srv, dev := NewServer(2)
+	defer srv.Close()
+
+	dev.SetFaults(Faults{
+		MaxConcurrent: 1,
+		Latency:       Latency{Distribution: LatencyFixed, Mean: 20 * time.Millisecond},
+	})
+
+	// with one request at a time, three requests take at least 3x the
+	// latency
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _ := do(t, http.MethodGet, srv.URL+"/size", "")
+			assert.Equal(t, http.StatusOK, code)
+		}()
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+}
+
+func TestAdminHandler(t *testing.T) {
+	dev := New(2)
+	h := dev.AdminHandler()
+
+	form := url.Values{}
+	form.Set("latency", "uniform:10ms-20ms")
+	form.Set("error_rate", "0.5")
+	form.Set("max_concurrent", "1")
+	req := httptest.NewRequest(http.MethodPost, "/admin/faults", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"latency":"uniform:10ms-20ms","error_rate":0.5,"drop_rate":0,"malformed_rate":0,"max_concurrent":1}`,
+		w.Body.String())
+
+	assert.Equal(t, Faults{
+		Latency:       Latency{Distribution: LatencyUniform, Min: 10 * time.Millisecond, Max: 20 * time.Millisecond},
+		ErrorRate:     0.5,
+		MaxConcurrent: 1,
+	}, dev.Faults())
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/faults?drop_rate=2", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/faults", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"error_rate":0.5`)
+}
@@ -0,0 +1,117 @@
+package wnptest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/mdns"
+)
+
+// ServiceName is the mDNS service type advertised by WiFi NeoPixel devices
+const ServiceName = "_neopixel._tcp"
+
+// Advertisement describes how a fake device announces itself over mDNS
+type Advertisement struct {
+	// Instance is the mDNS service instance name (e.g. "kitchen")
+	Instance string
+	// HostName is the device's hostname - defaults to "<instance>.local."
+	HostName string
+	// IPs are the addresses to advertise - defaults to this host's
+	// non-loopback addresses (or loopback addresses if there are no others)
+	IPs []net.IP
+	// TXT records to advertise, such as "mac=5c:cf:7f:00:00:01"
+	TXT []string
+	// Port is the port the device is listening on
+	Port int
+}
+
+// Advertise registers a _neopixel._tcp service for the device described by
+// a, so that it can be found by mDNS discovery. Several devices can be
+// advertised at once, from one or more processes. Call Shutdown on the
+// returned server to stop advertising.
+func Advertise(a Advertisement) (*mdns.Server, error) {
+	svc, err := a.service()
+	if err != nil {
+		return nil, err
+	}
+
+	srv, err := mdns.NewServer(&mdns.Config{Zone: svc})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start mDNS server: %w", err)
+	}
+
+	return srv, nil
+}
+
+func (a Advertisement) service() (*mdns.MDNSService, error) {
+	host := a.HostName
+	if host == "" {
+		host = hostLabel(a.Instance) + ".local."
+	}
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+
+	ips := a.IPs
+	if len(ips) == 0 {
+		var err error
+		ips, err = localIPs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	svc, err := mdns.NewMDNSService(a.Instance, ServiceName, "", host, a.Port, ips, a.TXT)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mDNS advertisement: %w", err)
+	}
+	return svc, nil
+}
+
+// hostLabel makes a usable hostname from an instance name, which may
+// contain spaces and other characters
+func hostLabel(instance string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, instance)
+}
+
+// localIPs returns this host's unicast addresses, preferring non-loopback
+// ones
+func localIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+
+	ips := []net.IP{}
+	loopback := []net.IP{}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() || ipnet.IP.IsMulticast() {
+			continue
+		}
+		if ipnet.IP.IsLoopback() {
+			loopback = append(loopback, ipnet.IP)
+			continue
+		}
+		ips = append(ips, ipnet.IP)
+	}
+
+	if len(ips) == 0 {
+		ips = loopback
+	}
+	if len(ips) == 0 {
+		host, _ := os.Hostname()
+		return nil, fmt.Errorf("no usable IP addresses found for %s", host)
+	}
+
+	return ips, nil
+}
@@ -0,0 +1,50 @@
+package wnptest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvertisementService(t *testing.T) {
+	a := Advertisement{
+		Instance: "Porch Light",
+		Port:     8888,
+		IPs:      []net.IP{net.ParseIP("192.168.1.5")},
+		TXT:      []string{"mac=5c:cf:7f:00:00:02"},
+	}
+
+	svc, err := a.service()
+	require.NoError(t, err)
+	assert.Equal(t, "Porch-Light.local.", svc.HostName)
+
+	records := svc.Records(dns.Question{Name: "Porch Light._neopixel._tcp.local.", Qtype: dns.TypeANY})
+	require.NotEmpty(t, records)
+
+	var srv *dns.SRV
+	var txt *dns.TXT
+	var a4 *dns.A
+	for _, rr := range records {
+		switch r := rr.(type) {
+		case *dns.SRV:
+			srv = r
+		case *dns.TXT:
+			txt = r
+		case *dns.A:
+			a4 = r
+		}
+	}
+	require.NotNil(t, srv)
+	assert.Equal(t, uint16(8888), srv.Port)
+	assert.Equal(t, "Porch-Light.local.", srv.Target)
+	require.NotNil(t, txt)
+	assert.Equal(t, []string{"mac=5c:cf:7f:00:00:02"}, txt.Txt)
+	require.NotNil(t, a4)
+	assert.Equal(t, "192.168.1.5", a4.A.String())
+
+	_, err = Advertisement{Instance: "no port"}.service()
+	assert.Error(t, err)
+}
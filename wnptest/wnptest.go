@@ -0,0 +1,223 @@
+// Package wnptest provides a fake WiFi NeoPixel device, for testing clients
+// without hardware. It mimics the device firmware's HTTP API:
+//
+//	GET  /states - the colour of each pixel, as a JSON array of 0xRRGGBB values
+//	GET  /size   - the number of pixels, as plain text
+//	POST /raw    - set pixel colours from a JSON array of 0xRRGGBB values
+//	GET  /clear  - turn all pixels off
+package wnptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Device is a fake WiFi NeoPixel strip. It implements http.Handler, so it
+// can be served with httptest.NewServer or any other HTTP server.
+//
+// By default the device is well-behaved, but it can be made slow and flaky
+// with SetFaults.
+type Device struct {
+	mux      *http.ServeMux
+	rnd      *rand.Rand
+	released chan struct{}
+	states   []uint32
+	requests []Request
+	onChange []func(states []uint32)
+	faults   Faults
+	active   int
+	mu       sync.RWMutex
+	faultMu  sync.Mutex
+}
+
+// Request is a record of a request received by the device
+type Request struct {
+	Time   time.Time
+	Method string
+	Path   string
+	Body   []byte
+}
+
+// New returns a fake device with the given number of pixels, all off.
+func New(length int) *Device {
+	d := &Device{
+		states:   make([]uint32, length),
+		mux:      http.NewServeMux(),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec
+		released: make(chan struct{}),
+	}
+
+	d.mux.HandleFunc("/clear", d.handleClear)
+	d.mux.HandleFunc("/raw", d.handleRaw)
+	d.mux.HandleFunc("/size", d.handleSize)
+	d.mux.HandleFunc("/states", d.handleStates)
+
+	return d
+}
+
+// NewServer starts a fake device with the given number of pixels, served by
+// a new httptest.Server. The caller should call Close on the server when
+// finished.
+func NewServer(length int) (*httptest.Server, *Device) {
+	d := New(length)
+	return httptest.NewServer(d), d
+}
+
+// ServeHTTP records the request, injects any configured faults, and
+// dispatches it to the appropriate endpoint.
+func (d *Device) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	d.mu.Lock()
+	d.requests = append(d.requests, Request{
+		Time:   time.Now(),
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Body:   body,
+	})
+	d.mu.Unlock()
+
+	if !d.injectFaults(w, r) {
+		return
+	}
+	defer d.release()
+
+	d.mux.ServeHTTP(w, r)
+}
+
+func (d *Device) handleClear(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	d.Update(func(states []uint32) {
+		for i := range states {
+			states[i] = 0
+		}
+	})
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("OK"))
+}
+
+func (d *Device) handleRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	raw := []uint32{}
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// like the firmware, set as many pixels as were given, ignoring any
+	// beyond the end of the strip
+	d.Update(func(states []uint32) {
+		copy(states, raw)
+	})
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("OK"))
+}
+
+func (d *Device) handleSize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(strconv.Itoa(d.Len())))
+}
+
+func (d *Device) handleStates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	d.writeJSON(w, d.States())
+}
+
+// Len returns the number of pixels in the strip
+func (d *Device) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.states)
+}
+
+// States returns a copy of the current colour of each pixel
+func (d *Device) States() []uint32 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	s := make([]uint32, len(d.states))
+	copy(s, d.states)
+	return s
+}
+
+// SetStates sets the pixels out-of-band, as though something other than the
+// client under test had changed them. Values beyond the end of the strip are
+// ignored.
+func (d *Device) SetStates(states []uint32) {
+	d.Update(func(s []uint32) {
+		copy(s, states)
+	})
+}
+
+// Update calls fn with the device's pixels, which fn may modify in place.
+// The device is locked while fn runs. Functions registered with OnChange are
+// called afterwards.
+func (d *Device) Update(fn func(states []uint32)) {
+	d.mu.Lock()
+	fn(d.states)
+	states := make([]uint32, len(d.states))
+	copy(states, d.states)
+	onChange := d.onChange
+	d.mu.Unlock()
+
+	for _, f := range onChange {
+		f(states)
+	}
+}
+
+// OnChange registers fn to be called with a copy of the pixels whenever
+// they're set, whether by a client (/raw or /clear) or out-of-band.
+func (d *Device) OnChange(fn func(states []uint32)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onChange = append(d.onChange, fn)
+}
+
+// Requests returns the requests received so far, in order
+func (d *Device) Requests() []Request {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	r := make([]Request, len(d.requests))
+	copy(r, d.requests)
+	return r
+}
+
+// ResetRequests clears the request log
+func (d *Device) ResetRequests() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests = nil
+}
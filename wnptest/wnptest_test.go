@@ -0,0 +1,98 @@
+package wnptest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), method, url, strings.NewReader(body))
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp.StatusCode, string(b)
+}
+
+func TestDevice(t *testing.T) {
+	srv, dev := NewServer(4)
+	defer srv.Close()
+
+	changes := [][]uint32{}
+	dev.OnChange(func(states []uint32) {
+		changes = append(changes, states)
+	})
+
+	code, body := do(t, http.MethodGet, srv.URL+"/size", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "4", body)
+
+	code, body = do(t, http.MethodGet, srv.URL+"/states", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, "[0,0,0,0]", body)
+
+	code, _ = do(t, http.MethodPost, srv.URL+"/raw", "[16711680,65280,255,16777215]")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []uint32{0xff0000, 0x00ff00, 0x0000ff, 0xffffff}, dev.States())
+
+	// short payloads only set the leading pixels, long ones are truncated
+	code, _ = do(t, http.MethodPost, srv.URL+"/raw", "[1]")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []uint32{1, 0x00ff00, 0x0000ff, 0xffffff}, dev.States())
+
+	code, _ = do(t, http.MethodPost, srv.URL+"/raw", "[1,2,3,4,5,6]")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []uint32{1, 2, 3, 4}, dev.States())
+
+	code, body = do(t, http.MethodGet, srv.URL+"/size", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "4", body)
+
+	code, _ = do(t, http.MethodPost, srv.URL+"/raw", "[1,2,")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do(t, http.MethodGet, srv.URL+"/raw", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, _ = do(t, http.MethodGet, srv.URL+"/clear", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []uint32{0, 0, 0, 0}, dev.States())
+
+	// out-of-band changes are visible to clients
+	dev.SetStates([]uint32{9, 8})
+	_, body = do(t, http.MethodGet, srv.URL+"/states", "")
+	states := []uint32{}
+	require.NoError(t, json.Unmarshal([]byte(body), &states))
+	assert.Equal(t, []uint32{9, 8, 0, 0}, states)
+
+	reqs := dev.Requests()
+	require.Len(t, reqs, 10)
+	assert.Equal(t, http.MethodPost, reqs[2].Method)
+	assert.Equal(t, "/raw", reqs[2].Path)
+	assert.Equal(t, "[16711680,65280,255,16777215]", string(reqs[2].Body))
+
+	assert.Equal(t, [][]uint32{
+		{0xff0000, 0x00ff00, 0x0000ff, 0xffffff},
+		{1, 0x00ff00, 0x0000ff, 0xffffff},
+		{1, 2, 3, 4},
+		{0, 0, 0, 0},
+		{9, 8, 0, 0},
+	}, changes)
+
+	dev.ResetRequests()
+	assert.Empty(t, dev.Requests())
+}